@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/femnad/passfuse/pkg/pass"
+	"io"
+	"text/tabwriter"
+	"time"
+)
+
+type benchmarkRun struct {
+	name     string
+	secrets  int
+	failures int
+	bytes    int
+	elapsed  time.Duration
+}
+
+func perSecond(count int, elapsed time.Duration) string {
+	if elapsed <= 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.1f", float64(count)/elapsed.Seconds())
+}
+
+// benchmarkReads decrypts the secrets one after another, the same way reading their content files does.
+func benchmarkReads(name string, leaves []pass.Node) benchmarkRun {
+	run := benchmarkRun{name: name, secrets: len(leaves)}
+	start := time.Now()
+	for _, leaf := range leaves {
+		content, err := pass.GetSecret(context.Background(), leaf.Secret)
+		if err != nil {
+			run.failures++
+			continue
+		}
+		run.bytes += len(content)
+	}
+	run.elapsed = time.Since(start)
+	return run
+}
+
+// benchmark times decrypting up to the given number of secrets under the prefix twice, so that the first run includes
+// any passphrase prompts of the GPG agent and the second one shows decrypting with its cache populated. Nothing is
+// mounted or written.
+func benchmark(args args, w io.Writer) error {
+	root, err := pass.GetPassTree(args.PasswordStorePath, args.Prefix, pass.ParseOptions{StrictGpg: args.StrictGpg})
+	if err != nil {
+		return err
+	}
+	leaves := pass.GetLeaves(root)
+	if len(leaves) > args.Benchmark {
+		leaves = leaves[:args.Benchmark]
+	}
+	if len(leaves) == 0 {
+		return fmt.Errorf("no secrets found for benchmarking")
+	}
+
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "run\tsecrets\tfailures\ttime\tsecrets/s\tbytes/s")
+	for _, name := range []string{"first", "repeated"} {
+		run := benchmarkReads(name, leaves)
+		fmt.Fprintf(table, "%s\t%d\t%d\t%s\t%s\t%s\n", run.name, run.secrets, run.failures,
+			run.elapsed.Round(time.Millisecond), perSecond(run.secrets, run.elapsed), perSecond(run.bytes, run.elapsed))
+	}
+	return table.Flush()
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestBenchmark(t *testing.T) {
+	storePath := makeStore(t, "work/github.gpg", "work/aws.gpg", "personal/mail.gpg")
+	defer os.RemoveAll(storePath)
+	setSecrets(map[string]string{"work/github": "hunter2\n", "work/aws": "hunter3\n"})
+
+	report := bytes.Buffer{}
+	err := benchmark(args{Benchmark: 2, PasswordStorePath: storePath, StrictGpg: true}, &report)
+	if err != nil {
+		t.Fatalf("Error benchmarking: %s", err)
+	}
+	lines := strings.Split(strings.TrimSpace(report.String()), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[0], "run") {
+		t.Fatalf("Expected a header and two runs, got %q", report.String())
+	}
+	for _, line := range lines[1:] {
+		fields := strings.Fields(line)
+		// Only personal/mail fails, and it's one of the first two secrets in tree order.
+		if fields[1] != "2" || fields[2] != "1" {
+			t.Errorf("Expected 2 secrets with 1 failure, got %q", line)
+		}
+	}
+
+	err = benchmark(args{Benchmark: 2, PasswordStorePath: storePath, Prefix: "missing"}, &report)
+	if err == nil {
+		t.Errorf("Expected benchmarking a missing prefix to fail")
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/femnad/passfuse/pkg/fs"
+	"github.com/femnad/passfuse/pkg/pass"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const gpgIdFile = ".gpg-id"
+
+type checkCategory struct {
+	name     string
+	isError  bool
+	problems []string
+}
+
+// hasGpgId returns whether a directory, or one of its parents within the store, has a .gpg-id file.
+func hasGpgId(storePath, dir string) bool {
+	for {
+		_, err := os.Stat(filepath.Join(dir, gpgIdFile))
+		if err == nil {
+			return true
+		}
+		if dir == storePath || !strings.HasPrefix(dir, storePath) {
+			return false
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// walkStore reports directories without an applicable .gpg-id, broken symlinks and files which aren't secrets under
+// the prefix, skipping hidden files and directories like pass does.
+func walkStore(storePath, prefix string, missingIds, brokenLinks, nonSecrets *checkCategory) error {
+	root := filepath.Join(storePath, prefix)
+	_, err := os.Stat(root + pass.GetSecretSuffix())
+	if prefix != "" && err == nil {
+		return nil
+	}
+
+	return filepath.Walk(root, func(walkedPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relative := strings.TrimPrefix(strings.TrimPrefix(walkedPath, storePath), "/")
+		if strings.HasPrefix(info.Name(), ".") && walkedPath != root {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		switch {
+		case info.IsDir():
+			if !hasGpgId(storePath, walkedPath) {
+				missingIds.problems = append(missingIds.problems, "/"+relative)
+			}
+		case info.Mode()&os.ModeSymlink != 0:
+			_, err := os.Stat(walkedPath)
+			if err != nil {
+				brokenLinks.problems = append(brokenLinks.problems, relative)
+			}
+		case !strings.HasSuffix(info.Name(), pass.GetSecretSuffix()):
+			nonSecrets.problems = append(nonSecrets.problems, relative)
+		}
+		return nil
+	})
+}
+
+// check reports problems with the store under the prefix by category, returning whether there are no errors.
+func check(args args, w io.Writer) (bool, error) {
+	storePath := pass.GetStorePath(args.PasswordStorePath)
+	prefix := strings.Trim(args.Prefix, "/")
+	decryption := checkCategory{name: "secrets failing to decrypt", isError: true}
+	missingIds := checkCategory{name: "directories without a .gpg-id", isError: true}
+	brokenLinks := checkCategory{name: "broken symlinks", isError: true}
+	collisions := checkCategory{name: "name collisions", isError: true}
+	nonSecrets := checkCategory{name: "files which aren't secrets"}
+
+	err := walkStore(storePath, prefix, &missingIds, &brokenLinks, &nonSecrets)
+	if err != nil {
+		return false, fmt.Errorf("error walking store %s: %s", storePath, err)
+	}
+
+	root, err := pass.GetPassTree(storePath, prefix, pass.ParseOptions{StrictGpg: args.StrictGpg})
+	if err != nil {
+		return false, err
+	}
+	for _, leaf := range pass.GetLeaves(root) {
+		_, err := pass.GetSecret(context.Background(), leaf.Secret)
+		if err != nil {
+			decryption.problems = append(decryption.problems, fmt.Sprintf("%s: %s", leaf.Secret, err))
+		}
+	}
+
+	collisions.problems, err = fs.FindNameCollisions(storePath, prefix, getOptions(args))
+	if err != nil {
+		return false, err
+	}
+
+	healthy := true
+	for _, category := range []checkCategory{decryption, missingIds, brokenLinks, collisions, nonSecrets} {
+		if len(category.problems) == 0 {
+			continue
+		}
+		level := "warning"
+		if category.isError {
+			level = "error"
+			healthy = false
+		}
+		fmt.Fprintf(w, "%s: %s\n", level, category.name)
+		for _, problem := range category.problems {
+			fmt.Fprintf(w, "  %s\n", problem)
+		}
+	}
+	return healthy, nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheck(t *testing.T) {
+	storePath := makeStore(t, ".gpg-id", "work/github.gpg", "work/notes.txt", "foo.gpg", "foo.contents/bar.gpg",
+		"personal/mail.gpg")
+	defer os.RemoveAll(storePath)
+	err := os.Symlink(filepath.Join(storePath, "missing.gpg"), filepath.Join(storePath, "work/dangling"))
+	if err != nil {
+		t.Fatalf("Error creating symlink: %s", err)
+	}
+	setSecrets(map[string]string{"work/github": "hunter2\n", "foo": "foo\n", "foo.contents/bar": "bar\n"})
+
+	report := bytes.Buffer{}
+	healthy, err := check(args{ContentFiles: true, PasswordStorePath: storePath, StrictGpg: true}, &report)
+	if err != nil {
+		t.Fatalf("Error checking: %s", err)
+	}
+	if healthy {
+		t.Errorf("Expected check to fail")
+	}
+	for _, expected := range []string{"error: secrets failing to decrypt\n  personal/mail.gpg: ",
+		"error: broken symlinks\n  work/dangling\n", "error: name collisions\n  foo.contents\n",
+		"warning: files which aren't secrets\n  work/notes.txt\n"} {
+		if !strings.Contains(report.String(), expected) {
+			t.Errorf("Expected report to contain %q, got %q", expected, report.String())
+		}
+	}
+	if strings.Contains(report.String(), ".gpg-id") {
+		t.Errorf("Expected the root .gpg-id to apply to all directories, got %q", report.String())
+	}
+}
+
+func TestCheckMissingGpgId(t *testing.T) {
+	storePath := makeStore(t, "work/.gpg-id", "work/github.gpg", "personal/mail.gpg")
+	defer os.RemoveAll(storePath)
+	setSecrets(map[string]string{"work/github": "hunter2\n", "personal/mail": "hunter3\n"})
+
+	report := bytes.Buffer{}
+	healthy, err := check(args{ContentFiles: true, PasswordStorePath: storePath, StrictGpg: true}, &report)
+	if err != nil {
+		t.Fatalf("Error checking: %s", err)
+	}
+	if healthy {
+		t.Errorf("Expected check to fail")
+	}
+	expected := "error: directories without a .gpg-id\n  /\n  /personal\n"
+	if report.String() != expected {
+		t.Errorf("Expected report %q, got %q", expected, report.String())
+	}
+
+	report.Reset()
+	healthy, err = check(args{ContentFiles: true, PasswordStorePath: storePath, Prefix: "work", StrictGpg: true}, &report)
+	if err != nil {
+		t.Fatalf("Error checking: %s", err)
+	}
+	if !healthy || report.Len() != 0 {
+		t.Errorf("Expected the work prefix to be healthy, got %q", report.String())
+	}
+}
@@ -6,5 +6,7 @@ require (
 	github.com/alexflint/go-arg v1.2.0
 	github.com/jacobsa/fuse v0.0.0-20191211084903-4898d79241b8
 	github.com/kylelemons/godebug v1.1.0 // indirect
+	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
 	golang.org/x/sys v0.0.0-20191220220014-0732a990476f // indirect
+	golang.org/x/text v0.3.2
 )
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// jsonLogLine is a log line as a JSON object, with the name of the instance and the message. Messages only have the
+// names of secrets and errors, never their contents.
+type jsonLogLine struct {
+	Ts   string `json:"ts"`
+	Name string `json:"name"`
+	Msg  string `json:"msg"`
+}
+
+// jsonLogWriter writes each message it gets as a line with a JSON object, for loggers without a prefix and flags. The
+// loggers of passfuse and of the FUSE server write to it concurrently, so writes are serialized.
+type jsonLogWriter struct {
+	writer io.Writer
+	name   string
+	mutex  sync.Mutex
+	now    func() time.Time
+}
+
+func newJSONLogWriter(writer io.Writer, name string) *jsonLogWriter {
+	return &jsonLogWriter{writer: writer, name: name, now: time.Now}
+}
+
+func (w *jsonLogWriter) Write(p []byte) (int, error) {
+	line := jsonLogLine{
+		Ts:   w.now().UTC().Format(time.RFC3339Nano),
+		Name: w.name,
+		Msg:  strings.TrimSuffix(string(p), "\n"),
+	}
+	encoded, err := json.Marshal(line)
+	if err != nil {
+		return 0, err
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	_, err = w.writer.Write(append(encoded, '\n'))
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
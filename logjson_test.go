@@ -0,0 +1,30 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJSONLogWriter(t *testing.T) {
+	var output bytes.Buffer
+	writer := newJSONLogWriter(&output, "passfuse")
+	writer.now = func() time.Time {
+		return time.Date(2024, 3, 14, 10, 0, 0, 0, time.UTC)
+	}
+	logger := log.New(writer, "", 0)
+	logger.Printf("Denied decrypting %s", "work/github.gpg")
+	logger.Print("error getting secret mail: exit status 2: gpg: decryption failed\n\"quoted\"")
+
+	expected := `{"ts":"2024-03-14T10:00:00Z","name":"passfuse","msg":"Denied decrypting work/github.gpg"}` + "\n" +
+		`{"ts":"2024-03-14T10:00:00Z","name":"passfuse",` +
+		`"msg":"error getting secret mail: exit status 2: gpg: decryption failed\n\"quoted\""}` + "\n"
+	if output.String() != expected {
+		t.Errorf("Expected JSON lines %q, got %q", expected, output.String())
+	}
+	if strings.Count(output.String(), "\n") != 2 {
+		t.Errorf("Expected a line per message, got %q", output.String())
+	}
+}
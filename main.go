@@ -6,90 +6,722 @@ import (
 	"fmt"
 	"github.com/alexflint/go-arg"
 	"github.com/femnad/passfuse/pkg/fs"
+	"github.com/femnad/passfuse/pkg/pass"
 	"github.com/jacobsa/fuse"
+	"io/ioutil"
+	"log"
 	"os"
 	"os/signal"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
 	"time"
 )
 
 const (
-	mountPathPermission = 0700
-	unmountSleep        = 5
-	version             = "0.1.5"
+	exportDirPermission  = 0700
+	exportFilePermission = 0600
+	mountPathPermission  = 0700
+	readyPollInterval    = 50 * time.Millisecond
+	version              = "0.1.5"
+)
+
+// Build metadata, set when linking, e.g. with -ldflags "-X main.commit=$(git rev-parse --short HEAD)"
+var (
+	commit    string
+	buildDate string
 )
 
 type args struct {
-	ContentFiles      bool   `default:"true" arg:"-C"`
-	CreateMountPath   bool   `default:"true" arg:"-c"`
-	FirstLineFiles    bool   `default:"false" arg:"-f"`
-	MountPath         string `default:"$HOME/.mnt/passfuse" arg:"-m"`
-	PasswordStorePath string `arg:"-s"`
-	Prefix            string `arg:"-p"`
-	UnmountAfter      int    `arg:"-u"`
+	AgeFiles          bool     `default:"false" arg:"--age-files"`
+	AgeSuffix         string   `default:".age" arg:"--age-suffix"`
+	Aliases           []string `arg:"--alias,separate"`
+	AllEnv            bool     `default:"false" arg:"--all-env"`
+	AllowReadFile     string   `arg:"--allow-read-file"`
+	Benchmark         int      `default:"0" arg:"--benchmark"`
+	ByDate            string   `arg:"--by-date"`
+	ByTag             bool     `default:"false" arg:"--by-tag"`
+	CacheContents     bool     `default:"true" arg:"--cache-contents"`
+	CacheSizes        bool     `default:"true" arg:"--cache-sizes"`
+	Check             bool     `default:"false" arg:"--check"`
+	CommandTimeout    int      `default:"0" arg:"--command-timeout"`
+	Config            string   `arg:"--config"`
+	ContentFiles      bool     `default:"true" arg:"-C"`
+	CreateMountPath   bool     `default:"true" arg:"-c"`
+	Demo              bool     `default:"false" arg:"--demo"`
+	DirectoriesOnly   bool     `default:"false" arg:"--directories-only"`
+	DirFiles          []string `arg:"--dir-files,separate"`
+	EnableCurrent     bool     `default:"false" arg:"--enable-current"`
+	EnableLock        bool     `default:"false" arg:"--enable-lock"`
+	EnableSearch      bool     `default:"false" arg:"--enable-search"`
+	EnableTarExport   bool     `default:"false" arg:"--enable-tar-export"`
+	EnvNames          bool     `default:"false" arg:"--env-names"`
+	Export            string   `arg:"--export"`
+	FieldDirs         bool     `default:"false" arg:"--field-dirs"`
+	FieldPattern      string   `arg:"--field-pattern"`
+	FirstLineFiles    bool     `default:"false" arg:"-f"`
+	FirstLineStripKey bool     `default:"false" arg:"--first-line-strip-key"`
+	FollowStoreLink   bool     `default:"false" arg:"--follow-store-link"`
+	FramedFiles       bool     `default:"false" arg:"--framed-files"`
+	GnupgHome         string   `arg:"--gnupghome"`
+	HasField          string   `arg:"--has-field"`
+	HideSizes         bool     `default:"false" arg:"--hide-sizes"`
+	HistoryFiles      bool     `default:"false" arg:"-H"`
+	IniFiles          bool     `default:"false" arg:"--ini-files"`
+	IUnderstand       bool     `default:"false" arg:"--i-understand-plaintext"`
+	IncludePassword   bool     `default:"false" arg:"--include-password-in-views"`
+	InputEncoding     string   `arg:"--input-encoding"`
+	LogJSON           bool     `default:"false" arg:"--log-json"`
+	LowercaseNames    bool     `default:"false" arg:"--lowercase-names"`
+	MaxOpenFiles      int      `default:"1024" arg:"--max-open-files"`
+	MaxSecretSize     int64    `default:"0" arg:"--max-secret-size"`
+	Mirror            bool     `default:"false" arg:"--mirror"`
+	MountPath         string   `default:"$HOME/.mnt/passfuse" arg:"-m"`
+	MountTimeout      int      `default:"30" arg:"--mount-timeout"`
+	Name              string   `arg:"--name"`
+	NameCollisions    string   `default:"suffix" arg:"--name-collision"`
+	NoAttrCache       bool     `default:"false" arg:"--no-attr-cache"`
+	NoDecrypt         bool     `default:"false" arg:"--no-decrypt"`
+	Notify            bool     `default:"false" arg:"--notify"`
+	OneShotFirstLine  bool     `default:"false" arg:"--one-shot-first-line"`
+	OneShotWindow     int      `default:"45" arg:"--one-shot-window"`
+	OpTimeout         int      `default:"60" arg:"--op-timeout"`
+	Overlay           string   `arg:"--overlay"`
+	PasswordField     string   `arg:"--password-field"`
+	PasswordStorePath string   `arg:"-s"`
+	PasswordToBlank   bool     `default:"false" arg:"--password-until-blank"`
+	PersistSizeCache  bool     `default:"false" arg:"--persist-size-cache"`
+	PrintConfig       bool     `default:"false" arg:"--print-config"`
+	Prefix            string   `arg:"-p"`
+	QrField           string   `arg:"--qr-field"`
+	QrFiles           bool     `default:"false" arg:"--qr-files"`
+	Probe             bool     `default:"false" arg:"--probe"`
+	Remote            string   `arg:"--remote"`
+	RemoteSessions    int      `default:"4" arg:"--remote-sessions"`
+	Revision          string   `arg:"--revision"`
+	RootName          string   `arg:"--root-name"`
+	SecretSuffix      string   `default:".gpg" arg:"--secret-suffix"`
+	ShowCommand       string   `default:"pass show {name}" arg:"--show-command"`
+	ShowControl       bool     `default:"false" arg:"--show-control"`
+	ShowRecipients    bool     `default:"false" arg:"--show-recipients"`
+	SingleSecret      string   `arg:"--single"`
+	SnapshotWindow    int      `default:"0" arg:"--snapshot-window"`
+	StatsInterval     int      `default:"0" arg:"--stats-interval"`
+	StoreRetries      int      `default:"0" arg:"--store-retries"`
+	StrictGpg         bool     `default:"true" arg:"--strict-gpg"`
+	StrictPerms       bool     `default:"false" arg:"--strict-perms"`
+	Templates         bool     `default:"false" arg:"--templates"`
+	TomlFiles         bool     `default:"false" arg:"--toml-files"`
+	TrimFirstLine     bool     `default:"false" arg:"--trim-first-line"`
+	UnmountAfter      int      `arg:"-u"`
+	UnmountInterval   int      `default:"5" arg:"--unmount-interval"`
+	Verify            string   `arg:"--verify"`
+	WaitReady         bool     `default:"false" arg:"--wait-ready"`
+	WaitReadyTimeout  int      `default:"10" arg:"--wait-ready-timeout"`
+	WarnWorldReadable bool     `default:"true" arg:"--warn-world-readable"`
+	WatchAgent        bool     `default:"false" arg:"--watch-agent"`
 }
 
 func (args) Version() string {
-	return version
+	return formatVersion(version, commit, buildDate)
 }
 
-func unmount(mountPath string) {
+// formatVersion returns the version followed by the build metadata which is known, keeping the version as the first
+// word for scripts parsing it, e.g. 0.1.5 (commit 1a2b3c4, built 2024-03-14).
+func formatVersion(version, commit, buildDate string) string {
+	var metadata []string
+	if commit != "" {
+		metadata = append(metadata, "commit "+commit)
+	}
+	if buildDate != "" {
+		metadata = append(metadata, "built "+buildDate)
+	}
+	if len(metadata) == 0 {
+		return version
+	}
+	return fmt.Sprintf("%s (%s)", version, strings.Join(metadata, ", "))
+}
+
+// unmount interrupts reads in flight and retries unmounting until the mount point is no longer busy.
+func unmount(server *fs.Server, mountPath string, interval int) {
+	server.Interrupt()
 	for {
 		err := fuse.Unmount(mountPath)
 		if err != nil {
-			fmt.Printf("Unmount error %v, sleeping for %d seconds\n", err, unmountSleep)
-			time.Sleep(time.Second * unmountSleep)
+			log.Printf("Unmount error %v, sleeping for %d seconds\n", err, interval)
+			time.Sleep(time.Second * time.Duration(interval))
 		} else {
 			break
 		}
 	}
 }
 
-func main() {
-	args := args{}
-	arg.MustParse(&args)
+// mountWithTimeout runs the mount function, failing if mounting doesn't finish within the timeout. A timeout of 0 waits
+// for mounting to finish however long it takes.
+func mountWithTimeout(mount func() (*fuse.MountedFileSystem, error),
+	timeout time.Duration) (*fuse.MountedFileSystem, error) {
+	if timeout == 0 {
+		return mount()
+	}
+	type result struct {
+		mountedFS *fuse.MountedFileSystem
+		err       error
+	}
+	done := make(chan result, 1)
+	go func() {
+		mountedFS, err := mount()
+		done <- result{mountedFS, err}
+	}()
+	select {
+	case mounted := <-done:
+		return mounted.mountedFS, mounted.err
+	case <-time.After(timeout):
+		return nil, fmt.Errorf("mounting didn't finish within %s, check that FUSE is available", timeout)
+	}
+}
 
-	options := fs.PassFsOptions{ContentFiles: args.ContentFiles, FirstLineFiles: args.FirstLineFiles}
-	server, err := fs.NewPassFS(args.PasswordStorePath, args.Prefix, options)
+// isMountRoot returns whether a path is the root of a mount, i.e. it's on a different device than its parent directory.
+func isMountRoot(mountPath string) (bool, error) {
+	var mount, parent syscall.Stat_t
+	err := syscall.Stat(mountPath, &mount)
 	if err != nil {
-		fmt.Printf("Error initializing filesystem %s\n", err)
-		os.Exit(1)
+		return false, err
+	}
+	err = syscall.Stat(filepath.Dir(mountPath), &parent)
+	if err != nil {
+		return false, err
+	}
+	return mount.Dev != parent.Dev, nil
+}
+
+// waitReady polls the mount path until it's the root of the mount, which means the kernel has served a stat of it from
+// the filesystem, failing if that doesn't happen within the timeout.
+func waitReady(mountPath string, timeout, interval time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		ready, err := isMountRoot(mountPath)
+		if ready {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			if err != nil {
+				return fmt.Errorf("mount at %s wasn't ready within %s: %s", mountPath, timeout, err)
+			}
+			return fmt.Errorf("mount at %s wasn't ready within %s", mountPath, timeout)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// getName returns the name identifying this instance in logs and mount options, defaulting to the base name of the
+// mount path.
+func getName(name, mountPath string) string {
+	if name != "" {
+		return name
+	}
+	return filepath.Base(mountPath)
+}
+
+// resolveMountPath expands environment variables in the mount path and makes it absolute, so that it stays the same
+// regardless of the working directory.
+func resolveMountPath(mountPath string) (string, error) {
+	return filepath.Abs(os.ExpandEnv(mountPath))
+}
+
+// existingParent returns the closest parent of a path which exists.
+func existingParent(dirPath string) string {
+	parent := filepath.Dir(dirPath)
+	for parent != filepath.Dir(parent) {
+		_, err := os.Stat(parent)
+		if err == nil {
+			break
+		}
+		parent = filepath.Dir(parent)
 	}
+	return parent
+}
 
-	cfg := &fuse.MountConfig{}
-	mountPath := os.ExpandEnv(args.MountPath)
-	_, err = os.Stat(mountPath)
-	if errors.Is(err, os.ErrNotExist) && args.CreateMountPath {
+// prepareMountPath creates the mount path if it doesn't exist and creating it is enabled, and makes it accessible only
+// to the current user. Failures due to permissions suggest how to fix them, e.g. when the mount path is under /mnt.
+func prepareMountPath(mountPath string, create bool) error {
+	_, err := os.Stat(mountPath)
+	if errors.Is(err, os.ErrNotExist) && create {
 		err = os.MkdirAll(mountPath, mountPathPermission)
-		if err != nil {
-			panic(err)
+		if errors.Is(err, os.ErrPermission) {
+			return fmt.Errorf("can't create mount path %s, %s isn't writable by the current user. Use a mount path "+
+				"in a directory you own, e.g. under $HOME, or create %s and make it owned by the current user",
+				mountPath, existingParent(mountPath), mountPath)
+		} else if err != nil {
+			return fmt.Errorf("error creating mount path %s: %s", mountPath, err)
 		}
+	} else if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("error checking mount path %s: %s", mountPath, err)
 	} else if err == nil {
-		err := os.Chmod(mountPath, mountPathPermission)
+		err = os.Chmod(mountPath, mountPathPermission)
+		if errors.Is(err, os.ErrPermission) {
+			return fmt.Errorf("can't restrict the permissions of mount path %s, it isn't owned by the current user. "+
+				"Use a mount path you own or make it owned by the current user", mountPath)
+		} else if err != nil {
+			return fmt.Errorf("error restricting the permissions of mount path %s: %s", mountPath, err)
+		}
+	}
+	return nil
+}
+
+func exportNode(node pass.Node, exportPath string) error {
+	if node.IsLeaf {
+		secretContent, err := pass.GetSecret(context.Background(), node.Secret)
+		if err != nil {
+			return err
+		}
+		filePath := path.Join(exportPath, strings.TrimSuffix(node.Secret, pass.GetSecretSuffix()))
+		err = os.MkdirAll(path.Dir(filePath), exportDirPermission)
+		if err != nil {
+			return fmt.Errorf("error creating export directory for %s: %s", node.Secret, err)
+		}
+		err = ioutil.WriteFile(filePath, []byte(secretContent), exportFilePermission)
 		if err != nil {
-			panic(err)
+			return fmt.Errorf("error exporting secret %s: %s", node.Secret, err)
 		}
+		return nil
 	}
 
-	mountedFS, err := fuse.Mount(mountPath, server, cfg)
+	for _, child := range node.Children {
+		err := exportNode(child, exportPath)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func export(args args) error {
+	if !args.IUnderstand {
+		return fmt.Errorf("exporting writes decrypted secrets as plaintext files, " +
+			"use --i-understand-plaintext to confirm")
+	}
+	fmt.Fprintf(os.Stderr, "WARNING: writing decrypted secrets as plaintext files to %s\n", args.Export)
+
+	root, err := pass.GetPassTree(args.PasswordStorePath, args.Prefix, pass.ParseOptions{StrictGpg: args.StrictGpg})
+	if err != nil {
+		return err
+	}
+	return exportNode(root, os.ExpandEnv(args.Export))
+}
+
+// readConfigArgs reads arguments from a config file with one argument per line, ignoring empty lines and lines
+// starting with #.
+func readConfigArgs(configPath string) ([]string, error) {
+	content, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("error reading config file %s: %s", configPath, err)
+	}
+	var configArgs []string
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		configArgs = append(configArgs, line)
+	}
+	return configArgs, nil
+}
+
+// parseArgs parses command line arguments, preceded by the arguments in the config file if one is given so that
+// command line arguments take precedence.
+func parseArgs(cmdArgs []string) (parsed args, parser *arg.Parser, err error) {
+	parser, err = arg.NewParser(arg.Config{}, &parsed)
+	if err != nil {
+		return
+	}
+	err = parser.Parse(cmdArgs)
+	if err != nil || parsed.Config == "" {
+		return
+	}
+
+	configArgs, err := readConfigArgs(os.ExpandEnv(parsed.Config))
+	if err != nil {
+		return
+	}
+	parsed = args{}
+	err = parser.Parse(append(configArgs, cmdArgs...))
+	return
+}
+
+func getOptions(args args) fs.PassFsOptions {
+	return fs.PassFsOptions{
+		ContentFiles:     args.ContentFiles,
+		FirstLineFiles:   args.FirstLineFiles,
+		StrictGpg:        args.StrictGpg,
+		OneShotFirstLine: args.OneShotFirstLine,
+		OneShotWindow:    time.Second * time.Duration(args.OneShotWindow),
+		PersistSizeCache: args.PersistSizeCache,
+		NoSizeCache:      !args.CacheSizes,
+		NoContentCache:   !args.CacheContents,
+		Probe:            args.Probe,
+		DirectoriesOnly:  args.DirectoriesOnly,
+		HistoryFiles:     args.HistoryFiles,
+		FieldDirs:        args.FieldDirs,
+		NoDecrypt:        args.NoDecrypt,
+		EnableCurrent:    args.EnableCurrent,
+		ShowControl:      args.ShowControl,
+		EnableLock:       args.EnableLock,
+		Notify:           args.Notify,
+		Mirror:           args.Mirror,
+		HasField:         args.HasField,
+		FieldPattern:     args.FieldPattern,
+		EnvNames:         args.EnvNames,
+		MaxOpenFiles:     args.MaxOpenFiles,
+		ByTag:            args.ByTag,
+		ByDate:           args.ByDate,
+		RootName:         args.RootName,
+		AllEnv:           args.AllEnv,
+		EnableSearch:     args.EnableSearch,
+		HideSizes:        args.HideSizes,
+		TarExport:        args.EnableTarExport,
+		Templates:        args.Templates,
+		LowercaseNames:   args.LowercaseNames,
+		ShowRecipients:   args.ShowRecipients,
+		Aliases:          args.Aliases,
+		DirFiles:         args.DirFiles,
+		NoAttrCache:      args.NoAttrCache,
+		FramedFiles:      args.FramedFiles,
+		AllowReadFile:    args.AllowReadFile,
+		StoreRetries:     args.StoreRetries,
+		FollowStoreLink:  args.FollowStoreLink,
+		Overlay:          args.Overlay,
+		OpTimeout:        time.Second * time.Duration(args.OpTimeout),
+		TomlFiles:        args.TomlFiles,
+		IniFiles:         args.IniFiles,
+		IncludePassword:  args.IncludePassword,
+		AgeFiles:         args.AgeFiles,
+		AgeSuffix:        args.AgeSuffix,
+		QrFiles:          args.QrFiles,
+		QrField:          args.QrField,
+		SingleSecret:     args.SingleSecret,
+		NameCollisions:   args.NameCollisions,
+	}
+}
+
+// warnRestartRequired logs the changed arguments which can't be applied without restarting.
+func warnRestartRequired(current, reloaded args) {
+	changes := []struct {
+		arg     string
+		changed bool
+	}{
+		{"mount path", current.MountPath != reloaded.MountPath},
+		{"name", current.Name != reloaded.Name},
+		{"password store path", current.PasswordStorePath != reloaded.PasswordStorePath},
+		{"prefix", current.Prefix != reloaded.Prefix},
+		{"revision", current.Revision != reloaded.Revision},
+		{"demo", current.Demo != reloaded.Demo},
+		{"log format", current.LogJSON != reloaded.LogJSON},
+		{"secret suffix", current.SecretSuffix != reloaded.SecretSuffix},
+		{"show command", current.ShowCommand != reloaded.ShowCommand},
+		{"trimming first lines", current.TrimFirstLine != reloaded.TrimFirstLine},
+		{"stripping first line keys", current.FirstLineStripKey != reloaded.FirstLineStripKey},
+		{"ending passwords at blank lines", current.PasswordToBlank != reloaded.PasswordToBlank},
+		{"the password field", current.PasswordField != reloaded.PasswordField},
+		{"input encoding", current.InputEncoding != reloaded.InputEncoding},
+		{"GPG home", current.GnupgHome != reloaded.GnupgHome},
+		{"maximum secret size", current.MaxSecretSize != reloaded.MaxSecretSize},
+		{"command timeout", current.CommandTimeout != reloaded.CommandTimeout},
+		{"snapshot window", current.SnapshotWindow != reloaded.SnapshotWindow},
+		{"unmount after", current.UnmountAfter != reloaded.UnmountAfter},
+		{"stats interval", current.StatsInterval != reloaded.StatsInterval},
+	}
+	for _, change := range changes {
+		if change.changed {
+			log.Printf("Changing the %s requires restarting passfuse, keeping the current value", change.arg)
+		}
+	}
+}
+
+func main() {
+	args, parser, err := parseArgs(os.Args[1:])
+	switch {
+	case err == arg.ErrHelp:
+		parser.WriteHelp(os.Stdout)
+		os.Exit(0)
+	case err == arg.ErrVersion:
+		fmt.Println(args.Version())
+		os.Exit(0)
+	case err != nil && parser != nil:
+		parser.Fail(err.Error())
+	case err != nil:
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if args.UnmountInterval <= 0 {
+		parser.Fail("unmount interval must be positive")
+	}
+	err = pass.SetShowCommand(args.ShowCommand)
+	if err != nil {
+		parser.Fail(err.Error())
+	}
+	if args.Mirror && args.NoDecrypt {
+		parser.Fail("--mirror and --no-decrypt are mutually exclusive")
+	}
+	if args.SingleSecret != "" && args.Prefix != "" {
+		parser.Fail("--single and --prefix are mutually exclusive")
+	}
+	err = pass.SetSecretSuffix(args.SecretSuffix)
+	if err != nil {
+		parser.Fail(err.Error())
+	}
+	if args.MountTimeout < 0 {
+		parser.Fail("mount timeout cannot be negative")
+	}
+	if args.WaitReadyTimeout <= 0 {
+		parser.Fail("wait ready timeout must be positive")
+	}
+	if args.StatsInterval < 0 {
+		parser.Fail("stats interval cannot be negative")
+	}
+	if args.MaxOpenFiles < 0 {
+		parser.Fail("maximum open files cannot be negative")
+	}
+	if args.MaxSecretSize < 0 {
+		parser.Fail("maximum secret size cannot be negative")
+	}
+	pass.SetMaxSecretSize(args.MaxSecretSize)
+	if args.CommandTimeout < 0 {
+		parser.Fail("command timeout cannot be negative")
+	}
+	if args.OpTimeout < 0 {
+		parser.Fail("operation timeout cannot be negative")
+	}
+	if args.StoreRetries < 0 {
+		parser.Fail("store retries cannot be negative")
+	}
+	pass.SetCommandTimeout(time.Second * time.Duration(args.CommandTimeout))
+	if args.SnapshotWindow < 0 {
+		parser.Fail("snapshot window cannot be negative")
+	}
+	pass.SetSnapshotWindow(args.PasswordStorePath, time.Second*time.Duration(args.SnapshotWindow))
+	pass.SetTrimFirstLine(args.TrimFirstLine)
+	pass.SetStripFirstLineKey(args.FirstLineStripKey)
+	pass.SetPasswordUntilBlank(args.PasswordToBlank)
+	pass.SetPasswordField(args.PasswordField)
+	err = pass.SetInputEncoding(args.InputEncoding)
+	if err != nil {
+		parser.Fail(err.Error())
+	}
+	err = pass.SetGnupgHome(os.ExpandEnv(args.GnupgHome))
+	if err != nil {
+		parser.Fail(err.Error())
+	}
+	if args.Revision != "" {
+		if args.Remote != "" {
+			parser.Fail("--revision needs a local store and can't be used with a remote store")
+		}
+		if args.PersistSizeCache || args.HistoryFiles || args.AgeFiles || args.Templates || args.ShowRecipients ||
+			args.NoDecrypt {
+			parser.Fail("persisting sizes, history files, age files, templates, recipients and not decrypting read " +
+				"the current files of the store and can't be used with a revision")
+		}
+	}
+	if args.Demo {
+		if args.PasswordStorePath != "" || args.Remote != "" || args.Revision != "" {
+			parser.Fail("--demo serves synthetic secrets and can't be used with a password store")
+		}
+		if args.Check || args.Export != "" || args.Benchmark > 0 {
+			parser.Fail("--demo only mounts and can't be used for checking, exporting or benchmarking")
+		}
+		if args.PersistSizeCache || args.HistoryFiles || args.AgeFiles || args.Templates || args.ShowRecipients ||
+			args.NoDecrypt {
+			parser.Fail("persisting sizes, history files, age files, templates, recipients and not decrypting read " +
+				"the files of a store and can't be used with --demo")
+		}
+	}
+	if args.Remote != "" {
+		remote, err := pass.ParseRemote(args.Remote)
+		if err != nil {
+			parser.Fail(err.Error())
+		}
+		if args.RemoteSessions <= 0 {
+			parser.Fail("number of remote sessions must be positive")
+		}
+		if args.PersistSizeCache || args.HistoryFiles || args.AgeFiles || args.Templates || args.ShowRecipients {
+			parser.Fail("persisting sizes, history files, age files, templates and recipients need a local store and " +
+				"can't be used with a remote store")
+		}
+		if args.GnupgHome != "" {
+			parser.Fail("the GPG home of a remote store can't be set")
+		}
+		log.Printf("Using the remote store %s, remote stores are experimental", args.Remote)
+		pass.SetRemote(remote, args.RemoteSessions)
+	}
+
+	if args.PrintConfig {
+		err := printConfig(args, os.Stdout)
+		if err != nil {
+			fmt.Printf("Error printing config %s\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if args.Export != "" {
+		err := export(args)
+		if err != nil {
+			fmt.Printf("Error exporting secrets %s\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if args.Benchmark > 0 {
+		err := benchmark(args, os.Stdout)
+		if err != nil {
+			fmt.Printf("Error benchmarking store %s\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if args.Check {
+		healthy, err := check(args, os.Stdout)
+		if err != nil {
+			fmt.Printf("Error checking store %s\n", err)
+			os.Exit(1)
+		}
+		if !healthy {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if args.Verify != "" {
+		matching, err := verify(args, os.Stdout)
+		if err != nil {
+			fmt.Printf("Error verifying secrets %s\n", err)
+			os.Exit(1)
+		}
+		if !matching {
+			os.Exit(1)
+		}
+		return
+	}
+
+	options := getOptions(args)
+	mountPath, err := resolveMountPath(args.MountPath)
+	if err != nil {
+		fmt.Printf("Error resolving mount path %s\n", err)
+		os.Exit(1)
+	}
+	name := getName(args.Name, mountPath)
+	if args.LogJSON {
+		log.SetFlags(0)
+		log.SetOutput(newJSONLogWriter(os.Stderr, name))
+	} else {
+		log.SetPrefix(fmt.Sprintf("[%s] ", name))
+	}
+
+	// A nil source reads the password store with the show command.
+	var source pass.SecretSource
+	if args.Revision != "" {
+		source = pass.RevisionSource{Path: args.PasswordStorePath, Revision: args.Revision}
+	}
+	if args.Demo {
+		log.Print("Serving synthetic demo secrets, nothing is read from a password store")
+		source = pass.NewDemoSource()
+	}
+	server, err := fs.NewPassFS(args.PasswordStorePath, args.Prefix, options, source)
+	if err != nil {
+		fmt.Printf("Error initializing filesystem %s\n", err)
+		os.Exit(1)
+	}
+	if args.WatchAgent {
+		err = server.WatchAgent()
+		if err != nil {
+			fmt.Printf("Error watching GPG agent %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if args.StatsInterval > 0 {
+		server.LogStats(time.Second * time.Duration(args.StatsInterval))
+	}
+
+	cfg := &fuse.MountConfig{
+		ErrorLogger: log.New(log.Writer(), log.Prefix(), log.Flags()),
+		FSName:      name,
+	}
+	err = prepareMountPath(mountPath, args.CreateMountPath)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	if args.WarnWorldReadable || args.StrictPerms {
+		problems := checkPermissions(mountPath, cfg.Options)
+		for _, problem := range problems {
+			log.Printf("Other users might be able to read secrets, %s", problem)
+		}
+		if len(problems) > 0 && args.StrictPerms {
+			fmt.Println("Error mounting filesystem, refusing to mount with permissions allowing other users to read secrets")
+			os.Exit(1)
+		}
+	}
+
+	mountedFS, err := mountWithTimeout(func() (*fuse.MountedFileSystem, error) {
+		return fuse.Mount(mountPath, server, cfg)
+	}, time.Second*time.Duration(args.MountTimeout))
 	if err != nil {
 		fmt.Printf("Error mounting filesystem %s\n", err)
 		os.Exit(1)
 	}
+	if args.WaitReady {
+		err = waitReady(mountPath, time.Second*time.Duration(args.WaitReadyTimeout), readyPollInterval)
+		if err != nil {
+			fmt.Printf("Error mounting filesystem %s\n", err)
+			unmount(server, mountPath, args.UnmountInterval)
+			os.Exit(1)
+		}
+		log.Printf("Mount at %s is ready", mountPath)
+	}
 
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt)
 	go func() {
 		for {
 			<-sigChan
-			unmount(mountPath)
+			unmount(server, mountPath, args.UnmountInterval)
 			break
 		}
 	}()
 
+	usr1Chan := make(chan os.Signal, 1)
+	signal.Notify(usr1Chan, syscall.SIGUSR1)
+	go func() {
+		for range usr1Chan {
+			server.Dump(os.Stderr)
+		}
+	}()
+
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
+	go func() {
+		for range hupChan {
+			reloaded, _, err := parseArgs(os.Args[1:])
+			if err != nil {
+				log.Printf("Error reloading arguments %s\n", err)
+				continue
+			}
+			warnRestartRequired(args, reloaded)
+			err = server.Reload(getOptions(reloaded))
+			if err != nil {
+				log.Printf("Error refreshing filesystem %s\n", err)
+			}
+		}
+	}()
+
 	go func() {
 		if args.UnmountAfter > 0 {
 			time.Sleep(time.Second * time.Duration(args.UnmountAfter))
-			unmount(mountPath)
+			unmount(server, mountPath, args.UnmountInterval)
 		}
 	}()
 
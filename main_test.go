@@ -0,0 +1,194 @@
+package main
+
+import (
+	"errors"
+	"github.com/femnad/passfuse/pkg/pass"
+	"github.com/jacobsa/fuse"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResolveRelativeMountPath(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("Error getting working directory: %s", err)
+	}
+
+	os.Setenv("PASSFUSE_TEST_MOUNT", "passfuse")
+	defer os.Unsetenv("PASSFUSE_TEST_MOUNT")
+	tests := map[string]string{
+		"./mnt":                    filepath.Join(wd, "mnt"),
+		"mnt/../other":             filepath.Join(wd, "other"),
+		"/tmp/mnt":                 "/tmp/mnt",
+		"mnt/$PASSFUSE_TEST_MOUNT": filepath.Join(wd, "mnt", "passfuse"),
+	}
+	for mountPath, expected := range tests {
+		resolved, err := resolveMountPath(mountPath)
+		if err != nil {
+			t.Fatalf("Error resolving %s: %s", mountPath, err)
+		}
+		if resolved != expected {
+			t.Errorf("Expected %s to resolve to %s, got %s", mountPath, expected, resolved)
+		}
+	}
+}
+
+func TestPrepareMountPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "passfuse-mount")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mountPath := filepath.Join(dir, "a", "mnt")
+	err = prepareMountPath(mountPath, true)
+	if err != nil {
+		t.Fatalf("Error preparing mount path: %s", err)
+	}
+	info, err := os.Stat(mountPath)
+	if err != nil || info.Mode().Perm() != mountPathPermission {
+		t.Errorf("Expected the mount path to be created with mode %o, got %v and %v", mountPathPermission, info, err)
+	}
+
+	file := filepath.Join(dir, "file")
+	err = ioutil.WriteFile(file, nil, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = prepareMountPath(filepath.Join(file, "mnt"), true)
+	if err == nil || !strings.Contains(err.Error(), "not a directory") {
+		t.Errorf("Expected an error creating a mount path under a file, got %v", err)
+	}
+
+	if os.Geteuid() == 0 {
+		t.Skip("Permissions aren't enforced for root")
+	}
+	readOnly := filepath.Join(dir, "read-only")
+	err = os.Mkdir(readOnly, 0500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = prepareMountPath(filepath.Join(readOnly, "a", "mnt"), true)
+	if err == nil || !strings.Contains(err.Error(), readOnly+" isn't writable") {
+		t.Errorf("Expected an error naming the parent which isn't writable, got %v", err)
+	}
+}
+
+func TestConfigArgs(t *testing.T) {
+	configFile, err := ioutil.TempFile("", "passfuse-config")
+	if err != nil {
+		t.Fatalf("Error creating config file: %s", err)
+	}
+	defer os.Remove(configFile.Name())
+	_, err = configFile.WriteString("# mount first lines\n--firstlinefiles\n\n--prefix=work\n")
+	if err != nil {
+		t.Fatalf("Error writing config file: %s", err)
+	}
+	configFile.Close()
+
+	parsed, _, err := parseArgs([]string{"--config", configFile.Name(), "--prefix", "personal"})
+	if err != nil {
+		t.Fatalf("Error parsing arguments: %s", err)
+	}
+	if !parsed.FirstLineFiles {
+		t.Errorf("Expected first line files to be enabled by the config file")
+	}
+	if parsed.Prefix != "personal" {
+		t.Errorf("Expected the command line prefix to take precedence, got %s", parsed.Prefix)
+	}
+	if !parsed.ContentFiles {
+		t.Errorf("Expected defaults to apply for arguments missing from the config file")
+	}
+}
+
+func makeStore(t *testing.T, files ...string) string {
+	t.Helper()
+	storePath, err := ioutil.TempDir("", "passfuse-test")
+	if err != nil {
+		t.Fatalf("Error creating store: %s", err)
+	}
+	for _, file := range files {
+		filePath := filepath.Join(storePath, file)
+		err = os.MkdirAll(filepath.Dir(filePath), 0700)
+		if err != nil {
+			t.Fatalf("Error creating directory for %s: %s", file, err)
+		}
+		err = ioutil.WriteFile(filePath, []byte{}, 0600)
+		if err != nil {
+			t.Fatalf("Error creating file %s: %s", file, err)
+		}
+	}
+	return storePath
+}
+
+// setSecrets makes pass return the given secret bodies, keyed by secret name without the .gpg suffix.
+func setSecrets(secrets map[string]string) {
+	pass.SetCommandRunner(func(name string, args ...string) (io.ReadCloser, error) {
+		body, found := secrets[args[len(args)-1]]
+		if !found {
+			return nil, os.ErrNotExist
+		}
+		return ioutil.NopCloser(strings.NewReader(body)), nil
+	})
+}
+
+func TestMountTimeout(t *testing.T) {
+	_, err := mountWithTimeout(func() (*fuse.MountedFileSystem, error) {
+		time.Sleep(time.Second)
+		return nil, nil
+	}, 50*time.Millisecond)
+	if err == nil {
+		t.Errorf("Expected mounting to time out")
+	}
+
+	mountErr := errors.New("mount failed")
+	for _, timeout := range []time.Duration{0, time.Second} {
+		_, err = mountWithTimeout(func() (*fuse.MountedFileSystem, error) {
+			return nil, mountErr
+		}, timeout)
+		if err != mountErr {
+			t.Errorf("Expected the error of mounting with timeout %s, got %v", timeout, err)
+		}
+	}
+}
+
+func TestWaitReady(t *testing.T) {
+	dir, err := ioutil.TempDir("", "passfuse-ready")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	err = waitReady(dir, 100*time.Millisecond, 10*time.Millisecond)
+	if err == nil {
+		t.Errorf("Expected waiting for a directory which isn't mounted to time out")
+	}
+	err = waitReady(filepath.Join(dir, "missing"), 100*time.Millisecond, 10*time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), "no such file") {
+		t.Errorf("Expected the error of stating a missing mount point, got %v", err)
+	}
+}
+
+func TestFormatVersion(t *testing.T) {
+	tests := []struct {
+		commit    string
+		buildDate string
+		expected  string
+	}{
+		{expected: "0.1.5"},
+		{commit: "1a2b3c4", expected: "0.1.5 (commit 1a2b3c4)"},
+		{commit: "1a2b3c4", buildDate: "2024-03-14", expected: "0.1.5 (commit 1a2b3c4, built 2024-03-14)"},
+		{buildDate: "2024-03-14", expected: "0.1.5 (built 2024-03-14)"},
+	}
+	for _, test := range tests {
+		formatted := formatVersion("0.1.5", test.commit, test.buildDate)
+		if formatted != test.expected {
+			t.Errorf("Expected version %q, got %q", test.expected, formatted)
+		}
+	}
+}
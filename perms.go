@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"github.com/femnad/passfuse/pkg/fs"
+	"os"
+	"sort"
+)
+
+// Mode bits giving access to other users than the owner
+const otherAccessMask = 0077
+
+// checkPermissions returns the problems which would allow other users to read secrets: the mount path or the mounted
+// files and directories having modes giving access to group or others, and mount options letting other users access
+// the mount.
+func checkPermissions(mountPath string, mountOptions map[string]string) []string {
+	var problems []string
+	info, err := os.Stat(mountPath)
+	if err == nil && info.Mode().Perm()&otherAccessMask != 0 {
+		problems = append(problems, fmt.Sprintf("mount path %s has mode %s", mountPath, info.Mode().Perm()))
+	}
+
+	modes := fs.GetModes()
+	var kinds []string
+	for kind := range modes {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		if modes[kind].Perm()&otherAccessMask != 0 {
+			problems = append(problems, fmt.Sprintf("mounted %s have mode %s", kind, modes[kind].Perm()))
+		}
+	}
+
+	for _, option := range []string{"allow_other", "allow_root"} {
+		_, found := mountOptions[option]
+		if found {
+			problems = append(problems, fmt.Sprintf("mount option %s lets other users access the mount", option))
+		}
+	}
+	return problems
+}
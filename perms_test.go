@@ -0,0 +1,36 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestCheckPermissions(t *testing.T) {
+	mountPath, err := ioutil.TempDir("", "passfuse-mount")
+	if err != nil {
+		t.Fatalf("Error creating mount path: %s", err)
+	}
+	defer os.RemoveAll(mountPath)
+
+	err = os.Chmod(mountPath, mountPathPermission)
+	if err != nil {
+		t.Fatalf("Error changing mode of mount path: %s", err)
+	}
+	problems := checkPermissions(mountPath, nil)
+	if len(problems) != 0 {
+		t.Errorf("Expected no problems for a private mount path, got %v", problems)
+	}
+
+	err = os.Chmod(mountPath, 0755)
+	if err != nil {
+		t.Fatalf("Error changing mode of mount path: %s", err)
+	}
+	problems = checkPermissions(mountPath, map[string]string{"allow_other": ""})
+	expected := []string{"mount path " + mountPath + " has mode -rwxr-xr-x",
+		"mount option allow_other lets other users access the mount"}
+	if strings.Join(problems, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expected problems %q, got %q", expected, problems)
+	}
+}
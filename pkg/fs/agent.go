@@ -0,0 +1,148 @@
+package fs
+
+import (
+	"context"
+	"fmt"
+	"github.com/femnad/passfuse/pkg/pass"
+	"github.com/jacobsa/fuse/fuseops"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Interval for checking whether the GPG agent has been restarted
+const agentWatchInterval = 5 * time.Second
+
+// getAgentSocket returns the path of the socket of the GPG agent, which is in the GPG home directory of the commands
+// showing secrets.
+func getAgentSocket() (string, error) {
+	cmd := exec.Command("gpgconf", "--list-dirs", "agent-socket")
+	if pass.GetGnupgHome() != "" {
+		cmd.Env = append(os.Environ(), "GNUPGHOME="+pass.GetGnupgHome())
+	}
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("error getting GPG agent socket: %s", err)
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// socketIdentity identifies a socket file, which changes whenever the agent creates its socket again on starting.
+type socketIdentity struct {
+	exists  bool
+	inode   uint64
+	modTime time.Time
+}
+
+func getSocketIdentity(socketPath string) socketIdentity {
+	info, err := os.Stat(socketPath)
+	if err != nil {
+		return socketIdentity{}
+	}
+	identity := socketIdentity{exists: true, modTime: info.ModTime()}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if ok {
+		identity.inode = stat.Ino
+	}
+	return identity
+}
+
+// watchAgent calls onRestart whenever the socket of the agent is created again, until the context is done. The agent
+// stopping doesn't count as a restart until it starts again.
+func watchAgent(ctx context.Context, socketPath string, interval time.Duration, onRestart func()) {
+	last := getSocketIdentity(socketPath)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		current := getSocketIdentity(socketPath)
+		if current.exists && current != last {
+			onRestart()
+		}
+		if current.exists {
+			last = current
+		}
+	}
+}
+
+// clearDecryptions forgets what has been learned by decrypting secrets, so that nothing the agent might now refuse
+// to decrypt is served from memory.
+func (fs *passFS) clearDecryptions() {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	fs.sizeMap = make(map[fuseops.InodeID]pass.SecretSize)
+	fs.sizeLookups = make(map[fuseops.InodeID]*sizeLookup)
+	fs.fieldMatches = make(map[string]fieldMatch)
+	fs.secretTags = make(map[string]secretTags)
+	fs.secretMonths = make(map[string]secretMonth)
+	fs.firstLines = make(map[string]firstLine)
+	fs.renderedFiles = make(map[fuseops.HandleID][]byte)
+	fs.clearCachedSizes()
+	pass.ClearSnapshots()
+}
+
+var killAgent = killGpgAgent
+
+// killGpgAgent stops the GPG agent of the commands showing secrets, which makes it forget the passphrases it has
+// cached. The agent is started again by the next decryption, which asks for the passphrase again.
+func killGpgAgent() error {
+	cmd := exec.Command("gpgconf", "--kill", "gpg-agent")
+	if pass.GetGnupgHome() != "" {
+		cmd.Env = append(os.Environ(), "GNUPGHOME="+pass.GetGnupgHome())
+	}
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("error stopping GPG agent: %s: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// lock forgets what has been decrypted and stops the GPG agent, so that secrets can only be read again after
+// unlocking the key. The streams and tar exports of open files are closed too, so that their next reads decrypt their
+// secrets again.
+func (fs *passFS) lock() error {
+	fs.clearDecryptions()
+	fs.mutex.RLock()
+	var streams []*pass.SecretStream
+	for _, stream := range fs.streams {
+		streams = append(streams, stream)
+	}
+	var exports []*tarExport
+	for _, export := range fs.tarExports {
+		exports = append(exports, export)
+	}
+	fs.mutex.RUnlock()
+	for _, stream := range streams {
+		stream.Close()
+	}
+	for _, export := range exports {
+		export.Close()
+	}
+	err := killAgent()
+	if err != nil {
+		return err
+	}
+	log.Print("Locked, cleared decrypted state and stopped the GPG agent")
+	return nil
+}
+
+// WatchAgent clears the secret sizes, field matches and tags kept in memory when the GPG agent restarts, until the
+// filesystem is interrupted.
+func (s *Server) WatchAgent() error {
+	socketPath, err := getAgentSocket()
+	if err != nil {
+		return err
+	}
+	go watchAgent(s.fs.ctx, socketPath, agentWatchInterval, func() {
+		log.Print("GPG agent restarted, clearing decrypted state")
+		s.fs.clearDecryptions()
+	})
+	return nil
+}
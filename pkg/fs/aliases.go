@@ -0,0 +1,118 @@
+package fs
+
+import (
+	"fmt"
+	"github.com/femnad/passfuse/pkg/pass"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+	"log"
+	"path"
+	"sort"
+	"strings"
+)
+
+// parseAliases parses aliases given as alias=secret, returning the secrets keyed by alias.
+func parseAliases(specs []string) (map[string]string, error) {
+	aliases := make(map[string]string)
+	for _, spec := range specs {
+		separator := strings.Index(spec, "=")
+		if separator <= 0 || separator == len(spec)-1 {
+			return nil, fmt.Errorf("alias %q is not in the form alias=secret", spec)
+		}
+		aliases[spec[:separator]] = spec[separator+1:]
+	}
+	return aliases, nil
+}
+
+// findDir returns the inode of the directory at a path relative to the mount point.
+func findDir(dirPath string, inodes map[fuseops.InodeID]inodeInfo) (fuseops.InodeID, bool) {
+	var id fuseops.InodeID = fuseops.RootInodeID
+	if dirPath == "." {
+		return id, true
+	}
+	for _, name := range strings.Split(dirPath, "/") {
+		child, err := findChildInode(name, inodes[id].children)
+		if err != nil || !inodes[child].dir || inodes[child].inodeType == pass.Field {
+			return 0, false
+		}
+		id = child
+	}
+	return id, true
+}
+
+// secretEntries returns the files of a secret at a path relative to the mount point, without the secret suffix, along
+// with the suffixes of their names. Directories aren't included since the kernel doesn't allow them to have aliases.
+func (fs *passFS) secretEntries(secretPath string, inodes map[fuseops.InodeID]inodeInfo) ([]fuseutil.Dirent,
+	[]string) {
+	dir, found := findDir(path.Dir(secretPath), inodes)
+	if !found {
+		return nil, nil
+	}
+	var entries []fuseutil.Dirent
+	var suffixes []string
+	// Any file type might be mounted for the secret, as the file types of directories can be overridden.
+	for _, fileType := range fileTypeOrder {
+		suffix := fs.options.fileSuffix(fileType)
+		child, err := findChildInode(path.Base(secretPath)+suffix, inodes[dir].children)
+		if err != nil || inodes[child].dir || inodes[child].secret == "" {
+			continue
+		}
+		entries = append(entries, fuseutil.Dirent{Inode: child, Type: fuseutil.DT_File})
+		suffixes = append(suffixes, suffix)
+	}
+	return entries, suffixes
+}
+
+// addAliases adds entries for the aliases to the tree, sharing the inodes of the files of the secrets they alias so
+// that they're like hard links. Both aliases and secrets are paths relative to the mount point, with or without the
+// secret suffix. Aliases in directories which don't exist, aliasing secrets without files or
+// having names of existing entries are reported and left out.
+func (fs *passFS) addAliases(inodes map[fuseops.InodeID]inodeInfo) {
+	// The options have been validated, so the aliases can be parsed.
+	aliasSecrets, _ := parseAliases(fs.options.Aliases)
+	var aliases []string
+	for alias := range aliasSecrets {
+		aliases = append(aliases, alias)
+	}
+	sort.Strings(aliases)
+	for _, alias := range aliases {
+		secret := fs.options.displayedPath(aliasSecrets[alias])
+		alias = fs.options.displayedPath(strings.TrimSuffix(path.Clean(alias), pass.GetSecretSuffix()))
+		entries, suffixes := fs.secretEntries(strings.TrimSuffix(path.Clean(secret), pass.GetSecretSuffix()), inodes)
+		if len(entries) == 0 {
+			log.Printf("Not adding alias %s, secret %s doesn't have any mounted files", alias, secret)
+			continue
+		}
+		dir, found := findDir(path.Dir(alias), inodes)
+		if !found {
+			log.Printf("Not adding alias %s, directory %s isn't mounted", alias, path.Dir(alias))
+			continue
+		}
+
+		dirInfo := inodes[dir]
+		children := append([]fuseutil.Dirent{}, dirInfo.children...)
+		added := true
+		for i, entry := range entries {
+			name := path.Base(alias) + suffixes[i]
+			_, err := findChildInode(name, children)
+			if err == nil {
+				log.Printf("Not adding alias %s, directory %s already has an entry %s", alias, path.Dir(alias), name)
+				added = false
+				break
+			}
+			entry.Name = name
+			children = append(children, entry)
+		}
+		if !added {
+			continue
+		}
+		numberDirents(children)
+		dirInfo.children = children
+		inodes[dir] = dirInfo
+		for _, entry := range entries {
+			info := inodes[entry.Inode]
+			info.attributes.Nlink++
+			inodes[entry.Inode] = info
+		}
+	}
+}
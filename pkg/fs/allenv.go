@@ -0,0 +1,88 @@
+package fs
+
+import (
+	"fmt"
+	"github.com/femnad/passfuse/pkg/pass"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+	"path"
+	"sort"
+	"strings"
+)
+
+const allEnvName = "all.env"
+
+// firstLine is the first line of a secret, for the hash of its file when it was decrypted.
+type firstLine struct {
+	hash string
+	line string
+}
+
+func getAllEnvDirEnt(id fuseops.InodeID, rootNode pass.Node, inodes map[fuseops.InodeID]inodeInfo) fuseutil.Dirent {
+	dirEnt := getControlFileDirEnt(id, allEnvName, inodes)
+	info := inodes[id]
+	for _, leaf := range pass.GetLeaves(rootNode) {
+		info.secrets = append(info.secrets, leaf.Secret)
+	}
+	inodes[id] = info
+	return dirEnt
+}
+
+// getFirstLine decrypts a secret for its first line, unless the first line of the secret in its current version is
+// known. First lines aren't kept if caching contents is disabled.
+func (fs *passFS) getFirstLine(secret string) (string, error) {
+	hash, err := hashSecretFile(path.Join(fs.storePath, secret))
+	if err == nil {
+		fs.mutex.RLock()
+		cached, found := fs.firstLines[secret]
+		fs.mutex.RUnlock()
+		if found && cached.hash == hash {
+			return cached.line, nil
+		}
+	}
+
+	line, err := pass.GetSecretFirstLine(fs.ctx, secret)
+	if err != nil {
+		return "", err
+	}
+	if hash != "" && !fs.getOptions().NoContentCache {
+		fs.mutex.Lock()
+		fs.firstLines[secret] = firstLine{hash: hash, line: line}
+		fs.mutex.Unlock()
+	}
+	return line, nil
+}
+
+// quoteEnvValue quotes a value for a dotenv file, escaping backslashes and double quotes.
+func quoteEnvValue(value string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value) + `"`
+}
+
+// renderAllEnv renders the first lines of the secrets as dotenv lines, named after the environment variable style
+// names of the secrets relative to the mount point. Secrets are ordered by name, and secrets whose name is already
+// taken by an earlier one get the first free name with a _2, _3, and so on suffix. Secrets which may not be decrypted
+// are left out.
+func (fs *passFS) renderAllEnv(secrets []string) ([]byte, error) {
+	prefix := strings.Trim(fs.prefix, "/")
+	sorted := append([]string{}, secrets...)
+	sort.Strings(sorted)
+	taken := make(map[string]bool)
+	var lines []string
+	for _, secret := range sorted {
+		if !fs.secretAllowed(secret) {
+			continue
+		}
+		line, err := fs.getFirstLine(secret)
+		if err != nil {
+			return nil, fmt.Errorf("error rendering %s: %w", allEnvName, err)
+		}
+		secretPath := strings.TrimSuffix(strings.TrimPrefix(secret, prefix+"/"), pass.GetSecretSuffix())
+		name := envName(secretPath)
+		for suffix := 2; taken[name]; suffix++ {
+			name = fmt.Sprintf("%s_%d", envName(secretPath), suffix)
+		}
+		taken[name] = true
+		lines = append(lines, name+"="+quoteEnvValue(line)+"\n")
+	}
+	return []byte(strings.Join(lines, "")), nil
+}
@@ -0,0 +1,81 @@
+package fs
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/femnad/passfuse/pkg/pass"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+)
+
+// allowlist holds the names of the secrets which may be decrypted for reading, without the secret suffix. A nil
+// allowlist allows all secrets.
+type allowlist map[string]bool
+
+// loadAllowlist reads an allowlist file with a secret name per line, relative to the store root and with or without
+// the secret suffix. Empty lines and lines starting with # are skipped. An empty path means there's no allowlist.
+func loadAllowlist(allowlistPath string) (allowlist, error) {
+	if allowlistPath == "" {
+		return nil, nil
+	}
+	file, err := os.Open(allowlistPath)
+	if err != nil {
+		return nil, fmt.Errorf("error reading allowlist: %s", err)
+	}
+	defer file.Close()
+
+	allowed := make(allowlist)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		allowed[allowlistName(line)] = true
+	}
+	if scanner.Err() != nil {
+		return nil, fmt.Errorf("error reading allowlist: %s", scanner.Err())
+	}
+	return allowed, nil
+}
+
+func allowlistName(secret string) string {
+	return strings.TrimSuffix(path.Clean(strings.TrimPrefix(secret, "/")), pass.GetSecretSuffix())
+}
+
+func (a allowlist) allows(secret string) bool {
+	return a == nil || a[allowlistName(secret)]
+}
+
+// decrypts returns whether reading a file, or listing a field directory, decrypts its secret.
+func (inode inodeInfo) decrypts() bool {
+	if inode.controlFile != "" {
+		return false
+	}
+	switch inode.inodeType {
+	case pass.Contents, pass.FirstLine, pass.Field, pass.Framed, pass.Toml, pass.Ini, pass.QR, pass.Template:
+		return true
+	}
+	return false
+}
+
+// readAllowed returns whether the secret of an inode may be decrypted, which is always the case for inodes which don't
+// decrypt anything.
+func (fs *passFS) readAllowed(inode inodeInfo) bool {
+	return !inode.decrypts() || fs.secretAllowed(inode.secret)
+}
+
+func (fs *passFS) secretAllowed(secret string) bool {
+	fs.mutex.RLock()
+	defer fs.mutex.RUnlock()
+	return fs.allowlist.allows(secret)
+}
+
+// denyRead logs a denied attempt at decrypting a secret and returns the error reported for it.
+func denyRead(secret string) error {
+	log.Printf("Denied decrypting %s, the secret isn't in the allowlist", secret)
+	return syscall.EACCES
+}
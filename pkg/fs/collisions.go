@@ -0,0 +1,118 @@
+package fs
+
+import (
+	"fmt"
+	"github.com/femnad/passfuse/pkg/pass"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+	"log"
+	"path"
+	"strings"
+)
+
+// Policies for entries with the same name as another entry in the same directory, e.g. a secret foo mounted as a field
+// directory next to a directory foo of the store
+const (
+	collisionSuffix = "suffix"
+	collisionSkip   = "skip"
+	collisionError  = "error"
+)
+
+// Appended to the names of directories of the store colliding with other entries with the suffix policy
+const collisionDirSuffix = ".dir"
+
+func validCollisionPolicy(policy string) bool {
+	switch policy {
+	case "", collisionSuffix, collisionSkip, collisionError:
+		return true
+	}
+	return false
+}
+
+// isStoreDir returns whether an inode is a directory of the store, rather than e.g. a field directory of a secret.
+func isStoreDir(inode inodeInfo) bool {
+	return inode.dir && !inode.control && inode.inodeType != pass.Field
+}
+
+// resolveCollisions applies the suffix or skip policy to the entries of a directory, leaving them as they are for other
+// policies. Directories of the store yield to other entries and otherwise later entries yield to earlier ones, so that
+// the result doesn't depend on the order of the store. With the suffix policy the yielding entry gets a suffix, with
+// the skip policy it's left out.
+func (fs *passFS) resolveCollisions(dirPath string, children []fuseutil.Dirent,
+	inodes map[fuseops.InodeID]inodeInfo) []fuseutil.Dirent {
+	policy := fs.options.NameCollisions
+	if policy != collisionSuffix && policy != collisionSkip {
+		return children
+	}
+	taken := make(map[string]bool)
+	skipped := make(map[int]bool)
+	claim := func(storeDirs bool) {
+		for i, child := range children {
+			if isStoreDir(inodes[child.Inode]) != storeDirs {
+				continue
+			}
+			if !taken[child.Name] {
+				taken[child.Name] = true
+				continue
+			}
+			if policy == collisionSkip {
+				log.Printf("Skipping %s, there is another entry with the same name", path.Join(dirPath, child.Name))
+				skipped[i] = true
+				continue
+			}
+			name := child.Name + collisionDirSuffix
+			for n := 2; taken[name]; n++ {
+				name = fmt.Sprintf("%s%s%d", child.Name, collisionDirSuffix, n)
+			}
+			log.Printf("Mounting %s as %s, there is another entry with the same name", path.Join(dirPath, child.Name),
+				name)
+			taken[name] = true
+			children[i].Name = name
+		}
+	}
+	claim(false)
+	claim(true)
+
+	var resolved []fuseutil.Dirent
+	for i, child := range children {
+		if skipped[i] {
+			continue
+		}
+		child.Offset = fuseops.DirOffset(len(resolved) + 1)
+		resolved = append(resolved, child)
+	}
+	return resolved
+}
+
+// findCollisions returns the paths of entries with the same name as an earlier entry in the same directory.
+func findCollisions(inodes map[fuseops.InodeID]inodeInfo, prefix string) []string {
+	var collisions []string
+	var find func(id fuseops.InodeID, dirPath string)
+	find = func(id fuseops.InodeID, dirPath string) {
+		seen := make(map[string]bool)
+		for _, child := range inodes[id].children {
+			childPath := strings.TrimPrefix(dirPath+"/"+child.Name, "/")
+			if seen[child.Name] {
+				collisions = append(collisions, childPath)
+			}
+			seen[child.Name] = true
+			if child.Type == fuseutil.DT_Directory {
+				find(child.Inode, childPath)
+			}
+		}
+	}
+	find(fuseops.RootInodeID, strings.Trim(prefix, "/"))
+	return collisions
+}
+
+// checkCollisions fails with the error policy if there are entries with the same name as another entry.
+func (fs *passFS) checkCollisions(inodes map[fuseops.InodeID]inodeInfo) error {
+	if fs.options.NameCollisions != collisionError {
+		return nil
+	}
+	collisions := findCollisions(inodes, fs.prefix)
+	if len(collisions) > 0 {
+		return fmt.Errorf("entries have the same name as other entries: %s", strings.Join(collisions, ", "))
+	}
+	return nil
+}
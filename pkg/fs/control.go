@@ -0,0 +1,410 @@
+package fs
+
+import (
+	"context"
+	"fmt"
+	"github.com/femnad/passfuse/pkg/pass"
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// The control directory holds files for interacting with passfuse rather than secrets. Its name is hidden like the
+// dotfiles of the password store, which are never mounted, so it can't collide with a secret.
+const (
+	controlDirName       = ".passfuse"
+	controlDirPermission = 0700
+	currentName          = "current"
+	errorsName           = "errors"
+	lastErrorName        = "last-error"
+	lockName             = "lock"
+	lockPermission       = 0200
+	recipientsName       = "recipients"
+	symlinkPermission    = 0777
+	uptimeName           = "uptime"
+)
+
+// hasControlDir returns whether any of the options needing the control directory are enabled.
+func (options PassFsOptions) hasControlDir() bool {
+	return options.ShowControl || options.EnableCurrent || options.AllEnv || options.EnableLock || options.TarExport ||
+		options.ShowRecipients || options.EnableSearch
+}
+
+func (fs *passFS) getCurrentTarget() string {
+	fs.mutex.RLock()
+	defer fs.mutex.RUnlock()
+	return fs.currentTarget
+}
+
+// getControlDirEnt creates the control directory, with the control files in it if they're shown, the file with the
+// first lines of the secrets in the tree, the search file, the recipients, the tar export and the lock file if they're
+// enabled and the current symlink if a secret has been selected.
+func (fs *passFS) getControlDirEnt(rootNode pass.Node, offset fuseops.DirOffset,
+	inodes map[fuseops.InodeID]inodeInfo) fuseutil.Dirent {
+	dirInode := fs.allocateInode()
+	info := inodeInfo{
+		attributes: fuseops.InodeAttributes{
+			Nlink: 1,
+			Mode:  controlDirPermission | os.ModeDir,
+		},
+		dir:     true,
+		control: true,
+	}
+	if fs.options.ShowControl {
+		info.children = append(info.children, getControlFileDirEnt(fs.allocateInode(), uptimeName, inodes))
+		info.children = append(info.children, getControlFileDirEnt(fs.allocateInode(), lastErrorName, inodes))
+		info.children = append(info.children, getControlFileDirEnt(fs.allocateInode(), errorsName, inodes))
+	}
+	if fs.options.AllEnv {
+		info.children = append(info.children, getAllEnvDirEnt(fs.allocateInode(), rootNode, inodes))
+	}
+	if fs.options.EnableSearch {
+		info.children = append(info.children, getSearchDirEnt(fs.allocateInode(), rootNode, inodes))
+	}
+	if fs.options.ShowRecipients {
+		info.children = append(info.children, getControlFileDirEnt(fs.allocateInode(), recipientsName, inodes))
+	}
+	if fs.options.TarExport {
+		info.children = append(info.children, getTarExportDirEnt(fs.allocateInode(), rootNode, inodes))
+	}
+	if fs.options.EnableLock {
+		lockEnt := getControlFileDirEnt(fs.allocateInode(), lockName, inodes)
+		lockInfo := inodes[lockEnt.Inode]
+		lockInfo.attributes.Mode = lockPermission
+		inodes[lockEnt.Inode] = lockInfo
+		info.children = append(info.children, lockEnt)
+	}
+	if fs.options.EnableCurrent && fs.getCurrentTarget() != "" {
+		info.children = append(info.children, getCurrentDirEnt(fs.allocateInode(), inodes))
+	}
+	numberDirents(info.children)
+	inodes[dirInode] = info
+	return fuseutil.Dirent{
+		Offset: offset,
+		Inode:  dirInode,
+		Name:   controlDirName,
+		Type:   fuseutil.DT_Directory,
+	}
+}
+
+// numberDirents sets the offsets of directory entries to follow their order.
+func numberDirents(children []fuseutil.Dirent) {
+	for i := range children {
+		children[i].Offset = fuseops.DirOffset(i + 1)
+	}
+}
+
+func getControlFileDirEnt(id fuseops.InodeID, name string, inodes map[fuseops.InodeID]inodeInfo) fuseutil.Dirent {
+	inodes[id] = inodeInfo{
+		attributes: fuseops.InodeAttributes{
+			Nlink: 1,
+			Mode:  filePermission,
+		},
+		controlFile: name,
+	}
+	return fuseutil.Dirent{
+		Inode: id,
+		Name:  name,
+		Type:  fuseutil.DT_File,
+	}
+}
+
+// renderControlFile returns the content of a control file.
+func (fs *passFS) renderControlFile(inode inodeInfo) ([]byte, error) {
+	switch inode.controlFile {
+	case uptimeName:
+		return []byte(time.Since(fs.startTime).Round(time.Second).String() + "\n"), nil
+	case lastErrorName:
+		return []byte(fs.getLastError()), nil
+	case errorsName:
+		return []byte(fs.renderSecretErrors()), nil
+	case allEnvName:
+		return fs.renderAllEnv(inode.secrets)
+	case searchName:
+		return fs.renderSearch(inode.secrets), nil
+	case recipientsName:
+		recipients, err := pass.GetDirRecipients(fs.storePath, strings.Trim(fs.prefix, "/"))
+		return []byte(recipients), err
+	}
+	return nil, nil
+}
+
+// secretFailure counts the failures of getting a secret, with the time and description of the last one.
+type secretFailure struct {
+	count int
+	last  time.Time
+	cause string
+}
+
+// recordError records a failure of getting a secret with the error reported for it, replacing the previous one, and
+// counts it for the secret if it's known.
+func (fs *passFS) recordError(secret string, err, errno error) {
+	now := time.Now()
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	fs.lastError = fmt.Sprintf("%s %s: %s\n", now.Format(time.RFC3339), errno, err)
+	if secret == "" {
+		return
+	}
+	secret = strings.TrimSuffix(secret, pass.GetSecretSuffix())
+	failure := fs.secretErrors[secret]
+	failure.count++
+	failure.last = now
+	failure.cause = strings.ReplaceAll(fmt.Sprintf("%s: %s", errno, err), "\n", " ")
+	fs.secretErrors[secret] = failure
+}
+
+// renderSecretErrors returns a line for each secret which failed since mounting or refreshing, sorted by secret, with
+// the secret, the number of failures, the time of the last one and its cause separated by tabs.
+func (fs *passFS) renderSecretErrors() string {
+	fs.mutex.RLock()
+	defer fs.mutex.RUnlock()
+	var secrets []string
+	for secret := range fs.secretErrors {
+		secrets = append(secrets, secret)
+	}
+	sort.Strings(secrets)
+	var lines strings.Builder
+	for _, secret := range secrets {
+		failure := fs.secretErrors[secret]
+		fmt.Fprintf(&lines, "%s\t%d\t%s\t%s\n", secret, failure.count, failure.last.Format(time.RFC3339),
+			failure.cause)
+	}
+	return lines.String()
+}
+
+// getLastError returns the description of the last failure of getting a secret, empty if nothing failed.
+func (fs *passFS) getLastError() string {
+	fs.mutex.RLock()
+	defer fs.mutex.RUnlock()
+	return fs.lastError
+}
+
+func getCurrentDirEnt(id fuseops.InodeID, inodes map[fuseops.InodeID]inodeInfo) fuseutil.Dirent {
+	inodes[id] = inodeInfo{
+		attributes: fuseops.InodeAttributes{
+			Nlink: 1,
+			Mode:  symlinkPermission | os.ModeSymlink,
+		},
+		symlink: true,
+	}
+	return fuseutil.Dirent{
+		Inode: id,
+		Name:  currentName,
+		Type:  fuseutil.DT_Link,
+	}
+}
+
+// findPath returns whether there is an entry at a path relative to the mount point.
+func (fs *passFS) findPath(entryPath string) bool {
+	fs.mutex.RLock()
+	defer fs.mutex.RUnlock()
+	var id fuseops.InodeID = fuseops.RootInodeID
+	for _, name := range strings.Split(entryPath, "/") {
+		child, err := findChildInode(name, fs.inodes[id].children)
+		if err != nil {
+			return false
+		}
+		id = child
+	}
+	return true
+}
+
+// resolveCurrent returns the path the current symlink points to. Targets naming a secret relative to the mount
+// point, with or without the .gpg suffix, point to the first file of the secret, or to its directory with field
+// directories. Other targets are left as they are.
+func (fs *passFS) resolveCurrent(target string) string {
+	if path.IsAbs(target) {
+		return target
+	}
+	options := fs.getOptions()
+	secret := options.displayedPath(strings.TrimSuffix(path.Clean(target), pass.GetSecretSuffix()))
+	var candidates []string
+	types := options.fileTypes()
+	if len(types) > 0 {
+		candidates = append(candidates, secret+options.fileSuffix(types[0]))
+	}
+	candidates = append(candidates, secret)
+	for _, candidate := range candidates {
+		if fs.findPath(candidate) {
+			return path.Join("..", candidate)
+		}
+	}
+	return target
+}
+
+// controlDirError returns the error for creating or removing an entry in a directory other than the current
+// symlink, or nil if the entry is the current symlink in the control directory.
+func (fs *passFS) controlDirError(parent fuseops.InodeID, name string) error {
+	fs.mutex.RLock()
+	info, found := fs.inodes[parent]
+	stale := fs.isStale(parent)
+	enableCurrent := fs.options.EnableCurrent
+	fs.mutex.RUnlock()
+	if !found && stale {
+		return syscall.ESTALE
+	} else if !found {
+		return fuse.ENOENT
+	}
+	if !info.control {
+		return fuse.ENOSYS
+	}
+	if name != currentName || !enableCurrent {
+		return syscall.EPERM
+	}
+	return nil
+}
+
+// CreateSymlink selects a secret by creating the current symlink. Creating the symlink again replaces the selection,
+// like ln -sf would, since there's nothing else to do with an existing selection.
+func (fs *passFS) CreateSymlink(
+	ctx context.Context,
+	op *fuseops.CreateSymlinkOp) (err error) {
+	err = fs.controlDirError(op.Parent, op.Name)
+	if err != nil {
+		return err
+	}
+	symlinkInode := fs.allocateInode()
+	expiration := fs.attributesExpiration()
+
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	parent, found := fs.inodes[op.Parent]
+	if !found {
+		return syscall.ESTALE
+	}
+	parent.children = append(fs.removeCurrent(parent.children), getCurrentDirEnt(symlinkInode, fs.inodes))
+	numberDirents(parent.children)
+	fs.inodes[op.Parent] = parent
+	fs.currentTarget = op.Target
+	fs.countInodes()
+
+	op.Entry.Child = symlinkInode
+	op.Entry.Attributes = fs.inodes[symlinkInode].attributes
+	op.Entry.AttributesExpiration = expiration
+	fs.patchAttributes(&op.Entry.Attributes)
+	return
+}
+
+// removeCurrent returns the entries of the control directory without the current symlink, removing its inode. The
+// mutex must be held.
+func (fs *passFS) removeCurrent(children []fuseutil.Dirent) []fuseutil.Dirent {
+	var kept []fuseutil.Dirent
+	for _, child := range children {
+		if child.Name == currentName {
+			delete(fs.inodes, child.Inode)
+			continue
+		}
+		kept = append(kept, child)
+	}
+	return kept
+}
+
+// Unlink clears the selection by removing the current symlink.
+func (fs *passFS) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) (err error) {
+	err = fs.controlDirError(op.Parent, op.Name)
+	if err != nil {
+		return err
+	}
+
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	parent, found := fs.inodes[op.Parent]
+	if !found {
+		return syscall.ESTALE
+	}
+	children := fs.removeCurrent(parent.children)
+	if len(children) == len(parent.children) {
+		return fuse.ENOENT
+	}
+	parent.children = children
+	numberDirents(parent.children)
+	fs.inodes[op.Parent] = parent
+	fs.currentTarget = ""
+	fs.countInodes()
+	return
+}
+
+// writableFileError returns the error for writing to or truncating a file other than the lock file or the search file,
+// or nil if the inode is one of them and it's enabled.
+func (fs *passFS) writableFileError(inode inodeInfo) error {
+	options := fs.getOptions()
+	if inode.controlFile == lockName && options.EnableLock || inode.controlFile == searchName && options.EnableSearch {
+		return nil
+	}
+	return syscall.EPERM
+}
+
+// SetInodeAttributes only allows truncating the lock file and the search file, which shells do before writing to them.
+// Truncating the search file clears its query, nothing else is changed.
+func (fs *passFS) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) (err error) {
+	inode, err := fs.getInode(op.Inode)
+	if err != nil {
+		return err
+	}
+	err = fs.writableFileError(*inode)
+	if err != nil {
+		return err
+	}
+	if inode.controlFile == searchName && op.Size != nil && *op.Size == 0 {
+		fs.clearSearchQuery()
+	}
+	op.Attributes = inode.attributes
+	op.AttributesExpiration = fs.entryExpiration(*inode)
+	fs.patchAttributes(&op.Attributes)
+	return
+}
+
+// WriteFile locks the mount when anything is written to the lock file, whatever is written, and sets the query of the
+// search file to what's written to it.
+func (fs *passFS) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) (err error) {
+	inode, err := fs.getInode(op.Inode)
+	if err != nil {
+		return err
+	}
+	err = fs.writableFileError(*inode)
+	if err != nil {
+		return err
+	}
+	if inode.controlFile == searchName {
+		fs.writeSearchQuery(op.Data, op.Offset)
+		return
+	}
+	err = fs.lock()
+	if err != nil {
+		log.Print(err)
+		return syscall.EIO
+	}
+	return
+}
+
+func (fs *passFS) ReadSymlink(
+	ctx context.Context,
+	op *fuseops.ReadSymlinkOp) (err error) {
+	inode, err := fs.getInode(op.Inode)
+	if err != nil {
+		return err
+	}
+	if !inode.symlink {
+		return fuse.EINVAL
+	}
+	if inode.target != "" {
+		op.Target = inode.target
+		return
+	}
+	op.Target = fs.resolveCurrent(fs.getCurrentTarget())
+	return
+}
@@ -0,0 +1,84 @@
+package fs
+
+import (
+	"github.com/femnad/passfuse/pkg/pass"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+	"log"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	dateDirName = "by-date"
+	// Month directory of secrets without a date
+	unknownMonth = "unknown"
+)
+
+// Layouts of the dates in the date field
+var dateLayouts = []string{"2006-01-02", time.RFC3339, "2006-01-02 15:04:05", "2006-01", "2006/01/02"}
+
+// secretMonth is the month of the date field of a secret, for the hash of its file when it was decrypted.
+type secretMonth struct {
+	hash  string
+	month string
+}
+
+// parseMonth returns the month of a date in the date field of a secret as YYYY-MM, or unknownMonth if the secret
+// doesn't have a date in a known layout.
+func parseMonth(secret, secretBody, field string) string {
+	value, _ := pass.ParseSecret(secretBody).GetField(strings.ToLower(field))
+	if value == "" {
+		return unknownMonth
+	}
+	for _, layout := range dateLayouts {
+		date, err := time.Parse(layout, value)
+		if err == nil {
+			return date.Format("2006-01")
+		}
+	}
+	log.Printf("Ignoring date %q of secret %s which isn't in a known layout", value, secret)
+	return unknownMonth
+}
+
+// getMonth decrypts a secret to read the month of its date field, unless the month of the secret in its current
+// version is known. Months aren't kept if caching contents is disabled.
+func (fs *passFS) getMonth(secret string) string {
+	hash, err := hashSecretFile(path.Join(fs.storePath, secret))
+	if err == nil {
+		fs.mutex.RLock()
+		cached, found := fs.secretMonths[secret]
+		fs.mutex.RUnlock()
+		if found && cached.hash == hash {
+			return cached.month
+		}
+	}
+
+	body, err := pass.GetSecret(fs.ctx, secret)
+	if err != nil {
+		log.Printf("Leaving out secret %s which failed to decrypt for reading its date: %s", secret, err)
+		return ""
+	}
+	month := parseMonth(secret, body, fs.options.ByDate)
+	if hash != "" && !fs.options.NoContentCache {
+		fs.mutex.Lock()
+		fs.secretMonths[secret] = secretMonth{hash: hash, month: month}
+		fs.mutex.Unlock()
+	}
+	return month
+}
+
+// getDateDirEnt creates the date directory with a directory per month, having symlinks to the secrets with a date in
+// the month, and an unknown directory for secrets without a date.
+func (fs *passFS) getDateDirEnt(rootNode pass.Node, rootChildren []fuseutil.Dirent, offset fuseops.DirOffset,
+	inodes map[fuseops.InodeID]inodeInfo) fuseutil.Dirent {
+	months := make(map[string][]string)
+	for _, leaf := range pass.GetLeaves(rootNode) {
+		month := fs.getMonth(leaf.Secret)
+		if month != "" {
+			months[month] = append(months[month], leaf.Secret)
+		}
+	}
+	return fs.getGroupsDirEnt(dateDirName, months, rootChildren, offset, inodes)
+}
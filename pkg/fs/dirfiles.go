@@ -0,0 +1,59 @@
+package fs
+
+import (
+	"fmt"
+	"github.com/femnad/passfuse/pkg/pass"
+	"path"
+	"strings"
+)
+
+// fileTypeByName returns the file type with the given name, which is its default suffix without the leading dot.
+func fileTypeByName(name string) (pass.NodeType, bool) {
+	for nodeType, suffix := range suffixMap {
+		if strings.TrimPrefix(suffix, ".") == name {
+			return nodeType, true
+		}
+	}
+	return 0, false
+}
+
+// parseDirFiles parses overrides of the file types of the secrets in directories given as dir=type,type, returning
+// the file types in the order they're listed keyed by the path of the directory relative to the mount point.
+func parseDirFiles(specs []string) (map[string][]pass.NodeType, error) {
+	overrides := make(map[string][]pass.NodeType)
+	for _, spec := range specs {
+		separator := strings.Index(spec, "=")
+		if separator <= 0 || separator == len(spec)-1 {
+			return nil, fmt.Errorf("directory file types %q are not in the form dir=type,type", spec)
+		}
+		enabled := make(map[pass.NodeType]bool)
+		for _, name := range strings.Split(spec[separator+1:], ",") {
+			fileType, found := fileTypeByName(strings.TrimSpace(name))
+			if !found {
+				return nil, fmt.Errorf("unknown file type %q in %q", name, spec)
+			}
+			enabled[fileType] = true
+		}
+		var types []pass.NodeType
+		for _, fileType := range fileTypeOrder {
+			if enabled[fileType] {
+				types = append(types, fileType)
+			}
+		}
+		overrides[path.Clean(strings.Trim(spec[:separator], "/"))] = types
+	}
+	return overrides, nil
+}
+
+// childFileTypes returns the file types of the secrets in a directory, which are the ones of its parent unless they
+// are overridden for the directory by its displayed path.
+func (fs *passFS) childFileTypes(dir pass.Node, parentTypes []pass.NodeType) []pass.NodeType {
+	prefix := strings.Trim(fs.prefix, "/")
+	dirPath := fs.options.displayedPath(strings.TrimPrefix(dir.Secret, prefix+"/"))
+	for overridden, types := range fs.dirFileTypes {
+		if fs.options.displayedPath(overridden) == dirPath {
+			return types
+		}
+	}
+	return parentTypes
+}
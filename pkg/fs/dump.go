@@ -0,0 +1,45 @@
+package fs
+
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
+func (fs *passFS) trackRead(delta int) {
+	fs.counters.mutex.Lock()
+	defer fs.counters.mutex.Unlock()
+	fs.counters.activeReads += delta
+}
+
+// dump writes inode and cache statistics, the secrets with cached sizes and in-flight reads. Only names of secrets
+// are written, never their content. It only takes the mutex of the counters, so that it doesn't wait for operations
+// holding the filesystem mutex.
+func (fs *passFS) dump(w io.Writer) {
+	fs.counters.mutex.Lock()
+	defer fs.counters.mutex.Unlock()
+
+	cachedSecrets := fs.counters.sortedCachedSecrets()
+	fmt.Fprintf(w, "inodes: %d\n", fs.counters.inodes)
+	fmt.Fprintf(w, "stale inodes: %d\n", fs.counters.staleInodes)
+	fmt.Fprintf(w, "reads: %d\n", fs.counters.reads)
+	fmt.Fprintf(w, "read errors: %d\n", fs.counters.readErrors)
+	fmt.Fprintf(w, "size cache hits: %d\n", fs.counters.sizeHits)
+	fmt.Fprintf(w, "size cache misses: %d\n", fs.counters.sizeMisses)
+	fmt.Fprintf(w, "open file handles: %d\n", fs.counters.openHandles)
+	fmt.Fprintf(w, "in-flight reads: %d\n", fs.counters.activeReads)
+	fmt.Fprintf(w, "secrets with cached sizes: %d\n", len(cachedSecrets))
+	for _, secret := range cachedSecrets {
+		fmt.Fprintf(w, "  %s\n", secret)
+	}
+}
+
+// sortedCachedSecrets returns the secrets whose sizes are cached. The counters mutex must be held.
+func (c *fsCounters) sortedCachedSecrets() []string {
+	var secrets []string
+	for secret := range c.cachedSecrets {
+		secrets = append(secrets, secret)
+	}
+	sort.Strings(secrets)
+	return secrets
+}
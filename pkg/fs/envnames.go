@@ -0,0 +1,71 @@
+package fs
+
+import (
+	"github.com/femnad/passfuse/pkg/pass"
+	"github.com/jacobsa/fuse/fuseops"
+	"log"
+	"path"
+	"strings"
+	"unicode"
+)
+
+// envName translates the path of a secret relative to the mount point to an environment variable style name, e.g.
+// work/github-token to WORK_GITHUB_TOKEN.
+func envName(secretPath string) string {
+	return strings.Map(func(r rune) rune {
+		if r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			return unicode.ToUpper(r)
+		}
+		return '_'
+	}, secretPath)
+}
+
+// buildEnvNames maps the environment variable style names of the secrets in the tree to the first file of each
+// secret, or its field directory. Names shared by several secrets are reported and left out, since they could refer
+// to any of them.
+func buildEnvNames(inodes map[fuseops.InodeID]inodeInfo) map[string]fuseops.InodeID {
+	names := make(map[string]fuseops.InodeID)
+	secrets := make(map[string]string)
+	collisions := make(map[string]bool)
+
+	var walk func(id fuseops.InodeID, dirPath string)
+	walk = func(id fuseops.InodeID, dirPath string) {
+		for _, child := range inodes[id].children {
+			info := inodes[child.Inode]
+			if info.control {
+				continue
+			}
+			if info.dir && info.inodeType != pass.Field {
+				walk(child.Inode, path.Join(dirPath, child.Name))
+				continue
+			}
+			if info.secret == "" {
+				continue
+			}
+			baseName := strings.TrimSuffix(path.Base(info.secret), pass.GetSecretSuffix())
+			name := envName(path.Join(dirPath, baseName))
+			existing, found := secrets[name]
+			if found && existing != info.secret && !collisions[name] {
+				log.Printf("Secrets %s and %s both have the environment name %s, it won't resolve to either",
+					existing, info.secret, name)
+				collisions[name] = true
+				delete(names, name)
+			}
+			if !found {
+				// The first file of a secret is the one the name resolves to.
+				secrets[name] = info.secret
+				names[name] = child.Inode
+			}
+		}
+	}
+	walk(fuseops.RootInodeID, "")
+	return names
+}
+
+// lookUpEnvName returns the inode an environment variable style name at the root resolves to.
+func (fs *passFS) lookUpEnvName(name string) (fuseops.InodeID, bool) {
+	fs.mutex.RLock()
+	defer fs.mutex.RUnlock()
+	id, found := fs.envNames[name]
+	return id, found
+}
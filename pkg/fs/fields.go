@@ -0,0 +1,113 @@
+package fs
+
+import (
+	"context"
+	"fmt"
+	"github.com/femnad/passfuse/pkg/pass"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+	"os"
+	"sort"
+	"strings"
+)
+
+// getFieldDirEnt creates a directory for a secret, whose field files are created when the directory is first used
+// since the fields are only known after decrypting the secret.
+func (fs *passFS) getFieldDirEnt(node pass.Node, offset fuseops.DirOffset,
+	inodes map[fuseops.InodeID]inodeInfo) fuseutil.Dirent {
+	dirInode := fs.allocateInode()
+	inodes[dirInode] = inodeInfo{
+		attributes: fuseops.InodeAttributes{
+			Nlink: 1,
+			Mode:  dirPermission | os.ModeDir,
+		},
+		dir:         true,
+		secret:      node.Secret,
+		inodeType:   pass.Field,
+		secretCount: 1,
+	}
+	return fuseutil.Dirent{
+		Offset: offset,
+		Inode:  dirInode,
+		Name:   strings.TrimSuffix(getSecretBaseName(node), pass.GetSecretSuffix()),
+		Type:   fuseutil.DT_Directory,
+	}
+}
+
+// sortFields orders field names for listing the password first and the other fields alphabetically, so that listings
+// don't depend on the order of the lines in the secret.
+func sortFields(fields []string) []string {
+	sort.SliceStable(fields, func(i, j int) bool {
+		if fields[i] == pass.PasswordField || fields[j] == pass.PasswordField {
+			return fields[i] == pass.PasswordField && fields[j] != pass.PasswordField
+		}
+		return fields[i] < fields[j]
+	})
+	return fields
+}
+
+// loadFields creates the field files of a field directory if they haven't been created yet.
+func (fs *passFS) loadFields(id fuseops.InodeID) error {
+	fs.mutex.RLock()
+	info, found := fs.inodes[id]
+	fs.mutex.RUnlock()
+	if !found || !info.dir || info.inodeType != pass.Field || info.fieldsLoaded {
+		return nil
+	}
+	if !fs.readAllowed(info) {
+		return denyRead(info.secret)
+	}
+
+	secretBody, err := pass.GetSecret(fs.ctx, info.secret)
+	if err != nil {
+		return err
+	}
+	var children []fuseutil.Dirent
+	fieldInodes := make(map[fuseops.InodeID]inodeInfo)
+	for index, field := range sortFields(pass.ParseSecret(secretBody).GetNonEmptyFields()) {
+		fieldInode := fs.allocateInode()
+		children = append(children, fuseutil.Dirent{
+			Offset: fuseops.DirOffset(index + 1),
+			Inode:  fieldInode,
+			Name:   field,
+			Type:   fuseutil.DT_File,
+		})
+		fieldInodes[fieldInode] = inodeInfo{
+			attributes: fuseops.InodeAttributes{
+				Nlink: 1,
+				Mode:  filePermission,
+			},
+			secret:    info.secret,
+			inodeType: pass.Field,
+			field:     field,
+		}
+	}
+
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	// The tree might have been refreshed or the fields loaded by a concurrent operation meanwhile.
+	current, found := fs.inodes[id]
+	if !found || current.fieldsLoaded {
+		return nil
+	}
+	for fieldInode, fieldInfo := range fieldInodes {
+		fs.inodes[fieldInode] = fieldInfo
+	}
+	current.children = children
+	current.fieldsLoaded = true
+	fs.inodes[id] = current
+	fs.countInodes()
+	return nil
+}
+
+func getFieldValue(ctx context.Context, secretName, field string) (string, error) {
+	secretBody, err := pass.GetSecret(ctx, secretName)
+	if err != nil {
+		return "", err
+	}
+	value, found := pass.ParseSecret(secretBody).GetField(field)
+	if !found {
+		return "", fmt.Errorf("secret %s doesn't have a field %s", secretName, field)
+	}
+	return value, nil
+}
@@ -0,0 +1,94 @@
+package fs
+
+import (
+	"fmt"
+	"github.com/femnad/passfuse/pkg/pass"
+	"log"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// fieldMatch is whether a secret matched the field filter, for the hash of its file when it was decrypted.
+type fieldMatch struct {
+	hash    string
+	matches bool
+}
+
+// fieldFilter selects secrets having a field with a non-empty value, optionally matching a pattern.
+type fieldFilter struct {
+	field   string
+	pattern *regexp.Regexp
+}
+
+func newFieldFilter(options PassFsOptions) (*fieldFilter, error) {
+	if options.HasField == "" {
+		if options.FieldPattern != "" {
+			return nil, fmt.Errorf("a field pattern requires a field to match")
+		}
+		return nil, nil
+	}
+	filter := fieldFilter{field: strings.ToLower(options.HasField)}
+	if options.FieldPattern != "" {
+		pattern, err := regexp.Compile(options.FieldPattern)
+		if err != nil {
+			return nil, fmt.Errorf("error compiling field pattern: %s", err)
+		}
+		filter.pattern = pattern
+	}
+	return &filter, nil
+}
+
+func (f fieldFilter) matches(secretBody string) bool {
+	value, found := pass.ParseSecret(secretBody).GetField(f.field)
+	if !found || value == "" {
+		return false
+	}
+	return f.pattern == nil || f.pattern.MatchString(value)
+}
+
+// matchesField decrypts a secret to check it against the filter, unless it's known whether the secret in its current
+// version matches. Matches aren't kept if caching contents is disabled.
+func (fs *passFS) matchesField(filter fieldFilter, secret string) bool {
+	var hash string
+	if !fs.options.NoContentCache {
+		hash, _ = hashSecretFile(path.Join(fs.storePath, secret))
+	}
+	if hash != "" {
+		fs.mutex.RLock()
+		match, found := fs.fieldMatches[secret]
+		fs.mutex.RUnlock()
+		if found && match.hash == hash {
+			return match.matches
+		}
+	}
+
+	body, err := pass.GetSecret(fs.ctx, secret)
+	if err != nil {
+		log.Printf("Hiding secret %s which failed to decrypt for matching fields: %s", secret, err)
+		return false
+	}
+	matches := filter.matches(body)
+	if hash != "" {
+		fs.mutex.Lock()
+		fs.fieldMatches[secret] = fieldMatch{hash: hash, matches: matches}
+		fs.mutex.Unlock()
+	}
+	return matches
+}
+
+// filterTree returns the tree with only the secrets matching the filter, leaving out directories without any.
+func (fs *passFS) filterTree(filter fieldFilter, node pass.Node) (pass.Node, bool) {
+	if node.IsLeaf {
+		return node, fs.matchesField(filter, node.Secret)
+	}
+	var children []pass.Node
+	for _, child := range node.Children {
+		filtered, keep := fs.filterTree(filter, child)
+		if keep {
+			children = append(children, filtered)
+		}
+	}
+	node.Children = children
+	return node, len(children) > 0
+}
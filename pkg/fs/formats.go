@@ -0,0 +1,98 @@
+package fs
+
+import (
+	"context"
+	"fmt"
+	"github.com/femnad/passfuse/pkg/pass"
+	"strings"
+)
+
+// secretKeyValues returns the fields of a secret as key value pairs in the order of the secret, preceded by the
+// password if it's included.
+func secretKeyValues(ctx context.Context, secretName string, includePassword bool) ([][2]string, error) {
+	body, err := pass.GetSecret(ctx, secretName)
+	if err != nil {
+		return nil, err
+	}
+	secret := pass.ParseSecret(body)
+	var pairs [][2]string
+	if includePassword {
+		pairs = append(pairs, [2]string{pass.PasswordField, secret.Password})
+	}
+	for _, name := range secret.FieldNames {
+		pairs = append(pairs, [2]string{name, secret.Fields[name]})
+	}
+	return pairs, nil
+}
+
+func isBareTomlKey(key string) bool {
+	for _, r := range key {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-') {
+			return false
+		}
+	}
+	return key != ""
+}
+
+// quoteToml quotes a value as a TOML basic string, escaping quotes, backslashes and control characters.
+func quoteToml(value string) string {
+	var quoted strings.Builder
+	quoted.WriteByte('"')
+	for _, r := range value {
+		switch {
+		case r == '"' || r == '\\':
+			quoted.WriteByte('\\')
+			quoted.WriteRune(r)
+		case r == '\t':
+			quoted.WriteString(`\t`)
+		case r < 0x20 || r == 0x7f:
+			fmt.Fprintf(&quoted, `\u%04X`, r)
+		default:
+			quoted.WriteRune(r)
+		}
+	}
+	quoted.WriteByte('"')
+	return quoted.String()
+}
+
+// renderToml renders the fields of a secret, and the password if it's included, as TOML key value pairs. Keys which
+// can't be bare keys are quoted.
+func renderToml(ctx context.Context, secretName string, includePassword bool) ([]byte, error) {
+	pairs, err := secretKeyValues(ctx, secretName, includePassword)
+	if err != nil {
+		return nil, err
+	}
+	var lines []string
+	for _, pair := range pairs {
+		key := pair[0]
+		if !isBareTomlKey(key) {
+			key = quoteToml(key)
+		}
+		lines = append(lines, key+" = "+quoteToml(pair[1])+"\n")
+	}
+	return []byte(strings.Join(lines, "")), nil
+}
+
+// quoteIni quotes a value like git config does, since INI has no escaping of its own, escaping quotes, backslashes,
+// newlines and tabs.
+func quoteIni(value string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\t", `\t`).Replace(value) + `"`
+}
+
+// renderIni renders the fields of a secret, and the password if it's included, as INI key value pairs without a
+// section. Fields whose names can't be INI keys, e.g. because they contain an equals sign or start a comment, are left
+// out.
+func renderIni(ctx context.Context, secretName string, includePassword bool) ([]byte, error) {
+	pairs, err := secretKeyValues(ctx, secretName, includePassword)
+	if err != nil {
+		return nil, err
+	}
+	var lines []string
+	for _, pair := range pairs {
+		if strings.ContainsAny(pair[0], "=;#[]\"") {
+			continue
+		}
+		lines = append(lines, pair[0]+" = "+quoteIni(pair[1])+"\n")
+	}
+	return []byte(strings.Join(lines, "")), nil
+}
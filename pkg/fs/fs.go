@@ -1,36 +1,287 @@
 package fs
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"github.com/femnad/passfuse/pkg/pass"
 	"github.com/jacobsa/fuse"
 	"github.com/jacobsa/fuse/fuseops"
 	"github.com/jacobsa/fuse/fuseutil"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
+	"path"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 )
 
 const (
 	dirPermission        = 0500
 	filePermission       = 0400
-	secretFileSuffix     = ".gpg"
 	secretContentsSuffix = ".contents"
-	firstLineSuffix = ".first-line"
+	firstLineSuffix      = ".first-line"
+	historySuffix        = ".history"
+	framedSuffix         = ".framed"
+	tomlSuffix           = ".toml"
+	iniSuffix            = ".ini"
+	ageSuffix            = ".age"
+	qrSuffix             = ".qr"
+	// Files whose content changes over time, like age files and control files, are cached for a shorter time
+	shortAttributesExpiration = time.Minute
 )
 
-var suffixMap = map[pass.NodeType]string {
-	pass.Contents: secretContentsSuffix,
+var suffixMap = map[pass.NodeType]string{
+	pass.Contents:  secretContentsSuffix,
 	pass.FirstLine: firstLineSuffix,
+	pass.History:   historySuffix,
+	pass.Framed:    framedSuffix,
+	pass.Toml:      tomlSuffix,
+	pass.Ini:       iniSuffix,
+	pass.Age:       ageSuffix,
+	pass.QR:        qrSuffix,
+}
+
+// GetModes returns the modes of the mounted files and directories, keyed by the kind of entries they apply to.
+func GetModes() map[string]os.FileMode {
+	return map[string]os.FileMode{
+		"files":               filePermission,
+		"directories":         dirPermission,
+		"control directories": controlDirPermission,
+	}
 }
 
 type PassFsOptions struct {
 	ContentFiles   bool
 	FirstLineFiles bool
+	StrictGpg      bool
+	// Serve first line files only once within OneShotWindow
+	OneShotFirstLine bool
+	OneShotWindow    time.Duration
+	// Persist secret sizes across mounts
+	PersistSizeCache bool
+	// Don't keep the sizes of secrets in memory, decrypting them again for every lookup
+	NoSizeCache bool
+	// Don't keep what was decrypted from secrets in memory, e.g. their first lines for all.env
+	NoContentCache bool
+	// Decrypt a secret before mounting to make sure decryption works
+	Probe bool
+	// Only mount the directory structure, without any files for secrets
+	DirectoriesOnly bool
+	HistoryFiles    bool
+	// Mount secrets as directories with a file per field
+	FieldDirs bool
+	// Only mount the directory structure and the encrypted files of secrets, never decrypting anything
+	NoDecrypt bool
+	// Add a control directory with a writable symlink for selecting a secret
+	EnableCurrent bool
+	// Add a control directory with files showing the state of the mount
+	ShowControl bool
+	// Add a lock file to the control directory, clearing what was decrypted and stopping the GPG agent when written
+	EnableLock bool
+	// Send a desktop notification when reading fails because the GPG agent can't ask for a passphrase
+	Notify bool
+	// Mount the decrypted content of secrets with the names of their files in the store
+	Mirror bool
+	// Only mount secrets with a non-empty value for this field, matching FieldPattern if it's set
+	HasField     string
+	FieldPattern string
+	// Resolve environment variable style names of secrets at the root, e.g. WORK_GITHUB for work/github
+	EnvNames bool
+	// Maximum number of open file handles, 0 means unlimited
+	MaxOpenFiles int
+	// Add a tags directory with a directory per tag in the tags field of secrets, linking to the secrets
+	ByTag bool
+	// Add a by-date directory with a directory per month of the dates in this field of secrets, linking to the secrets
+	ByDate string
+	// Mount the secrets in a directory with this name at the mount point rather than at the mount point itself
+	RootName string
+	// Add a file to the control directory with the first lines of all secrets as dotenv lines
+	AllEnv bool
+	// Add a file to the control directory listing the secrets matching the query written to it
+	EnableSearch bool
+	// Report the size of files showing passwords as 0, while reads still return the passwords
+	HideSizes bool
+	// Show the names of directories and files lowercased, while reading the secrets by their paths
+	LowercaseNames bool
+	// Add a file to the control directory with the recipients of the secrets at the mount point
+	ShowRecipients bool
+	// Mount template files in the store rendered with the fields of the secrets of the same name
+	Templates bool
+	// Add a file to the control directory streaming a tar archive of the decrypted contents of all secrets
+	TarExport bool
+	// Additional names of the files of secrets sharing their inodes, each as alias=secret
+	Aliases []string
+	// Don't let the kernel cache attributes, so that they're fetched again for every stat
+	NoAttrCache bool
+	// Mount files with the content of secrets prefixed by its length
+	FramedFiles bool
+	// Mount files with the fields of secrets as TOML or INI, with the password only if IncludePassword is set
+	TomlFiles       bool
+	IniFiles        bool
+	IncludePassword bool
+	// Mount files with the time since secrets were last changed, with AgeSuffix instead of the default suffix if it's
+	// set
+	AgeFiles  bool
+	AgeSuffix string
+	// Mount files with PNG images of QR codes of the first lines of secrets, or of QrField if it's set
+	QrFiles bool
+	QrField string
+	// File types of secrets in directories and their subdirectories overriding the enabled ones, each as dir=type,type
+	DirFiles []string
+	// Number of times reading a secret is retried after transient errors, e.g. of a store on a network filesystem
+	StoreRetries int
+	// Rebuild the tree from where the store path resolves to when refreshing, rather than failing if it changed
+	FollowStoreLink bool
+	// Real directory whose entries are mounted along with the secrets
+	Overlay string
+	// Time operations which may run commands may take before they fail with EIO, 0 means no timeout
+	OpTimeout time.Duration
+	// File with the names of the only secrets which may be decrypted for reading, all secrets may be if it's empty
+	AllowReadFile string
+	// Mount only the files of this secret at the root, without reading the rest of the store
+	SingleSecret string
+	// How entries with the same name as another entry in the same directory are handled, one of suffix, skip or
+	// error, empty for leaving them as they are so that only the first of them can be looked up
+	NameCollisions string
+}
+
+func (options PassFsOptions) validate() error {
+	if !validCollisionPolicy(options.NameCollisions) {
+		return fmt.Errorf("unknown name collision policy %s, expected suffix, skip or error", options.NameCollisions)
+	}
+	if options.Mirror && options.NoDecrypt {
+		return fmt.Errorf("mirror and no decrypt modes are mutually exclusive")
+	}
+	if options.HasField != "" && options.NoDecrypt {
+		return fmt.Errorf("matching fields requires decrypting secrets")
+	}
+	if options.PersistSizeCache && options.NoSizeCache {
+		return fmt.Errorf("persisting sizes requires caching them")
+	}
+	if options.ByTag && options.NoDecrypt {
+		return fmt.Errorf("reading tags requires decrypting secrets")
+	}
+	if options.ByDate != "" && options.NoDecrypt {
+		return fmt.Errorf("reading dates requires decrypting secrets")
+	}
+	if options.AllEnv && options.NoDecrypt {
+		return fmt.Errorf("rendering first lines requires decrypting secrets")
+	}
+	if options.Templates && options.NoDecrypt {
+		return fmt.Errorf("rendering templates requires decrypting secrets")
+	}
+	if options.TarExport && options.NoDecrypt {
+		return fmt.Errorf("exporting secrets requires decrypting them")
+	}
+	if options.NoContentCache && pass.GetSnapshotWindow() > 0 {
+		return fmt.Errorf("snapshots keep decrypted secrets in memory, which requires caching contents")
+	}
+	_, err := parseAliases(options.Aliases)
+	if err != nil {
+		return err
+	}
+	_, err = parseDirFiles(options.DirFiles)
+	if err != nil {
+		return err
+	}
+	if len(options.DirFiles) > 0 && (options.Mirror || options.NoDecrypt || options.fieldDirs() ||
+		options.DirectoriesOnly) {
+		return fmt.Errorf("file types of directories can't be set when mounting only directories, field directories, " +
+			"mirrored or encrypted files")
+	}
+	if options.RootName == "." || options.RootName == ".." || strings.Contains(options.RootName, "/") {
+		return fmt.Errorf("root name %s isn't a valid directory name", options.RootName)
+	}
+	if strings.Contains(options.AgeSuffix, "/") {
+		return fmt.Errorf("age suffix %s can't contain a slash", options.AgeSuffix)
+	}
+	if options.RootName == controlDirName {
+		return fmt.Errorf("root name %s is reserved for the control directory", options.RootName)
+	}
+	_, err = newFieldFilter(options)
+	return err
+}
+
+// fieldDirs returns whether secrets are mounted as field directories, which the modes mounting one file with the name
+// of the secret file take precedence over.
+func (options PassFsOptions) fieldDirs() bool {
+	return options.FieldDirs && !options.NoDecrypt && !options.Mirror
+}
+
+// fileSuffix returns the suffix replacing the secret suffix in the names of files of the given type. Raw files, and
+// content files in mirror mode, keep the secret suffix.
+func (options PassFsOptions) fileSuffix(nodeType pass.NodeType) string {
+	if nodeType == pass.Raw || (nodeType == pass.Contents && options.Mirror) {
+		return pass.GetSecretSuffix()
+	}
+	if nodeType == pass.Age && options.AgeSuffix != "" {
+		return options.AgeSuffix
+	}
+	return suffixMap[nodeType]
+}
+
+// Order in which the files of a secret are listed, regardless of which of them are enabled
+var fileTypeOrder = []pass.NodeType{pass.Contents, pass.FirstLine, pass.Raw, pass.History, pass.Framed, pass.Toml,
+	pass.Ini, pass.Age, pass.QR}
+
+// fileTypes returns the types of files to create for each secret, in the order they're listed.
+func (options PassFsOptions) fileTypes() []pass.NodeType {
+	if options.DirectoriesOnly || options.fieldDirs() {
+		return nil
+	}
+	if options.Mirror {
+		return []pass.NodeType{pass.Contents}
+	}
+	enabled := map[pass.NodeType]bool{
+		pass.Contents:  options.ContentFiles && !options.NoDecrypt,
+		pass.FirstLine: options.FirstLineFiles && !options.NoDecrypt,
+		pass.Raw:       options.NoDecrypt,
+		// History files only need the git log, not decrypting the secret.
+		pass.History: options.HistoryFiles,
+		pass.Framed:  options.FramedFiles && !options.NoDecrypt,
+		pass.Toml:    options.TomlFiles && !options.NoDecrypt,
+		pass.Ini:     options.IniFiles && !options.NoDecrypt,
+		pass.Age:     options.AgeFiles,
+		pass.QR:      options.QrFiles && !options.NoDecrypt,
+	}
+	var types []pass.NodeType
+	for _, fileType := range fileTypeOrder {
+		if enabled[fileType] {
+			types = append(types, fileType)
+		}
+	}
+	return types
+}
+
+// Names of file types for describing the options
+var fileTypeNames = map[pass.NodeType]string{
+	pass.Contents:  "contents",
+	pass.FirstLine: "first line",
+	pass.Raw:       "raw",
+	pass.History:   "history",
+	pass.Framed:    "framed",
+	pass.Toml:      "TOML",
+	pass.Ini:       "INI",
+	pass.Age:       "age",
+	pass.QR:        "QR code",
+}
+
+// FileTypeNames returns the names of the types of files mounted for each secret, in the order they're listed, with
+// fields for field directories.
+func (options PassFsOptions) FileTypeNames() []string {
+	names := []string{}
+	for _, fileType := range options.fileTypes() {
+		names = append(names, fileTypeNames[fileType])
+	}
+	if options.fieldDirs() {
+		names = append(names, "fields")
+	}
+	return names
 }
 
 func (fs *passFS) allocateInode() fuseops.InodeID {
@@ -49,10 +300,11 @@ func getSecretBaseName(node pass.Node) string {
 	return splitBySlash[len(splitBySlash)-1]
 }
 
-func (fs *passFS) getDirEnt(node pass.Node, offset fuseops.DirOffset, nodeType pass.NodeType) fuseutil.Dirent {
+func (fs *passFS) getDirEnt(node pass.Node, offset fuseops.DirOffset, nodeType pass.NodeType,
+	inodes map[fuseops.InodeID]inodeInfo) fuseutil.Dirent {
 	baseName := getSecretBaseName(node)
-	suffix := suffixMap[nodeType]
-	displayedName := strings.Replace(baseName, secretFileSuffix, suffix, 1)
+	suffix := fs.options.fileSuffix(nodeType)
+	displayedName := strings.Replace(baseName, pass.GetSecretSuffix(), suffix, 1)
 	childInode := fs.allocateInode()
 
 	childEnt := fuseutil.Dirent{
@@ -61,31 +313,30 @@ func (fs *passFS) getDirEnt(node pass.Node, offset fuseops.DirOffset, nodeType p
 		Name:   displayedName,
 		Type:   fuseutil.DT_File,
 	}
-	fs.inodes[childInode] = inodeInfo{
+	inodes[childInode] = inodeInfo{
 		attributes: fuseops.InodeAttributes{
 			Nlink: 1,
 			Mode:  filePermission,
 		},
-		dir: false,
-		secret:node.Secret,
-		inodeType:nodeType,
+		dir:       false,
+		secret:    node.Secret,
+		inodeType: nodeType,
 	}
 
 	return childEnt
 }
 
-func (fs *passFS) locateChildren(node pass.Node, offset fuseops.DirOffset) []fuseutil.Dirent {
-	if node.IsLeaf {
+// locateChildren creates the entries for a node, with files of the given types for secrets.
+func (fs *passFS) locateChildren(node pass.Node, offset fuseops.DirOffset, types []pass.NodeType,
+	inodes map[fuseops.InodeID]inodeInfo) []fuseutil.Dirent {
+	if node.IsLeaf && fs.options.fieldDirs() {
+		return []fuseutil.Dirent{fs.getFieldDirEnt(node, offset, inodes)}
+	} else if node.IsLeaf {
 		var entries []fuseutil.Dirent
 		offsetStart := offset
-		if fs.options.ContentFiles {
-			contentsDirEnt := fs.getDirEnt(node, offsetStart, pass.Contents)
-			entries = append(entries, contentsDirEnt)
-			offsetStart++
-		}
-		if fs.options.FirstLineFiles {
-			firstLineDirEnt := fs.getDirEnt(node, offsetStart, pass.FirstLine)
-			entries = append(entries, firstLineDirEnt)
+		for _, fileType := range types {
+			dirEnt := fs.getDirEnt(node, offsetStart, fileType, inodes)
+			entries = append(entries, dirEnt)
 			offsetStart++
 		}
 		return entries
@@ -93,13 +344,18 @@ func (fs *passFS) locateChildren(node pass.Node, offset fuseops.DirOffset) []fus
 		var nodesChildren []fuseutil.Dirent
 		// index is 1-based
 		index := 1
+		childTypes := fs.childFileTypes(node, types)
 		for _, child := range node.Children {
-			children := fs.locateChildren(child, fuseops.DirOffset(index))
+			children := fs.locateChildren(child, fuseops.DirOffset(index), childTypes, inodes)
 			// account for the fact we might create more than one virtual entry per actual entry
 			offsetConsumed := len(children)
 			index += offsetConsumed
 			nodesChildren = append(nodesChildren, children...)
 		}
+		fs.lowercaseNames(nodesChildren)
+		nodesChildren = fs.resolveCollisions(node.Secret, nodesChildren, inodes)
+		nodesChildren = fs.addTemplates(node, nodesChildren, inodes)
+		nodesChildren = fs.addOverlay(fs.overlayDirPath(node.Secret), nodesChildren, inodes)
 		nodeInode := fs.allocateInode()
 		nodeEnt := fuseutil.Dirent{
 			Offset: offset,
@@ -107,37 +363,44 @@ func (fs *passFS) locateChildren(node pass.Node, offset fuseops.DirOffset) []fus
 			Name:   getSecretBaseName(node),
 			Type:   fuseutil.DT_Directory,
 		}
-		fs.inodes[nodeInode] = inodeInfo{
+		inodes[nodeInode] = inodeInfo{
 			attributes: fuseops.InodeAttributes{
 				Nlink: 1,
 				Mode:  dirPermission | os.ModeDir,
 			},
-			dir: true,
-			secret:node.Secret,
-			children:nodesChildren,
+			dir:         true,
+			secret:      node.Secret,
+			children:    nodesChildren,
+			secretCount: len(pass.GetLeaves(node)),
 		}
 		return []fuseutil.Dirent{nodeEnt}
 	}
 }
 
-func NewPassFS(path, prefix string, options PassFsOptions) (server fuse.Server, err error) {
-
-	if !(options.ContentFiles || options.FirstLineFiles) {
-		log.Print("Neither content files nor first line files are enabled, mount point won't have any files")
+// getRootNameDirEnt creates the directory with the root name holding the entries which are otherwise at the root.
+func (fs *passFS) getRootNameDirEnt(children []fuseutil.Dirent, secretCount int,
+	inodes map[fuseops.InodeID]inodeInfo) fuseutil.Dirent {
+	dirInode := fs.allocateInode()
+	inodes[dirInode] = inodeInfo{
+		attributes: fuseops.InodeAttributes{
+			Nlink: 1,
+			Mode:  dirPermission | os.ModeDir,
+		},
+		dir:         true,
+		children:    children,
+		secretCount: secretCount,
 	}
-
-	user := uint32(os.Getuid())
-	group := uint32(os.Getgid())
-
-	rootNode, err := pass.GetPassTree(path, prefix)
-	if err != nil {
-		return nil, err
+	return fuseutil.Dirent{
+		Offset: 1,
+		Inode:  dirInode,
+		Name:   fs.options.RootName,
+		Type:   fuseutil.DT_Directory,
 	}
+}
 
+// buildInodes allocates inodes for the given tree, returning an inode map rooted at the root inode.
+func (fs *passFS) buildInodes(rootNode pass.Node) map[fuseops.InodeID]inodeInfo {
 	inodes := make(map[fuseops.InodeID]inodeInfo)
-	sizeMap := make(map[fuseops.InodeID]pass.SecretSize)
-	fs := &passFS{inodes: inodes, user: user, group: group, allocatableInode: fuseops.RootInodeID + 1, sizeMap: sizeMap,
-		options:options}
 	rootInfo := inodeInfo{
 		attributes: fuseops.InodeAttributes{
 			Nlink: 1,
@@ -148,27 +411,416 @@ func NewPassFS(path, prefix string, options PassFsOptions) (server fuse.Server,
 
 	var children []fuseutil.Dirent
 	index := 1
+	types := fs.childFileTypes(rootNode, fs.options.fileTypes())
 	for _, child := range rootNode.Children {
-		locatedChildren := fs.locateChildren(child, fuseops.DirOffset(index))
+		locatedChildren := fs.locateChildren(child, fuseops.DirOffset(index), types, inodes)
 		children = append(children, locatedChildren...)
 		index += len(locatedChildren)
 	}
+	fs.lowercaseNames(children)
+	children = fs.resolveCollisions(rootNode.Secret, children, inodes)
+	children = fs.addTemplates(rootNode, children, inodes)
+	children = fs.addOverlay("", children, inodes)
+	index = len(children) + 1
+	secretCount := len(pass.GetLeaves(rootNode))
+	if len(fs.options.Aliases) > 0 {
+		inodes[fuseops.RootInodeID] = inodeInfo{dir: true, children: children}
+		fs.addAliases(inodes)
+		children = inodes[fuseops.RootInodeID].children
+		index = len(children) + 1
+	}
+	if fs.options.ByTag {
+		_, err := findChildInode(tagsDirName, children)
+		if err == nil {
+			log.Printf("Not adding the tags directory, the password store has an entry named %s", tagsDirName)
+		} else {
+			children = append(children, fs.getTagsDirEnt(rootNode, children, fuseops.DirOffset(index), inodes))
+			index++
+		}
+	}
+	if fs.options.ByDate != "" {
+		_, err := findChildInode(dateDirName, children)
+		if err == nil {
+			log.Printf("Not adding the date directory, the password store has an entry named %s", dateDirName)
+		} else {
+			children = append(children, fs.getDateDirEnt(rootNode, children, fuseops.DirOffset(index), inodes))
+			index++
+		}
+	}
+	if fs.options.RootName != "" {
+		children = []fuseutil.Dirent{fs.getRootNameDirEnt(children, secretCount, inodes)}
+		index = 2
+	}
+	if fs.options.hasControlDir() {
+		children = append(children, fs.getControlDirEnt(rootNode, fuseops.DirOffset(index), inodes))
+	}
 	rootInfo.children = children
-	fs.inodes[fuseops.RootInodeID] = rootInfo
-	server = fuseutil.NewFileSystemServer(fs)
+	rootInfo.secretCount = secretCount
+	inodes[fuseops.RootInodeID] = rootInfo
+	return inodes
+}
+
+func (fs *passFS) getPassTree() (pass.Node, error) {
+	var root pass.Node
+	var err error
+	if fs.options.SingleSecret != "" {
+		root, err = pass.GetSecretTree(fs.storePath, fs.options.SingleSecret)
+	} else {
+		root, err = pass.GetPassTree(fs.storePath, fs.prefix, pass.ParseOptions{StrictGpg: fs.options.StrictGpg,
+			Templates: fs.options.Templates})
+	}
+	if err != nil {
+		return root, err
+	}
+	filter, err := newFieldFilter(fs.options)
+	if err != nil || filter == nil {
+		return root, err
+	}
+	root, _ = fs.filterTree(*filter, root)
+	return root, nil
+}
+
+func newPassFS(path, prefix string, options PassFsOptions) (*passFS, error) {
+	err := options.validate()
+	if err != nil {
+		return nil, err
+	}
+	if len(options.fileTypes()) == 0 && !options.FieldDirs && !options.DirectoriesOnly && len(options.DirFiles) == 0 {
+		log.Print("No file types are enabled, mount point won't have any files")
+	}
+
+	user := uint32(os.Getuid())
+	group := uint32(os.Getgid())
+
+	var cache *sizeCache
+	if options.PersistSizeCache {
+		cache, err = loadSizeCache(getSizeCachePath())
+		if err != nil {
+			return nil, err
+		}
+	}
+	allowed, err := loadAllowlist(options.AllowReadFile)
+	if err != nil {
+		return nil, err
+	}
+	dirFileTypes, _ := parseDirFiles(options.DirFiles)
+
+	sizeMap := make(map[fuseops.InodeID]pass.SecretSize)
+	ctx, cancel := context.WithCancel(context.Background())
+	fs := &passFS{user: user, group: group, allocatableInode: fuseops.RootInodeID + 1, sizeMap: sizeMap,
+		sizeLookups: make(map[fuseops.InodeID]*sizeLookup), options: options,
+		firstLineReads: make(map[fuseops.InodeID]time.Time), storePath: pass.GetStorePath(path),
+		prefix: prefix, sizeCache: cache, allowlist: allowed, dirFileTypes: dirFileTypes,
+		staleInodes: make(map[fuseops.InodeID]bool), streams: make(map[fuseops.HandleID]*pass.SecretStream),
+		tarExports: make(map[fuseops.HandleID]*tarExport), renderedFiles: make(map[fuseops.HandleID][]byte),
+		nextHandle: 1, ctx: ctx, cancel: cancel,
+		startTime: time.Now(), fieldMatches: make(map[string]fieldMatch), secretTags: make(map[string]secretTags),
+		secretMonths: make(map[string]secretMonth), firstLines: make(map[string]firstLine),
+		secretErrors: make(map[string]secretFailure), counters: fsCounters{cachedSecrets: make(map[string]bool)}}
+
+	err = fs.setOverlay(options)
+	if err != nil {
+		return nil, err
+	}
+	rootNode, err := fs.getPassTree()
+	if err != nil {
+		return nil, err
+	}
+	if options.HasField != "" {
+		log.Printf("Decrypting all secrets for matching field %s, this might take a while", options.HasField)
+	}
+	if options.ByTag {
+		log.Print("Decrypting all secrets for reading their tags, this might take a while")
+	}
+	if options.ByDate != "" {
+		log.Printf("Decrypting all secrets for reading their %s field, this might take a while", options.ByDate)
+	}
+	warnTarExport(PassFsOptions{}, options)
+	if options.Probe && !options.NoDecrypt {
+		err = probe(ctx, rootNode)
+		if err != nil {
+			return nil, err
+		}
+	}
+	fs.inodes = fs.buildInodes(rootNode)
+	fs.countInodes()
+	err = fs.checkCollisions(fs.inodes)
+	if err != nil {
+		return nil, err
+	}
+	err = fs.resolveStore()
+	if err != nil {
+		return nil, err
+	}
+	if options.EnvNames {
+		fs.envNames = buildEnvNames(fs.inodes)
+	}
+	return fs, nil
+}
+
+func findLeaf(node pass.Node) (pass.Node, bool) {
+	if node.IsLeaf {
+		return node, true
+	}
+	for _, child := range node.Children {
+		leaf, found := findLeaf(child)
+		if found {
+			return leaf, true
+		}
+	}
+	return pass.Node{}, false
+}
+
+// probe decrypts the first secret in the tree to surface decryption problems before mounting.
+func probe(ctx context.Context, rootNode pass.Node) error {
+	leaf, found := findLeaf(rootNode)
+	if !found {
+		log.Print("No secrets found for probing decryption")
+		return nil
+	}
+	_, err := pass.GetSecret(ctx, leaf.Secret)
+	if err != nil {
+		return fmt.Errorf("probing decryption failed, check that the key for %s is available: %s", leaf.Secret, err)
+	}
+	return nil
+}
+
+// Server serves a password store as a filesystem and allows rebuilding it while mounted.
+type Server struct {
+	fuse.Server
+	fs *passFS
+}
+
+// Dump writes the current state of the filesystem for debugging.
+func (s *Server) Dump(w io.Writer) {
+	s.fs.dump(w)
+}
+
+// Refresh rebuilds the filesystem tree from the password store.
+func (s *Server) Refresh() error {
+	return s.fs.refresh()
+}
+
+// Reload applies the given options and rebuilds the filesystem tree with them.
+func (s *Server) Reload(options PassFsOptions) error {
+	return s.fs.reload(options)
+}
+
+// Interrupt stops commands of reads in flight and fails later reads, so that the filesystem can be unmounted without
+// waiting for reads blocked on decrypting secrets.
+func (s *Server) Interrupt() {
+	s.fs.cancel()
+}
+
+// NewPassFS creates a server for the secrets of a source, which is the password store at the path for a nil source.
+func NewPassFS(path, prefix string, options PassFsOptions, source pass.SecretSource) (server *Server, err error) {
+	pass.SetSource(source)
+	fs, err := newPassFS(path, prefix, options)
+	if err != nil {
+		return nil, err
+	}
+	server = &Server{Server: fuseutil.NewFileSystemServer(opTimeoutFS{fs}), fs: fs}
 	return
 }
 
+// refresh rebuilds the inode tree and marks all inodes of the previous tree, except the root, as stale. New inodes are
+// always allocated with fresh IDs, so stale inodes can't be mistaken for ones in the new tree, and inodes with IDs
+// lower than the first one of the new tree are stale without remembering each of them.
+func (fs *passFS) refresh() error {
+	err := fs.resolveStore()
+	if err != nil {
+		return fmt.Errorf("error rebuilding tree: %s", err)
+	}
+	rootNode, err := fs.getPassTree()
+	if err != nil {
+		return fmt.Errorf("error rebuilding tree: %s", err)
+	}
+	fs.mutex.RLock()
+	treeStart := fs.allocatableInode
+	fs.mutex.RUnlock()
+	inodes := fs.buildInodes(rootNode)
+	err = fs.checkCollisions(inodes)
+	if err != nil {
+		return err
+	}
+	var envNames map[string]fuseops.InodeID
+	if fs.options.EnvNames {
+		envNames = buildEnvNames(inodes)
+	}
+
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	// Inodes of the previous tree allocated while building the new one, e.g. field files, have higher IDs.
+	fs.staleInodes = make(map[fuseops.InodeID]bool)
+	for id := range fs.inodes {
+		if id >= treeStart {
+			fs.staleInodes[id] = true
+		}
+	}
+	fs.countStaleInodes(len(fs.inodes) - 1)
+	fs.treeStart = treeStart
+	fs.inodes = inodes
+	fs.envNames = envNames
+	fs.sizeMap = make(map[fuseops.InodeID]pass.SecretSize)
+	fs.sizeLookups = make(map[fuseops.InodeID]*sizeLookup)
+	fs.firstLineReads = make(map[fuseops.InodeID]time.Time)
+	fs.secretErrors = make(map[string]secretFailure)
+	fs.countInodes()
+	fs.clearCachedSizes()
+	return nil
+}
+
+func (fs *passFS) reload(options PassFsOptions) error {
+	err := options.validate()
+	if err != nil {
+		return err
+	}
+	// The persisted sizes are kept rather than read again, as sizes recorded since might not have been written yet.
+	fs.mutex.RLock()
+	previousCache := fs.sizeCache
+	fs.mutex.RUnlock()
+	var cache *sizeCache
+	if options.PersistSizeCache && previousCache != nil {
+		cache = previousCache
+	} else if options.PersistSizeCache {
+		cache, err = loadSizeCache(getSizeCachePath())
+		if err != nil {
+			return err
+		}
+	}
+	allowed, err := loadAllowlist(options.AllowReadFile)
+	if err != nil {
+		return err
+	}
+	dirFileTypes, _ := parseDirFiles(options.DirFiles)
+	err = fs.setOverlay(options)
+	if err != nil {
+		return err
+	}
+	warnTarExport(fs.getOptions(), options)
+
+	fs.mutex.Lock()
+	fs.options = options
+	fs.sizeCache = cache
+	fs.allowlist = allowed
+	fs.dirFileTypes = dirFileTypes
+	fs.fieldMatches = make(map[string]fieldMatch)
+	fs.secretTags = make(map[string]secretTags)
+	fs.secretMonths = make(map[string]secretMonth)
+	fs.firstLines = make(map[string]firstLine)
+	fs.mutex.Unlock()
+	if previousCache != nil && cache == nil {
+		fs.flushSizeCache(previousCache)
+	}
+	return fs.refresh()
+}
+
+// flushSizeCache writes the sizes recorded in a size cache which haven't been written yet.
+func (fs *passFS) flushSizeCache(cache *sizeCache) {
+	err := cache.flush()
+	if err != nil {
+		log.Printf("Error persisting sizes: %s", err)
+	}
+}
+
+// Destroy writes the sizes which haven't been written yet when the filesystem is unmounted.
+func (fs *passFS) Destroy() {
+	fs.mutex.RLock()
+	cache := fs.sizeCache
+	fs.mutex.RUnlock()
+	if cache != nil {
+		fs.flushSizeCache(cache)
+	}
+}
+
+// getOptions returns the options, which reloading replaces while operations are running.
+func (fs *passFS) getOptions() PassFsOptions {
+	fs.mutex.RLock()
+	defer fs.mutex.RUnlock()
+	return fs.options
+}
+
+// missingInodeError returns the error for an inode which isn't in the current tree, ESTALE if it was removed by a
+// refresh so that applications know to look it up again.
+func (fs *passFS) missingInodeError(id fuseops.InodeID) error {
+	fs.mutex.RLock()
+	defer fs.mutex.RUnlock()
+	if fs.isStale(id) {
+		return syscall.ESTALE
+	}
+	return fuse.ENOENT
+}
+
+// isStale returns whether an inode was removed by refreshing the tree. The mutex must be held.
+func (fs *passFS) isStale(id fuseops.InodeID) bool {
+	return (id != fuseops.RootInodeID && id < fs.treeStart) || fs.staleInodes[id]
+}
+
 type passFS struct {
 	fuseutil.NotImplementedFileSystem
 	user             uint32
 	group            uint32
 	inodes           map[fuseops.InodeID]inodeInfo
 	node             pass.Node
-	mutex            sync.Mutex
+	mutex            sync.RWMutex
 	allocatableInode fuseops.InodeID
-	sizeMap map[fuseops.InodeID]pass.SecretSize
-	options PassFsOptions
+	sizeMap          map[fuseops.InodeID]pass.SecretSize
+	// Size lookups in flight, keyed by inode
+	sizeLookups map[fuseops.InodeID]*sizeLookup
+	options     PassFsOptions
+	// Time of the first read of one shot first line files
+	firstLineReads map[fuseops.InodeID]time.Time
+	storePath      string
+	prefix         string
+	// Path the store path resolved to when the tree was last built, for local stores
+	storeTarget string
+	// Open overlay directory and the path its entries are read from, nil and empty unless enabled
+	overlayFile *os.File
+	overlayRoot string
+	// Sizes persisted across mounts, nil unless enabled
+	sizeCache *sizeCache
+	// Secrets which may be decrypted for reading, nil unless enabled
+	allowlist allowlist
+	// File types of the secrets in directories overriding the enabled ones, keyed by directory path
+	dirFileTypes map[string][]pass.NodeType
+	// First inode ID allocated for the current tree, lower IDs which aren't in the tree were removed by refreshing it
+	treeStart fuseops.InodeID
+	// Inodes of the previous tree with IDs from treeStart on, which were allocated while refreshing the tree
+	staleInodes map[fuseops.InodeID]bool
+	// Secret streams of open file handles
+	streams map[fuseops.HandleID]*pass.SecretStream
+	// Tar exports of open file handles of the tar export control file
+	tarExports map[fuseops.HandleID]*tarExport
+	// Content of rendered files of open file handles, rendered by their first read
+	renderedFiles map[fuseops.HandleID][]byte
+	nextHandle    fuseops.HandleID
+	// Context of all commands for reading secrets, cancelled when unmounting
+	ctx    context.Context
+	cancel context.CancelFunc
+	// Time the filesystem was created, shortly before mounting
+	startTime time.Time
+	// Inodes of the environment variable style names of secrets, nil unless enabled
+	envNames map[string]fuseops.InodeID
+	// Whether secrets matched the field filter, keyed by secret
+	fieldMatches map[string]fieldMatch
+	// Tags of secrets, keyed by secret
+	secretTags map[string]secretTags
+	// Months of the date field of secrets, keyed by secret
+	secretMonths map[string]secretMonth
+	// First lines of secrets for the all.env control file, keyed by secret
+	firstLines map[string]firstLine
+	// Time of the last desktop notification
+	lastNotification time.Time
+	// Target of the current symlink in the control directory, empty if no secret is selected
+	currentTarget string
+	// Description of the last failure of getting a secret, for the last-error control file
+	lastError string
+	// Query written to the search control file
+	searchQuery string
+	// Failures of getting secrets since mounting or refreshing, keyed by secret, for the errors control file
+	secretErrors map[string]secretFailure
+	// Counters for debugging
+	counters fsCounters
 }
 
 type inodeInfo struct {
@@ -183,6 +835,30 @@ type inodeInfo struct {
 	secret string
 
 	inodeType pass.NodeType
+
+	// For field directories, whether the field files have been created, and for field files, the field.
+	fieldsLoaded bool
+	field        string
+
+	// For rendered templates, the path of the template file. The secret is the one it's rendered with.
+	template string
+
+	// For entries of the overlay, their path relative to the overlay directory.
+	overlayPath string
+
+	// Whether this is the control directory or a symlink, and the name of control files.
+	control     bool
+	symlink     bool
+	controlFile string
+
+	// For symlinks in tag directories, the target. The current symlink resolves its target when read.
+	target string
+
+	// For the all.env control file, the secrets it renders.
+	secrets []string
+
+	// For directories, the number of secrets under them, recursively.
+	secretCount int
 }
 
 func findChildInode(
@@ -204,30 +880,260 @@ func getDesiredSize(nodeType pass.NodeType, size pass.SecretSize) (secretSize ui
 	case pass.Contents:
 		secretSize = size.ContentsSize
 	case pass.FirstLine:
-		secretSize = size.FirstLineSize
+		secretSize = size.GetFirstLineSize()
+	case pass.Framed:
+		secretSize = pass.FramePrefixSize + size.ContentsSize
+	case pass.Field, pass.Toml, pass.Ini, pass.QR, pass.Template, pass.History:
+		// Rendered files have the size of what they render to.
+		secretSize = size.ContentsSize
 	}
 	return
 }
 
-func (fs *passFS) getSize(id fuseops.InodeID) (secretSize uint64, err error) {
-	fs.mutex.Lock()
-	defer fs.mutex.Unlock()
+// lookUpInodeSize determines the size of the file of an inode, rendering it if it's rendered rather than streamed.
+func (fs *passFS) lookUpInodeSize(cache *sizeCache, inode inodeInfo) (pass.SecretSize, error) {
+	content, rendered, err := fs.renderFile(inode)
+	if rendered {
+		return pass.SecretSize{ContentsSize: uint64(len(content))}, err
+	}
+	return fs.lookUpSize(cache, inode.secret)
+}
 
+// lookUpSize determines the size of a secret, consulting the persisted size cache before decrypting if it's enabled.
+// The cache is passed in, as it's replaced by reloading while sizes are looked up.
+func (fs *passFS) lookUpSize(cache *sizeCache, secret string) (size pass.SecretSize, err error) {
+	if cache == nil {
+		return pass.GetSecretSize(fs.ctx, secret)
+	}
+
+	hash, err := hashSecretFile(path.Join(fs.storePath, secret))
+	if err != nil {
+		return
+	}
+	size, found := cache.get(secret, hash)
+	if found {
+		return
+	}
+
+	size, err = pass.GetSecretSize(fs.ctx, secret)
+	if err != nil {
+		return
+	}
+	cache.put(secret, hash, size)
+	return
+}
+
+// renderFile returns the content of files which are rendered as a whole rather than streamed from the show command,
+// and whether the file is rendered.
+func (fs *passFS) renderFile(inode inodeInfo) (content []byte, rendered bool, err error) {
+	if inode.controlFile != "" {
+		content, err := fs.renderControlFile(inode)
+		return content, true, err
+	}
+	switch inode.inodeType {
+	case pass.History:
+		history, err := pass.GetSecretHistory(fs.ctx, fs.storePath, inode.secret)
+		return []byte(history), true, err
+	case pass.Field:
+		value, err := getFieldValue(fs.ctx, inode.secret, inode.field)
+		return []byte(value), true, err
+	case pass.Raw:
+		content, err := ioutil.ReadFile(path.Join(fs.storePath, inode.secret))
+		return content, true, err
+	case pass.Toml:
+		content, err := renderToml(fs.ctx, inode.secret, fs.getOptions().IncludePassword)
+		return content, true, err
+	case pass.Ini:
+		content, err := renderIni(fs.ctx, inode.secret, fs.getOptions().IncludePassword)
+		return content, true, err
+	case pass.QR:
+		content, err := renderQr(fs.ctx, inode.secret, fs.getOptions().QrField)
+		return content, true, err
+	case pass.Age:
+		mtime, err := pass.GetSecretMtime(fs.ctx, fs.storePath, inode.secret)
+		return []byte(formatAge(time.Since(mtime)) + "\n"), true, err
+	case pass.Template:
+		content, err := renderTemplate(fs.ctx, fs.storePath, inode)
+		return content, true, err
+	case pass.Overlay:
+		content, err := fs.readOverlayFile(inode)
+		return content, true, err
+	}
+	return nil, false, nil
+}
+
+// hidesSize returns whether the size of a file showing a password is reported as 0, so that listings don't reveal the
+// length of passwords.
+func (options PassFsOptions) hidesSize(inode inodeInfo) bool {
+	if !options.HideSizes || inode.controlFile != "" || inode.dir {
+		return false
+	}
+	return inode.inodeType == pass.FirstLine || inode.inodeType == pass.Field && inode.field == pass.PasswordField
+}
+
+func (fs *passFS) getSize(id fuseops.InodeID) (secretSize uint64, err error) {
+	fs.mutex.RLock()
 	inode, found := fs.inodes[id]
+	fs.mutex.RUnlock()
 	if !found {
 		return secretSize, fmt.Errorf("cannot find inode for %d", id)
 	}
-	size, exists := fs.sizeMap[id]
-	if !exists {
-		size, err = pass.GetSecretSize(inode.secret)
+	if inode.inodeType == pass.Overlay {
+		return fs.getOverlaySize(inode)
+	}
+	if inode.inodeType == pass.Raw {
+		info, err := os.Stat(path.Join(fs.storePath, inode.secret))
 		if err != nil {
-			return secretSize, fmt.Errorf("error determining size for secret %s: %s", inode.secret, err)
+			return secretSize, err
 		}
-		fs.sizeMap[id] = size
+		return uint64(info.Size()), nil
+	}
+	// Secrets which may not be decrypted are empty rather than decrypted for their size, and the size of the tar export
+	// is only known after decrypting all secrets.
+	options := fs.getOptions()
+	if !fs.readAllowed(inode) || inode.controlFile == tarExportName || options.hidesSize(inode) {
+		return 0, nil
+	}
+	retries := options.StoreRetries
+	// Rendering files may take the mutex, e.g. for caching what was decrypted for rendering them. Control files and
+	// ages change without the store changing, so their sizes aren't cached.
+	if inode.controlFile != "" || inode.inodeType == pass.Age {
+		var content []byte
+		err = fs.retryTransient(retries, inode.secret, func() (err error) {
+			content, _, err = fs.renderFile(inode)
+			return
+		})
+		return uint64(len(content)), err
 	}
-	secretSize = getDesiredSize(inode.inodeType, size)
 
-	return
+	// The mutex is only held for the size map, not for decrypting the secret, which might wait for a passphrase.
+	fs.mutex.Lock()
+	size, exists := fs.sizeMap[id]
+	hit := exists && !options.NoSizeCache
+	var lookup *sizeLookup
+	var inFlight bool
+	if !hit {
+		lookup, inFlight = fs.sizeLookups[id]
+		if !inFlight {
+			lookup = &sizeLookup{done: make(chan struct{})}
+			fs.sizeLookups[id] = lookup
+		}
+	}
+	cache := fs.sizeCache
+	fs.mutex.Unlock()
+	fs.countSizeLookup(hit)
+	if hit {
+		return getDesiredSize(inode.inodeType, size), nil
+	}
+
+	if inFlight {
+		<-lookup.done
+	} else {
+		lookup.err = fs.retryTransient(retries, inode.secret, func() (err error) {
+			lookup.size, err = fs.lookUpInodeSize(cache, inode)
+			return
+		})
+		// Lookups are forgotten along with the sizes, a size looked up before they were cleared isn't stored.
+		fs.mutex.Lock()
+		current := fs.sizeLookups[id] == lookup
+		if current {
+			delete(fs.sizeLookups, id)
+		}
+		store := current && lookup.err == nil && !options.NoSizeCache
+		if store {
+			fs.sizeMap[id] = lookup.size
+		}
+		fs.mutex.Unlock()
+		if store {
+			fs.countCachedSize(inode.secret)
+		}
+		close(lookup.done)
+	}
+	if lookup.err != nil {
+		return secretSize, fmt.Errorf("error determining size for secret %s: %w", inode.secret, lookup.err)
+	}
+	return getDesiredSize(inode.inodeType, lookup.size), nil
+}
+
+// sizeLookup is a lookup of the size of an inode in flight, which concurrent lookups of the same inode wait for rather
+// than decrypting the secret again.
+type sizeLookup struct {
+	done chan struct{}
+	size pass.SecretSize
+	err  error
+}
+
+// attributesExpiration returns until when the kernel may cache attributes, which is an hour unless caching attributes
+// is disabled.
+func (fs *passFS) attributesExpiration() time.Time {
+	if fs.getOptions().NoAttrCache {
+		return time.Now()
+	}
+	return time.Now().Add(time.Hour)
+}
+
+// entryExpiration returns until when the kernel may cache the attributes of an inode, which is shorter for age files
+// and control files as their size changes over time.
+func (fs *passFS) entryExpiration(inode inodeInfo) time.Time {
+	expiration := fs.attributesExpiration()
+	changing := inode.inodeType == pass.Age || inode.inodeType == pass.Overlay || inode.controlFile != ""
+	if changing && expiration.After(time.Now().Add(shortAttributesExpiration)) {
+		return time.Now().Add(shortAttributesExpiration)
+	}
+	return expiration
+}
+
+// formatAge formats the age of a secret with the days counted separately, e.g. 93d4h5m3s, as the hours alone get hard
+// to read for old secrets.
+func formatAge(age time.Duration) string {
+	age = age.Round(time.Second)
+	days := age / (24 * time.Hour)
+	if days == 0 {
+		return age.String()
+	}
+	return fmt.Sprintf("%dd%s", days, age-days*24*time.Hour)
+}
+
+// secretError maps errors from getting a secret to the errors reported to the kernel, recording failures for the
+// last-error and errors control files. The secret is empty if the failure can't be attributed to a single secret.
+func (fs *passFS) secretError(secret string, err error) error {
+	err = fs.storeError(err)
+	errno := fs.classifyError(err)
+	if errno != nil {
+		fs.recordError(secret, err, errno)
+	}
+	return errno
+}
+
+func (fs *passFS) classifyError(err error) error {
+	if errors.Is(err, pass.ErrSecretTooLarge) {
+		return syscall.EFBIG
+	}
+	if errors.Is(err, pass.ErrAgentLocked) {
+		log.Print(err)
+		fs.notifyAgentLocked()
+		return syscall.EACCES
+	}
+	if errors.Is(err, pass.ErrCardMissing) {
+		log.Print(err)
+		return syscall.ENXIO
+	}
+	if errors.Is(err, pass.ErrStoreUnavailable) {
+		log.Print(err)
+		return syscall.EIO
+	}
+	if errors.Is(err, context.Canceled) {
+		return syscall.EINTR
+	}
+	if errors.Is(err, errTemplate) {
+		log.Print(err)
+		return syscall.EIO
+	}
+	if isTransient(err) {
+		log.Print(err)
+		return syscall.EIO
+	}
+	return err
 }
 
 func (fs *passFS) patchAttributes(
@@ -263,29 +1169,46 @@ func getMode(node pass.Node) os.FileMode {
 func (fs *passFS) LookUpInode(
 	ctx context.Context,
 	op *fuseops.LookUpInodeOp) (err error) {
+	err = fs.loadFields(op.Parent)
+	if err != nil {
+		return fs.secretError(fs.inodeSecret(op.Parent), err)
+	}
+
 	// Find the info for the parent.
-	parentInfo, ok := fs.inodes[op.Parent]
-	if !ok {
-		err = fuse.ENOENT
+	parentInfo, err := fs.getInode(op.Parent)
+	if err != nil {
 		return
 	}
 
-	// Find the child within the parent.
+	// Find the child within the parent, or the secret an environment variable style name at the root refers to.
 	childInode, err := findChildInode(op.Name, parentInfo.children)
+	if err != nil && op.Parent == fuseops.RootInodeID && fs.getOptions().EnvNames {
+		var found bool
+		childInode, found = fs.lookUpEnvName(op.Name)
+		if found {
+			err = nil
+		}
+	}
 	if err != nil {
 		return
 	}
 
 	// Copy over information.
 	op.Entry.Child = childInode
-	op.Entry.Attributes = fs.inodes[childInode].attributes
-	secretSize, err := fs.getSize(childInode)
+	childInfo, err := fs.getInode(childInode)
 	if err != nil {
-		return err
+		return
 	}
-
-	op.Entry.Attributes.Size = uint64(secretSize)
-	op.Entry.AttributesExpiration = time.Now().Add(time.Hour)
+	op.Entry.Attributes = childInfo.attributes
+	// Directories and symlinks don't have secrets to determine the size from.
+	if !childInfo.dir && !childInfo.symlink {
+		secretSize, err := fs.getSize(childInode)
+		if err != nil {
+			return fs.secretError(childInfo.secret, err)
+		}
+		op.Entry.Attributes.Size = secretSize
+	}
+	op.Entry.AttributesExpiration = fs.entryExpiration(*childInfo)
 
 	// Patch attributes.
 	fs.patchAttributes(&op.Entry.Attributes)
@@ -297,18 +1220,21 @@ func (fs *passFS) GetInodeAttributes(
 	ctx context.Context,
 	op *fuseops.GetInodeAttributesOp) (err error) {
 	// Find the info for this inode.
-	info, ok := fs.inodes[op.Inode]
-	if !ok {
-		err = fuse.ENOENT
+	info, err := fs.getInode(op.Inode)
+	if err != nil {
 		return
 	}
 
 	// Copy over its attributes.
 	op.Attributes = info.attributes
-	op.AttributesExpiration = time.Now().Add(time.Hour)
+	op.AttributesExpiration = fs.entryExpiration(*info)
 
 	// Patch attributes.
 	fs.patchAttributes(&op.Attributes)
+	// The change time of the root is the start time of the mount, for telling how long it has been up.
+	if op.Inode == fuseops.RootInodeID && fs.getOptions().ShowControl {
+		op.Attributes.Ctime = fs.startTime
+	}
 
 	return
 }
@@ -320,13 +1246,28 @@ func (fs *passFS) OpenDir(
 	return
 }
 
+// checkDirent returns an error if a directory entry can't be listed, e.g. because its inode failed to be created.
+func (fs *passFS) checkDirent(e fuseutil.Dirent) error {
+	fs.mutex.RLock()
+	_, found := fs.inodes[e.Inode]
+	fs.mutex.RUnlock()
+	if !found {
+		return fmt.Errorf("cannot find inode %d", e.Inode)
+	}
+	return nil
+}
+
 func (fs *passFS) ReadDir(
 	ctx context.Context,
 	op *fuseops.ReadDirOp) (err error) {
+	err = fs.loadFields(op.Inode)
+	if err != nil {
+		return fs.secretError(fs.inodeSecret(op.Inode), err)
+	}
+
 	// Find the info for this inode.
-	info, ok := fs.inodes[op.Inode]
-	if !ok {
-		err = fuse.ENOENT
+	info, err := fs.getInode(op.Inode)
+	if err != nil {
 		return
 	}
 
@@ -337,7 +1278,8 @@ func (fs *passFS) ReadDir(
 
 	entries := info.children
 
-	// Grab the range of interest.
+	// Grab the range of interest. An offset right after the last entry is the end of the directory, which results in
+	// no entries rather than an error.
 	if op.Offset > fuseops.DirOffset(len(entries)) {
 		err = fuse.EIO
 		return
@@ -350,6 +1292,12 @@ func (fs *passFS) ReadDir(
 		if e.Offset == 0 {
 			continue
 		}
+		// Skip entries which can't be listed rather than failing the listing of all of their siblings.
+		err := fs.checkDirent(e)
+		if err != nil {
+			log.Printf("Skipping entry %s of %s: %s", e.Name, info.secret, err)
+			continue
+		}
 		n := fuseutil.WriteDirent(op.Dst[op.BytesRead:], e)
 		if n == 0 {
 			break
@@ -364,42 +1312,208 @@ func (fs *passFS) ReadDir(
 func (fs *passFS) OpenFile(
 	ctx context.Context,
 	op *fuseops.OpenFileOp) (err error) {
-	// Allow opening any file.
+	// Allow opening any file, each handle streams the secret from its first read on.
+	inode, err := fs.getInode(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	defer fs.countInodes()
+	if fs.options.MaxOpenFiles > 0 && fs.openHandles() >= fs.options.MaxOpenFiles {
+		log.Printf("Refusing to open %s, the maximum of %d open files has been reached", inode.secret,
+			fs.options.MaxOpenFiles)
+		return syscall.EMFILE
+	}
+	op.Handle = fs.nextHandle
+	fs.nextHandle++
+	if inode.controlFile == tarExportName {
+		// The size of the archive isn't known before writing it, so reads go past the size of the file.
+		op.UseDirectIO = true
+		fs.tarExports[op.Handle] = newTarExport(fs, inode.secrets)
+		return
+	}
+	if inode.controlFile == searchName || fs.options.hidesSize(*inode) {
+		// Writing a query changes the results, and hidden sizes are 0, so reads aren't limited to the size of the file
+		// at lookup.
+		op.UseDirectIO = true
+	}
+	fs.streams[op.Handle] = pass.NewSecretStream(fs.ctx, inode.secret, inode.inodeType)
 	return
 }
 
+// openHandles returns the number of open file handles. The mutex must be held.
+func (fs *passFS) openHandles() int {
+	return len(fs.streams) + len(fs.tarExports)
+}
+
+func (fs *passFS) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) (err error) {
+	fs.mutex.Lock()
+	stream, found := fs.streams[op.Handle]
+	delete(fs.streams, op.Handle)
+	export, exporting := fs.tarExports[op.Handle]
+	delete(fs.tarExports, op.Handle)
+	delete(fs.renderedFiles, op.Handle)
+	fs.countInodes()
+	fs.mutex.Unlock()
+
+	if found {
+		stream.Close()
+	}
+	if exporting {
+		export.Close()
+	}
+	return
+}
+
+// getRenderedFile returns the content a file was rendered to by an earlier read of an open file handle.
+func (fs *passFS) getRenderedFile(handle fuseops.HandleID) ([]byte, bool) {
+	fs.mutex.RLock()
+	defer fs.mutex.RUnlock()
+	content, found := fs.renderedFiles[handle]
+	return content, found
+}
+
+// setRenderedFile keeps the content a file was rendered to for later reads of an open file handle, like streams keep
+// what a secret decrypted to, so that reading a rendered file in chunks renders it once.
+func (fs *passFS) setRenderedFile(handle fuseops.HandleID, content []byte) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	if _, open := fs.streams[handle]; open {
+		fs.renderedFiles[handle] = content
+	}
+}
+
+func (fs *passFS) getStream(handle fuseops.HandleID) (*pass.SecretStream, bool) {
+	fs.mutex.RLock()
+	defer fs.mutex.RUnlock()
+	stream, found := fs.streams[handle]
+	return stream, found
+}
+
+// consumeFirstLine records a read of a one shot first line file and returns true if the file has already been read
+// within the one shot window. Only reads starting at the beginning of the file count, so that the first reader can
+// continue reading at later offsets.
+func (fs *passFS) consumeFirstLine(id fuseops.InodeID, offset int64) bool {
+	if offset != 0 {
+		return false
+	}
+
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	now := time.Now()
+	readAt, read := fs.firstLineReads[id]
+	if read && now.Sub(readAt) < fs.options.OneShotWindow {
+		return true
+	}
+	fs.firstLineReads[id] = now
+	return false
+}
+
 func (fs *passFS) ReadFile(ctx context.Context, op *fuseops.ReadFileOp) (err error) {
 	inode, err := fs.getInode(op.Inode)
 	if err != nil {
 		return err
 	}
-
-	secretContent, err := pass.GetSecret(inode.secret)
-	if err != nil {
-		return err
+	if !fs.readAllowed(*inode) {
+		return denyRead(inode.secret)
 	}
 
-	if inode.inodeType == pass.FirstLine {
-		secretContent, err = pass.GetFirstLine(secretContent)
-		err = fmt.Errorf("cannot determine first line from secret: %s: %s", inode.secret, err)
+	if fs.getOptions().OneShotFirstLine && inode.inodeType == pass.FirstLine && fs.consumeFirstLine(op.Inode, op.Offset) {
+		return
+	}
+	if inode.controlFile == tarExportName {
+		return fs.readTarExport(*inode, op)
 	}
 
-	// Let io.ReaderAt deal with the semantics.
-	reader := strings.NewReader(secretContent)
-	op.BytesRead, err = reader.ReadAt(op.Dst, op.Offset)
+	fs.trackRead(1)
+	defer fs.trackRead(-1)
+	defer func() {
+		fs.countRead(err)
+	}()
 
-	// Special case: FUSE doesn't expect us to return io.EOF.
-	if err == io.EOF {
-		err = nil
+	retries := fs.getOptions().StoreRetries
+	content, rendered := fs.getRenderedFile(op.Handle)
+	if !rendered {
+		err = fs.retryTransient(retries, inode.secret, func() (err error) {
+			content, rendered, err = fs.renderFile(*inode)
+			return
+		})
+		if err != nil {
+			return fs.secretError(inode.secret, err)
+		}
+		// Control files are rendered for every read, e.g. for reading the results of a query written to the search
+		// file meanwhile.
+		if rendered && inode.controlFile == "" {
+			fs.setRenderedFile(op.Handle, content)
+		}
+	}
+	if rendered {
+		op.BytesRead, err = bytes.NewReader(content).ReadAt(op.Dst, op.Offset)
+		if err == io.EOF {
+			err = nil
+		}
+		return
 	}
 
-	return
+	stream, found := fs.getStream(op.Handle)
+	if !found {
+		stream = pass.NewSecretStream(fs.ctx, inode.secret, inode.inodeType)
+		defer stream.Close()
+	}
+
+	err = fs.retryTransient(retries, inode.secret, func() (err error) {
+		// The stream has io.ReaderAt semantics, including empty secrets where it returns io.EOF right away.
+		op.BytesRead, err = stream.ReadAt(op.Dst, op.Offset)
+		// Special case: FUSE doesn't expect us to return io.EOF.
+		if err == io.EOF {
+			err = nil
+		}
+		// Closing the stream makes the next read show the secret again, skipping to the offset.
+		if isTransient(err) {
+			stream.Close()
+		}
+		return
+	})
+
+	return fs.secretError(inode.secret, err)
+}
+
+// inodeSecret returns the secret of an inode, empty if it's not in the current tree.
+func (fs *passFS) inodeSecret(id fuseops.InodeID) string {
+	fs.mutex.RLock()
+	defer fs.mutex.RUnlock()
+	return fs.inodes[id].secret
 }
 
+// getInode returns a copy of the info of an inode. Rebuilding the tree replaces the inode map rather than changing the
+// infos in it, and the children of an info are replaced rather than changed, so the copy can be used without holding
+// the mutex.
 func (fs *passFS) getInode(id fuseops.InodeID) (*inodeInfo, error) {
+	fs.mutex.RLock()
 	inode, ok := fs.inodes[id]
+	fs.mutex.RUnlock()
 	if !ok {
-		return nil, fmt.Errorf("inode %d not found", id)
+		return nil, fs.missingInodeError(id)
 	}
 	return &inode, nil
 }
+
+// FindNameCollisions returns the paths of entries which would have the same name as another entry in the same
+// directory when mounting with the given options, e.g. for a secret foo and a directory foo.contents next to it. The
+// collisions are found before applying the name collision policy, which would resolve them.
+func FindNameCollisions(path, prefix string, options PassFsOptions) ([]string, error) {
+	options.Probe = false
+	options.NameCollisions = ""
+	fs, err := newPassFS(path, prefix, options)
+	if err != nil {
+		return nil, err
+	}
+	fs.mutex.RLock()
+	defer fs.mutex.RUnlock()
+	return findCollisions(fs.inodes, prefix), nil
+}
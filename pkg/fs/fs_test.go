@@ -0,0 +1,2523 @@
+package fs
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/femnad/passfuse/pkg/pass"
+	"github.com/jacobsa/fuse/fuseops"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func makeStore(t *testing.T, files ...string) string {
+	t.Helper()
+	storePath, err := ioutil.TempDir("", "passfuse-test")
+	if err != nil {
+		t.Fatalf("Error creating store: %s", err)
+	}
+	for _, file := range files {
+		filePath := path.Join(storePath, file)
+		err = os.MkdirAll(path.Dir(filePath), 0700)
+		if err != nil {
+			t.Fatalf("Error creating directory for %s: %s", file, err)
+		}
+		err = ioutil.WriteFile(filePath, []byte{}, 0600)
+		if err != nil {
+			t.Fatalf("Error creating file %s: %s", file, err)
+		}
+	}
+	return storePath
+}
+
+// setSecrets makes pass return the given secret bodies, keyed by secret name without the .gpg suffix.
+func setSecrets(secrets map[string]string) {
+	pass.SetCommandRunner(func(name string, args ...string) (io.ReadCloser, error) {
+		secretName := args[len(args)-1]
+		body, found := secrets[secretName]
+		if !found {
+			return nil, syscall.ENOENT
+		}
+		return ioutil.NopCloser(strings.NewReader(body)), nil
+	})
+}
+
+func lookUp(t *testing.T, fs *passFS, parent fuseops.InodeID, name string) fuseops.InodeID {
+	t.Helper()
+	op := fuseops.LookUpInodeOp{Parent: parent, Name: name}
+	err := fs.LookUpInode(context.Background(), &op)
+	if err != nil {
+		t.Fatalf("Error looking up %s: %s", name, err)
+	}
+	return op.Entry.Child
+}
+
+func readFile(fs *passFS, inode fuseops.InodeID) (string, error) {
+	op := fuseops.ReadFileOp{Inode: inode, Dst: make([]byte, 4096)}
+	err := fs.ReadFile(context.Background(), &op)
+	return string(op.Dst[:op.BytesRead]), err
+}
+
+func TestReadAfterRefreshIsStale(t *testing.T) {
+	storePath := makeStore(t, "foo.gpg")
+	defer os.RemoveAll(storePath)
+	setSecrets(map[string]string{"foo": "hunter2\n"})
+
+	fs, err := newPassFS(storePath, "", PassFsOptions{ContentFiles: true})
+	if err != nil {
+		t.Fatalf("Error creating filesystem: %s", err)
+	}
+	inode := lookUp(t, fs, fuseops.RootInodeID, "foo.contents")
+
+	err = fs.refresh()
+	if err != nil {
+		t.Fatalf("Error refreshing filesystem: %s", err)
+	}
+	_, err = readFile(fs, inode)
+	if err != syscall.ESTALE {
+		t.Errorf("Expected ESTALE reading a refreshed inode, got %v", err)
+	}
+	// Inodes stay stale across refreshes without being remembered one by one.
+	err = fs.refresh()
+	if err != nil {
+		t.Fatalf("Error refreshing filesystem: %s", err)
+	}
+	_, err = readFile(fs, inode)
+	if err != syscall.ESTALE {
+		t.Errorf("Expected ESTALE reading an inode removed two refreshes ago, got %v", err)
+	}
+	if len(fs.staleInodes) != 0 {
+		t.Errorf("Expected no stale inodes to be remembered, got %d", len(fs.staleInodes))
+	}
+
+	inode = lookUp(t, fs, fuseops.RootInodeID, "foo.contents")
+	content, err := readFile(fs, inode)
+	if err != nil {
+		t.Fatalf("Error reading after lookup: %s", err)
+	}
+	if strings.TrimSpace(content) != "hunter2" {
+		t.Errorf("Unexpected content %q", content)
+	}
+}
+
+func TestProbe(t *testing.T) {
+	storePath := makeStore(t, "work/foo.gpg")
+	defer os.RemoveAll(storePath)
+
+	setSecrets(map[string]string{"work/foo": "hunter2\n"})
+	_, err := newPassFS(storePath, "", PassFsOptions{ContentFiles: true, Probe: true})
+	if err != nil {
+		t.Errorf("Expected probe to succeed, got %s", err)
+	}
+
+	setSecrets(map[string]string{})
+	_, err = newPassFS(storePath, "", PassFsOptions{ContentFiles: true, Probe: true})
+	if err == nil {
+		t.Errorf("Expected probe to fail when decryption fails")
+	}
+}
+
+// readDirNames parses the names of the entries returned by reading a directory from the given offset.
+func readDirNames(t *testing.T, fs *passFS, inode fuseops.InodeID, offset fuseops.DirOffset) []string {
+	t.Helper()
+	op := fuseops.ReadDirOp{Inode: inode, Offset: offset, Dst: make([]byte, 4096)}
+	err := fs.ReadDir(context.Background(), &op)
+	if err != nil {
+		t.Fatalf("Error reading directory: %s", err)
+	}
+
+	var names []string
+	buf := op.Dst[:op.BytesRead]
+	for len(buf) > 0 {
+		// Dirents consist of inode, offset, name length, type and padded name.
+		nameLength := int(binary.LittleEndian.Uint32(buf[16:20]))
+		names = append(names, string(buf[24:24+nameLength]))
+		entryLength := (24 + nameLength + 7) &^ 7
+		buf = buf[entryLength:]
+	}
+	return names
+}
+
+func TestEmptySecret(t *testing.T) {
+	storePath := makeStore(t, "empty.gpg")
+	defer os.RemoveAll(storePath)
+	setSecrets(map[string]string{"empty": ""})
+
+	fs, err := newPassFS(storePath, "", PassFsOptions{ContentFiles: true, FirstLineFiles: true})
+	if err != nil {
+		t.Fatalf("Error creating filesystem: %s", err)
+	}
+
+	names := readDirNames(t, fs, fuseops.RootInodeID, 0)
+	if strings.Join(names, " ") != "empty.contents empty.first-line" {
+		t.Errorf("Unexpected directory entries %v", names)
+	}
+
+	for _, name := range names {
+		op := fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID, Name: name}
+		err = fs.LookUpInode(context.Background(), &op)
+		if err != nil {
+			t.Fatalf("Error looking up %s: %s", name, err)
+		}
+		if op.Entry.Attributes.Size != 0 {
+			t.Errorf("Expected size 0 for %s, got %d", name, op.Entry.Attributes.Size)
+		}
+		content, err := readFile(fs, op.Entry.Child)
+		if err != nil {
+			t.Errorf("Error reading %s: %s", name, err)
+		}
+		if content != "" {
+			t.Errorf("Expected empty content for %s, got %q", name, content)
+		}
+	}
+}
+
+func TestMaxSecretSize(t *testing.T) {
+	storePath := makeStore(t, "large.gpg", "small.gpg")
+	defer os.RemoveAll(storePath)
+	setSecrets(map[string]string{"large": strings.Repeat("x", 1024), "small": "hunter2\n"})
+	pass.SetMaxSecretSize(512)
+	defer pass.SetMaxSecretSize(0)
+
+	fs, err := newPassFS(storePath, "", PassFsOptions{ContentFiles: true})
+	if err != nil {
+		t.Fatalf("Error creating filesystem: %s", err)
+	}
+
+	op := fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID, Name: "large.contents"}
+	err = fs.LookUpInode(context.Background(), &op)
+	if err != syscall.EFBIG {
+		t.Errorf("Expected EFBIG looking up a large secret, got %v", err)
+	}
+	_, err = readFile(fs, op.Entry.Child)
+	if err != syscall.EFBIG {
+		t.Errorf("Expected EFBIG reading a large secret, got %v", err)
+	}
+
+	inode := lookUp(t, fs, fuseops.RootInodeID, "small.contents")
+	_, err = readFile(fs, inode)
+	if err != nil {
+		t.Errorf("Error reading a small secret: %s", err)
+	}
+}
+
+func TestDirectoriesOnly(t *testing.T) {
+	storePath := makeStore(t, "foo.gpg", "work/bar.gpg", "work/ops/baz.gpg")
+	defer os.RemoveAll(storePath)
+
+	fs, err := newPassFS(storePath, "", PassFsOptions{ContentFiles: true, FirstLineFiles: true, DirectoriesOnly: true})
+	if err != nil {
+		t.Fatalf("Error creating filesystem: %s", err)
+	}
+
+	names := readDirNames(t, fs, fuseops.RootInodeID, 0)
+	if strings.Join(names, " ") != "work" {
+		t.Errorf("Expected only directories at the root, got %v", names)
+	}
+	work := lookUp(t, fs, fuseops.RootInodeID, "work")
+	names = readDirNames(t, fs, work, 0)
+	if strings.Join(names, " ") != "ops" {
+		t.Errorf("Expected only directories in work, got %v", names)
+	}
+}
+
+func TestHistoryFile(t *testing.T) {
+	storePath := makeStore(t, "foo.gpg")
+	defer os.RemoveAll(storePath)
+	history := "1600000000 Rotate foo\n1500000000 Add foo\n"
+	pass.SetCommandRunner(func(name string, args ...string) (io.ReadCloser, error) {
+		if name != "git" {
+			t.Fatalf("Expected reading history not to show the secret, ran %s", name)
+		}
+		return ioutil.NopCloser(strings.NewReader(history)), nil
+	})
+
+	fs, err := newPassFS(storePath, "", PassFsOptions{HistoryFiles: true})
+	if err != nil {
+		t.Fatalf("Error creating filesystem: %s", err)
+	}
+	op := fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID, Name: "foo.history"}
+	err = fs.LookUpInode(context.Background(), &op)
+	if err != nil {
+		t.Fatalf("Error looking up history file: %s", err)
+	}
+	if op.Entry.Attributes.Size != uint64(len(history)) {
+		t.Errorf("Expected size %d, got %d", len(history), op.Entry.Attributes.Size)
+	}
+	content, err := readFile(fs, op.Entry.Child)
+	if err != nil {
+		t.Fatalf("Error reading history file: %s", err)
+	}
+	if content != history {
+		t.Errorf("Unexpected history %q", content)
+	}
+}
+
+func TestReloadOptions(t *testing.T) {
+	storePath := makeStore(t, "foo.gpg")
+	defer os.RemoveAll(storePath)
+	setSecrets(map[string]string{"foo": "hunter2\n"})
+
+	fs, err := newPassFS(storePath, "", PassFsOptions{ContentFiles: true})
+	if err != nil {
+		t.Fatalf("Error creating filesystem: %s", err)
+	}
+	names := readDirNames(t, fs, fuseops.RootInodeID, 0)
+	if strings.Join(names, " ") != "foo.contents" {
+		t.Errorf("Unexpected entries before reloading %v", names)
+	}
+
+	err = fs.reload(PassFsOptions{ContentFiles: true, FirstLineFiles: true})
+	if err != nil {
+		t.Fatalf("Error reloading: %s", err)
+	}
+	names = readDirNames(t, fs, fuseops.RootInodeID, 0)
+	if strings.Join(names, " ") != "foo.contents foo.first-line" {
+		t.Errorf("Unexpected entries after reloading %v", names)
+	}
+}
+
+func TestFieldDirs(t *testing.T) {
+	storePath := makeStore(t, "work/github.gpg")
+	defer os.RemoveAll(storePath)
+	setSecrets(map[string]string{"work/github": "hunter2\nusername: foo\nurl:\n"})
+
+	fs, err := newPassFS(storePath, "", PassFsOptions{ContentFiles: true, FieldDirs: true})
+	if err != nil {
+		t.Fatalf("Error creating filesystem: %s", err)
+	}
+	work := lookUp(t, fs, fuseops.RootInodeID, "work")
+	names := readDirNames(t, fs, work, 0)
+	if strings.Join(names, " ") != "github" {
+		t.Errorf("Expected a directory for the secret, got %v", names)
+	}
+
+	github := lookUp(t, fs, work, "github")
+	names = readDirNames(t, fs, github, 0)
+	if strings.Join(names, " ") != "password username" {
+		t.Errorf("Expected files for non-empty fields, got %v", names)
+	}
+
+	for field, expected := range map[string]string{"password": "hunter2", "username": "foo"} {
+		op := fuseops.LookUpInodeOp{Parent: github, Name: field}
+		err = fs.LookUpInode(context.Background(), &op)
+		if err != nil {
+			t.Fatalf("Error looking up %s: %s", field, err)
+		}
+		if op.Entry.Attributes.Size != uint64(len(expected)) {
+			t.Errorf("Expected size %d for %s, got %d", len(expected), field, op.Entry.Attributes.Size)
+		}
+		content, err := readFile(fs, op.Entry.Child)
+		if err != nil {
+			t.Fatalf("Error reading %s: %s", field, err)
+		}
+		if content != expected {
+			t.Errorf("Expected %q for %s, got %q", expected, field, content)
+		}
+	}
+}
+
+func TestInterruptSlowRead(t *testing.T) {
+	storePath := makeStore(t, "slow.gpg")
+	defer os.RemoveAll(storePath)
+	setSecrets(map[string]string{"slow": "hunter2\n"})
+
+	fs, err := newPassFS(storePath, "", PassFsOptions{ContentFiles: true})
+	if err != nil {
+		t.Fatalf("Error creating filesystem: %s", err)
+	}
+	inode := lookUp(t, fs, fuseops.RootInodeID, "slow.contents")
+
+	// Simulate a show command blocked on decryption, which never writes its output.
+	started := make(chan struct{})
+	reader, writer := io.Pipe()
+	pass.SetCommandRunner(func(name string, args ...string) (io.ReadCloser, error) {
+		close(started)
+		return reader, nil
+	})
+	defer setSecrets(map[string]string{})
+
+	readErr := make(chan error)
+	go func() {
+		_, err := readFile(fs, inode)
+		readErr <- err
+	}()
+	<-started
+
+	server := Server{fs: fs}
+	server.Interrupt()
+	select {
+	case err = <-readErr:
+		if err != syscall.EINTR {
+			t.Errorf("Expected EINTR for an interrupted read, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Read wasn't interrupted")
+	}
+	_, err = writer.Write([]byte("hunter2\n"))
+	if err != io.ErrClosedPipe {
+		t.Errorf("Expected the show command to be stopped, got %v", err)
+	}
+
+	_, err = readFile(fs, inode)
+	if err != syscall.EINTR {
+		t.Errorf("Expected EINTR for reads after interrupting, got %v", err)
+	}
+}
+
+func TestReadDirSkipsBrokenEntries(t *testing.T) {
+	storePath := makeStore(t, "a.gpg", "b.gpg", "c.gpg")
+	defer os.RemoveAll(storePath)
+	setSecrets(map[string]string{})
+
+	fs, err := newPassFS(storePath, "", PassFsOptions{ContentFiles: true})
+	if err != nil {
+		t.Fatalf("Error creating filesystem: %s", err)
+	}
+	// Simulate an entry whose inode failed to be created.
+	for _, child := range fs.inodes[fuseops.RootInodeID].children {
+		if child.Name == "b.contents" {
+			delete(fs.inodes, child.Inode)
+		}
+	}
+
+	names := readDirNames(t, fs, fuseops.RootInodeID, 0)
+	if strings.Join(names, " ") != "a.contents c.contents" {
+		t.Errorf("Expected the siblings of the broken entry to be listed, got %v", names)
+	}
+}
+
+func TestNoDecrypt(t *testing.T) {
+	storePath := makeStore(t, "work/github.gpg")
+	defer os.RemoveAll(storePath)
+	encrypted := "-----BEGIN PGP MESSAGE-----\n"
+	err := ioutil.WriteFile(path.Join(storePath, "work/github.gpg"), []byte(encrypted), 0600)
+	if err != nil {
+		t.Fatalf("Error writing secret: %s", err)
+	}
+	pass.SetCommandRunner(func(name string, args ...string) (io.ReadCloser, error) {
+		t.Errorf("Unexpected command %s %v", name, args)
+		return nil, syscall.ENOENT
+	})
+	defer setSecrets(map[string]string{})
+
+	fs, err := newPassFS(storePath, "", PassFsOptions{ContentFiles: true, FirstLineFiles: true, FieldDirs: true,
+		Probe: true, NoDecrypt: true})
+	if err != nil {
+		t.Fatalf("Error creating filesystem: %s", err)
+	}
+	work := lookUp(t, fs, fuseops.RootInodeID, "work")
+	names := readDirNames(t, fs, work, 0)
+	if strings.Join(names, " ") != "github.gpg" {
+		t.Errorf("Expected only the encrypted file, got %v", names)
+	}
+
+	op := fuseops.LookUpInodeOp{Parent: work, Name: "github.gpg"}
+	err = fs.LookUpInode(context.Background(), &op)
+	if err != nil {
+		t.Fatalf("Error looking up encrypted file: %s", err)
+	}
+	if op.Entry.Attributes.Size != uint64(len(encrypted)) {
+		t.Errorf("Expected size %d, got %d", len(encrypted), op.Entry.Attributes.Size)
+	}
+	content, err := readFile(fs, op.Entry.Child)
+	if err != nil {
+		t.Fatalf("Error reading encrypted file: %s", err)
+	}
+	if content != encrypted {
+		t.Errorf("Expected the encrypted content, got %q", content)
+	}
+}
+
+func TestCurrentSymlink(t *testing.T) {
+	storePath := makeStore(t, "work/github.gpg")
+	defer os.RemoveAll(storePath)
+	// Looking up the symlink mustn't decrypt anything.
+	setSecrets(map[string]string{})
+
+	fs, err := newPassFS(storePath, "", PassFsOptions{ContentFiles: true, EnableCurrent: true})
+	if err != nil {
+		t.Fatalf("Error creating filesystem: %s", err)
+	}
+	control := lookUp(t, fs, fuseops.RootInodeID, ".passfuse")
+	if len(readDirNames(t, fs, control, 0)) != 0 {
+		t.Errorf("Expected no current symlink before selecting a secret")
+	}
+
+	err = fs.CreateSymlink(context.Background(), &fuseops.CreateSymlinkOp{Parent: control, Name: "other",
+		Target: "work/github"})
+	if err != syscall.EPERM {
+		t.Errorf("Expected EPERM creating a symlink other than current, got %v", err)
+	}
+	for _, target := range []string{"work/github", "work/github.gpg"} {
+		err = fs.CreateSymlink(context.Background(), &fuseops.CreateSymlinkOp{Parent: control, Name: "current",
+			Target: target})
+		if err != nil {
+			t.Fatalf("Error creating current symlink: %s", err)
+		}
+		readOp := fuseops.ReadSymlinkOp{Inode: lookUp(t, fs, control, "current")}
+		err = fs.ReadSymlink(context.Background(), &readOp)
+		if err != nil {
+			t.Fatalf("Error reading current symlink: %s", err)
+		}
+		if readOp.Target != "../work/github.contents" {
+			t.Errorf("Expected target %s to resolve to the content file, got %s", target, readOp.Target)
+		}
+	}
+
+	// The selection survives rebuilding the tree.
+	err = fs.refresh()
+	if err != nil {
+		t.Fatalf("Error refreshing filesystem: %s", err)
+	}
+	control = lookUp(t, fs, fuseops.RootInodeID, ".passfuse")
+	lookUp(t, fs, control, "current")
+
+	err = fs.Unlink(context.Background(), &fuseops.UnlinkOp{Parent: control, Name: "current"})
+	if err != nil {
+		t.Fatalf("Error removing current symlink: %s", err)
+	}
+	err = fs.LookUpInode(context.Background(), &fuseops.LookUpInodeOp{Parent: control, Name: "current"})
+	if err != syscall.ENOENT {
+		t.Errorf("Expected ENOENT after removing the current symlink, got %v", err)
+	}
+}
+
+func TestAgeStore(t *testing.T) {
+	err := pass.SetSecretSuffix(".age")
+	if err != nil {
+		t.Fatalf("Error setting secret suffix: %s", err)
+	}
+	defer pass.SetSecretSuffix(pass.DefaultSecretSuffix)
+	storePath := makeStore(t, "work/github.age", "work/old.gpg")
+	defer os.RemoveAll(storePath)
+	setSecrets(map[string]string{"work/github": "hunter2\n"})
+
+	fs, err := newPassFS(storePath, "", PassFsOptions{ContentFiles: true, StrictGpg: true})
+	if err != nil {
+		t.Fatalf("Error creating filesystem: %s", err)
+	}
+	work := lookUp(t, fs, fuseops.RootInodeID, "work")
+	names := readDirNames(t, fs, work, 0)
+	if strings.Join(names, " ") != "github.contents" {
+		t.Errorf("Expected only the age secret, got %v", names)
+	}
+	content, err := readFile(fs, lookUp(t, fs, work, "github.contents"))
+	if err != nil {
+		t.Fatalf("Error reading secret: %s", err)
+	}
+	if content != "hunter2\n" {
+		t.Errorf("Unexpected content %q", content)
+	}
+}
+
+func TestUptime(t *testing.T) {
+	storePath := makeStore(t, "work/github.gpg")
+	defer os.RemoveAll(storePath)
+	setSecrets(map[string]string{})
+
+	fs, err := newPassFS(storePath, "", PassFsOptions{ContentFiles: true, ShowControl: true, EnableCurrent: true})
+	if err != nil {
+		t.Fatalf("Error creating filesystem: %s", err)
+	}
+	fs.startTime = time.Now().Add(-90 * time.Second)
+	control := lookUp(t, fs, fuseops.RootInodeID, ".passfuse")
+
+	content, err := readFile(fs, lookUp(t, fs, control, "uptime"))
+	if err != nil {
+		t.Fatalf("Error reading uptime: %s", err)
+	}
+	if content != "1m30s\n" {
+		t.Errorf("Expected uptime 1m30s, got %q", content)
+	}
+	op := fuseops.GetInodeAttributesOp{Inode: fuseops.RootInodeID}
+	err = fs.GetInodeAttributes(context.Background(), &op)
+	if err != nil {
+		t.Fatalf("Error getting root attributes: %s", err)
+	}
+	if !op.Attributes.Ctime.Equal(fs.startTime) {
+		t.Errorf("Expected the root change time to be the start time, got %s", op.Attributes.Ctime)
+	}
+
+	// Selecting a secret keeps the control files.
+	err = fs.CreateSymlink(context.Background(), &fuseops.CreateSymlinkOp{Parent: control, Name: "current",
+		Target: "work/github"})
+	if err != nil {
+		t.Fatalf("Error creating current symlink: %s", err)
+	}
+	names := readDirNames(t, fs, control, 0)
+	if strings.Join(names, " ") != "uptime last-error errors current" {
+		t.Errorf("Expected uptime, last-error, errors and current, got %v", names)
+	}
+	err = fs.Unlink(context.Background(), &fuseops.UnlinkOp{Parent: control, Name: "uptime"})
+	if err != syscall.EPERM {
+		t.Errorf("Expected EPERM removing a control file, got %v", err)
+	}
+}
+
+// failingOutput is the output of a show command which fails once its output has been read.
+type failingOutput struct {
+	io.Reader
+	err error
+}
+
+func (o failingOutput) Close() error {
+	return o.err
+}
+
+func TestAgentLocked(t *testing.T) {
+	storePath := makeStore(t, "work/github.gpg")
+	defer os.RemoveAll(storePath)
+	setSecrets(map[string]string{"work/github": "hunter2\n"})
+
+	fs, err := newPassFS(storePath, "", PassFsOptions{ContentFiles: true, Notify: true})
+	if err != nil {
+		t.Fatalf("Error creating filesystem: %s", err)
+	}
+	inode := lookUp(t, fs, lookUp(t, fs, fuseops.RootInodeID, "work"), "github.contents")
+
+	pass.SetCommandRunner(func(name string, args ...string) (io.ReadCloser, error) {
+		return failingOutput{Reader: strings.NewReader(""), err: pass.ErrAgentLocked}, nil
+	})
+	defer setSecrets(map[string]string{})
+	var notifications []string
+	notify = func(message string) error {
+		notifications = append(notifications, message)
+		return nil
+	}
+	defer func() { notify = sendNotification }()
+
+	for i := 0; i < 2; i++ {
+		_, err = readFile(fs, inode)
+		if err != syscall.EACCES {
+			t.Errorf("Expected EACCES when the agent is locked, got %v", err)
+		}
+	}
+	if len(notifications) != 1 {
+		t.Errorf("Expected a single notification, got %v", notifications)
+	}
+}
+
+func TestCardMissing(t *testing.T) {
+	storePath := makeStore(t, "work/github.gpg")
+	defer os.RemoveAll(storePath)
+	setSecrets(map[string]string{"work/github": "hunter2\n"})
+
+	fs, err := newPassFS(storePath, "", PassFsOptions{ContentFiles: true, ShowControl: true})
+	if err != nil {
+		t.Fatalf("Error creating filesystem: %s", err)
+	}
+	work := lookUp(t, fs, fuseops.RootInodeID, "work")
+	inode := lookUp(t, fs, work, "github.contents")
+
+	pass.SetCommandRunner(func(name string, args ...string) (io.ReadCloser, error) {
+		return failingOutput{Reader: strings.NewReader(""), err: pass.ErrCardMissing}, nil
+	})
+	defer setSecrets(map[string]string{})
+
+	_, err = readFile(fs, inode)
+	if err != syscall.ENXIO {
+		t.Errorf("Expected ENXIO when the smartcard is missing, got %v", err)
+	}
+	if lookUp(t, fs, work, "github.contents") != inode {
+		t.Errorf("Expected browsing to work without the smartcard")
+	}
+	lastError, _ := readFile(fs, lookUp(t, fs, lookUp(t, fs, fuseops.RootInodeID, controlDirName), lastErrorName))
+	if !strings.Contains(lastError, "smartcard") {
+		t.Errorf("Expected the last error to mention the smartcard, got %q", lastError)
+	}
+}
+
+func TestSecretErrors(t *testing.T) {
+	storePath := makeStore(t, "work/github.gpg", "work/gitlab.gpg", "mail.gpg")
+	defer os.RemoveAll(storePath)
+	setSecrets(map[string]string{"mail": "hunter2\n"})
+	defer setSecrets(map[string]string{})
+
+	fs, err := newPassFS(storePath, "", PassFsOptions{ContentFiles: true, ShowControl: true, NoSizeCache: true})
+	if err != nil {
+		t.Fatalf("Error creating filesystem: %s", err)
+	}
+	work := lookUp(t, fs, fuseops.RootInodeID, "work")
+	for _, name := range []string{"github.contents", "github.contents", "gitlab.contents"} {
+		err = fs.LookUpInode(context.Background(), &fuseops.LookUpInodeOp{Parent: work, Name: name})
+		if err == nil {
+			t.Errorf("Expected looking up %s of a secret failing to decrypt to fail", name)
+		}
+	}
+	readFile(fs, lookUp(t, fs, fuseops.RootInodeID, "mail.contents"))
+
+	content, err := readFile(fs, lookUp(t, fs, lookUp(t, fs, fuseops.RootInodeID, controlDirName), errorsName))
+	if err != nil {
+		t.Fatalf("Error reading errors: %s", err)
+	}
+	lines := strings.Split(strings.TrimSuffix(content, "\n"), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "work/github\t2\t") ||
+		!strings.HasPrefix(lines[1], "work/gitlab\t1\t") || !strings.Contains(lines[0], "no such file") {
+		t.Errorf("Expected failures of work/github and work/gitlab, got %q", content)
+	}
+
+	err = fs.refresh()
+	if err != nil {
+		t.Fatalf("Error refreshing: %s", err)
+	}
+	content, _ = readFile(fs, lookUp(t, fs, lookUp(t, fs, fuseops.RootInodeID, controlDirName), errorsName))
+	if content != "" {
+		t.Errorf("Expected refreshing to reset the errors, got %q", content)
+	}
+}
+
+func TestSecretFileOrder(t *testing.T) {
+	storePath := makeStore(t, "work/github.gpg")
+	defer os.RemoveAll(storePath)
+	setSecrets(map[string]string{"work/github": "hunter2\nurl: example.com\nusername: foo\nemail: foo@example.com\n"})
+
+	tests := []struct {
+		options  PassFsOptions
+		expected string
+	}{
+		{options: PassFsOptions{HistoryFiles: true, FirstLineFiles: true, ContentFiles: true},
+			expected: "github.contents github.first-line github.history"},
+		{options: PassFsOptions{HistoryFiles: true, ContentFiles: true, NoDecrypt: true},
+			expected: "github.gpg github.history"},
+		{options: PassFsOptions{ContentFiles: true, FieldDirs: true},
+			expected: "password email url username"},
+	}
+	for _, test := range tests {
+		fs, err := newPassFS(storePath, "", test.options)
+		if err != nil {
+			t.Fatalf("Error creating filesystem: %s", err)
+		}
+		dir := lookUp(t, fs, fuseops.RootInodeID, "work")
+		if test.options.FieldDirs {
+			dir = lookUp(t, fs, dir, "github")
+		}
+		names := readDirNames(t, fs, dir, 0)
+		if strings.Join(names, " ") != test.expected {
+			t.Errorf("Expected %s with options %+v, got %v", test.expected, test.options, names)
+		}
+	}
+}
+
+func TestMirror(t *testing.T) {
+	storePath := makeStore(t, "work/github.gpg")
+	defer os.RemoveAll(storePath)
+	setSecrets(map[string]string{"work/github": "hunter2\n"})
+
+	fs, err := newPassFS(storePath, "", PassFsOptions{ContentFiles: true, FirstLineFiles: true, FieldDirs: true,
+		Mirror: true})
+	if err != nil {
+		t.Fatalf("Error creating filesystem: %s", err)
+	}
+	work := lookUp(t, fs, fuseops.RootInodeID, "work")
+	names := readDirNames(t, fs, work, 0)
+	if strings.Join(names, " ") != "github.gpg" {
+		t.Errorf("Expected the name of the secret file, got %v", names)
+	}
+	content, err := readFile(fs, lookUp(t, fs, work, "github.gpg"))
+	if err != nil {
+		t.Fatalf("Error reading secret: %s", err)
+	}
+	if content != "hunter2\n" {
+		t.Errorf("Expected the decrypted content, got %q", content)
+	}
+
+	_, err = newPassFS(storePath, "", PassFsOptions{Mirror: true, NoDecrypt: true})
+	if err == nil {
+		t.Errorf("Expected mirror and no decrypt modes to be mutually exclusive")
+	}
+}
+
+func TestHasField(t *testing.T) {
+	storePath := makeStore(t, "work/github.gpg", "work/aws.gpg", "personal/mail.gpg")
+	defer os.RemoveAll(storePath)
+	secrets := map[string]string{
+		"work/github":   "hunter2\nURL: github.com\n",
+		"work/aws":      "hunter3\nusername: foo\n",
+		"personal/mail": "hunter4\nurl: mail.example.com\n",
+	}
+	decrypted := 0
+	pass.SetCommandRunner(func(name string, args ...string) (io.ReadCloser, error) {
+		decrypted++
+		return ioutil.NopCloser(strings.NewReader(secrets[args[len(args)-1]])), nil
+	})
+	defer setSecrets(map[string]string{})
+
+	fs, err := newPassFS(storePath, "", PassFsOptions{ContentFiles: true, HasField: "url"})
+	if err != nil {
+		t.Fatalf("Error creating filesystem: %s", err)
+	}
+	names := readDirNames(t, fs, fuseops.RootInodeID, 0)
+	if strings.Join(names, " ") != "personal work" {
+		t.Errorf("Expected both directories, got %v", names)
+	}
+	names = readDirNames(t, fs, lookUp(t, fs, fuseops.RootInodeID, "work"), 0)
+	if strings.Join(names, " ") != "github.contents" {
+		t.Errorf("Expected only the secret with the field, got %v", names)
+	}
+
+	// Unchanged secrets aren't decrypted again when refreshing.
+	decrypted = 0
+	err = fs.refresh()
+	if err != nil {
+		t.Fatalf("Error refreshing filesystem: %s", err)
+	}
+	if decrypted != 0 {
+		t.Errorf("Expected field matches to be cached, decrypted %d secrets", decrypted)
+	}
+
+	err = fs.reload(PassFsOptions{ContentFiles: true, HasField: "url", FieldPattern: `^github\.`})
+	if err != nil {
+		t.Fatalf("Error reloading filesystem: %s", err)
+	}
+	names = readDirNames(t, fs, fuseops.RootInodeID, 0)
+	if strings.Join(names, " ") != "work" {
+		t.Errorf("Expected directories without matching secrets to be hidden, got %v", names)
+	}
+
+	// Field matches aren't cached if caching contents is disabled.
+	err = fs.reload(PassFsOptions{ContentFiles: true, HasField: "url", NoContentCache: true})
+	if err != nil {
+		t.Fatalf("Error reloading filesystem: %s", err)
+	}
+	decrypted = 0
+	err = fs.refresh()
+	if err != nil {
+		t.Fatalf("Error refreshing filesystem: %s", err)
+	}
+	if decrypted != len(secrets) {
+		t.Errorf("Expected all secrets to be decrypted without content caching, decrypted %d", decrypted)
+	}
+
+	_, err = newPassFS(storePath, "", PassFsOptions{ContentFiles: true, FieldPattern: "github"})
+	if err == nil {
+		t.Errorf("Expected a field pattern without a field to be rejected")
+	}
+}
+
+func TestEnvNames(t *testing.T) {
+	storePath := makeStore(t, "personal/mail.gpg", "work/github-token.gpg", "work/github.token.gpg")
+	defer os.RemoveAll(storePath)
+	setSecrets(map[string]string{"personal/mail": "hunter2\n"})
+
+	fs, err := newPassFS(storePath, "", PassFsOptions{ContentFiles: true, FirstLineFiles: true, EnvNames: true})
+	if err != nil {
+		t.Fatalf("Error creating filesystem: %s", err)
+	}
+	content, err := readFile(fs, lookUp(t, fs, fuseops.RootInodeID, "PERSONAL_MAIL"))
+	if err != nil {
+		t.Fatalf("Error reading secret by environment name: %s", err)
+	}
+	if content != "hunter2\n" {
+		t.Errorf("Expected the content of personal/mail, got %q", content)
+	}
+
+	err = fs.LookUpInode(context.Background(), &fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID,
+		Name: "WORK_GITHUB_TOKEN"})
+	if err != syscall.ENOENT {
+		t.Errorf("Expected ENOENT for an environment name shared by two secrets, got %v", err)
+	}
+	names := readDirNames(t, fs, fuseops.RootInodeID, 0)
+	if strings.Join(names, " ") != "personal work" {
+		t.Errorf("Expected environment names not to be listed, got %v", names)
+	}
+}
+
+func TestWatchAgent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "passfuse-agent")
+	if err != nil {
+		t.Fatalf("Error creating directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	socketPath := path.Join(dir, "S.gpg-agent")
+	err = ioutil.WriteFile(socketPath, []byte{}, 0600)
+	if err != nil {
+		t.Fatalf("Error creating socket file: %s", err)
+	}
+
+	restarts := make(chan struct{}, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go watchAgent(ctx, socketPath, 10*time.Millisecond, func() {
+		restarts <- struct{}{}
+	})
+
+	// Stopping the agent isn't a restart, starting it again is.
+	os.Remove(socketPath)
+	select {
+	case <-restarts:
+		t.Fatalf("Expected the agent stopping not to count as a restart")
+	case <-time.After(50 * time.Millisecond):
+	}
+	err = ioutil.WriteFile(socketPath+".new", []byte{}, 0600)
+	if err == nil {
+		err = os.Rename(socketPath+".new", socketPath)
+	}
+	if err != nil {
+		t.Fatalf("Error recreating socket file: %s", err)
+	}
+	select {
+	case <-restarts:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected a restart to be detected")
+	}
+}
+
+func TestReadDirAtEnd(t *testing.T) {
+	storePath := makeStore(t, "a.gpg", "b.gpg")
+	defer os.RemoveAll(storePath)
+	setSecrets(map[string]string{})
+
+	fs, err := newPassFS(storePath, "", PassFsOptions{ContentFiles: true, FirstLineFiles: true})
+	if err != nil {
+		t.Fatalf("Error creating filesystem: %s", err)
+	}
+	names := readDirNames(t, fs, fuseops.RootInodeID, 0)
+	if len(names) != 4 {
+		t.Fatalf("Expected 4 entries, got %v", names)
+	}
+
+	// Reading again from the offset after the last entry is the end of the directory rather than an error.
+	names = readDirNames(t, fs, fuseops.RootInodeID, fuseops.DirOffset(len(names)))
+	if len(names) != 0 {
+		t.Errorf("Expected no entries at the end of the directory, got %v", names)
+	}
+
+	op := fuseops.ReadDirOp{Inode: fuseops.RootInodeID, Offset: 5, Dst: make([]byte, 4096)}
+	err = fs.ReadDir(context.Background(), &op)
+	if err != syscall.EIO {
+		t.Errorf("Expected EIO for an offset beyond the end, got %v", err)
+	}
+}
+
+func TestMaxOpenFiles(t *testing.T) {
+	storePath := makeStore(t, "work/github.gpg")
+	defer os.RemoveAll(storePath)
+	setSecrets(map[string]string{"work/github": "hunter2\n"})
+
+	fs, err := newPassFS(storePath, "", PassFsOptions{ContentFiles: true, MaxOpenFiles: 2})
+	if err != nil {
+		t.Fatalf("Error creating filesystem: %s", err)
+	}
+	inode := lookUp(t, fs, lookUp(t, fs, fuseops.RootInodeID, "work"), "github.contents")
+
+	var handles []fuseops.HandleID
+	for i := 0; i < 2; i++ {
+		op := fuseops.OpenFileOp{Inode: inode}
+		err = fs.OpenFile(context.Background(), &op)
+		if err != nil {
+			t.Fatalf("Error opening file: %s", err)
+		}
+		handles = append(handles, op.Handle)
+	}
+	err = fs.OpenFile(context.Background(), &fuseops.OpenFileOp{Inode: inode})
+	if err != syscall.EMFILE {
+		t.Errorf("Expected EMFILE beyond the maximum open files, got %v", err)
+	}
+
+	err = fs.ReleaseFileHandle(context.Background(), &fuseops.ReleaseFileHandleOp{Handle: handles[0]})
+	if err != nil {
+		t.Fatalf("Error releasing file handle: %s", err)
+	}
+	err = fs.OpenFile(context.Background(), &fuseops.OpenFileOp{Inode: inode})
+	if err != nil {
+		t.Errorf("Expected opening to succeed after releasing a handle, got %v", err)
+	}
+}
+
+func TestStats(t *testing.T) {
+	storePath := makeStore(t, "work/github.gpg")
+	defer os.RemoveAll(storePath)
+	setSecrets(map[string]string{"work/github": "hunter2\n"})
+
+	fs, err := newPassFS(storePath, "", PassFsOptions{ContentFiles: true})
+	if err != nil {
+		t.Fatalf("Error creating filesystem: %s", err)
+	}
+	github := lookUp(t, fs, lookUp(t, fs, fuseops.RootInodeID, "work"), "github.contents")
+	for i := 0; i < 2; i++ {
+		_, err = readFile(fs, github)
+		if err != nil {
+			t.Fatalf("Error reading file: %s", err)
+		}
+	}
+	setSecrets(map[string]string{})
+	_, err = readFile(fs, github)
+	if err == nil {
+		t.Fatalf("Expected reading a removed secret to fail")
+	}
+	err = fs.OpenFile(context.Background(), &fuseops.OpenFileOp{Inode: github})
+	if err != nil {
+		t.Fatalf("Error opening file: %s", err)
+	}
+
+	expected := "reads: 3, read errors: 1, size cache hits: 0, size cache misses: 1, open file handles: 1"
+	if stats := fs.stats(); stats != expected {
+		t.Errorf("Expected stats %q, got %q", expected, stats)
+	}
+}
+
+func TestDumpWhileLocked(t *testing.T) {
+	storePath := makeStore(t, "work/github.gpg", "mail.gpg")
+	defer os.RemoveAll(storePath)
+	setSecrets(map[string]string{"work/github": "hunter2\n", "mail": "swordfish\n"})
+
+	fs, err := newPassFS(storePath, "", PassFsOptions{ContentFiles: true})
+	if err != nil {
+		t.Fatalf("Error creating filesystem: %s", err)
+	}
+	lookUp(t, fs, lookUp(t, fs, fuseops.RootInodeID, "work"), "github.contents")
+
+	// An operation holding the mutex, e.g. one which hangs, doesn't keep the state from being dumped.
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	dumped := make(chan string)
+	go func() {
+		var dump bytes.Buffer
+		fs.dump(&dump)
+		dumped <- dump.String()
+	}()
+	select {
+	case dump := <-dumped:
+		for _, line := range []string{"size cache misses: 1\n", "open file handles: 0\n",
+			"secrets with cached sizes: 1\n  work/github.gpg\n"} {
+			if !strings.Contains(dump, line) {
+				t.Errorf("Expected dump to contain %q, got %q", line, dump)
+			}
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected dumping not to wait for the mutex")
+	}
+}
+
+func TestByTag(t *testing.T) {
+	storePath := makeStore(t, "work/github.gpg", "work/aws.gpg", "personal/mail.gpg")
+	defer os.RemoveAll(storePath)
+	secrets := map[string]string{
+		"work/github":   "hunter2\ntags: work, ci\n",
+		"work/aws":      "hunter3\ntags: work\n",
+		"personal/mail": "hunter4\n",
+	}
+	decrypted := 0
+	pass.SetCommandRunner(func(name string, args ...string) (io.ReadCloser, error) {
+		decrypted++
+		return ioutil.NopCloser(strings.NewReader(secrets[args[len(args)-1]])), nil
+	})
+	defer setSecrets(map[string]string{})
+
+	fs, err := newPassFS(storePath, "", PassFsOptions{ContentFiles: true, ByTag: true})
+	if err != nil {
+		t.Fatalf("Error creating filesystem: %s", err)
+	}
+	tags := lookUp(t, fs, fuseops.RootInodeID, "tags")
+	names := readDirNames(t, fs, tags, 0)
+	if strings.Join(names, " ") != "ci work" {
+		t.Errorf("Expected a directory per tag, got %v", names)
+	}
+	work := lookUp(t, fs, tags, "work")
+	names = readDirNames(t, fs, work, 0)
+	if strings.Join(names, " ") != "aws github" {
+		t.Errorf("Expected links to both secrets with the tag, got %v", names)
+	}
+	readOp := fuseops.ReadSymlinkOp{Inode: lookUp(t, fs, work, "github")}
+	err = fs.ReadSymlink(context.Background(), &readOp)
+	if err != nil {
+		t.Fatalf("Error reading symlink: %s", err)
+	}
+	if readOp.Target != "../../work/github.contents" {
+		t.Errorf("Expected the link to point to the content file, got %s", readOp.Target)
+	}
+
+	// Unchanged secrets aren't decrypted again when refreshing.
+	decrypted = 0
+	err = fs.refresh()
+	if err != nil {
+		t.Fatalf("Error refreshing filesystem: %s", err)
+	}
+	if decrypted != 0 {
+		t.Errorf("Expected tags to be cached, decrypted %d secrets", decrypted)
+	}
+
+	_, err = newPassFS(storePath, "", PassFsOptions{NoDecrypt: true, ByTag: true})
+	if err == nil {
+		t.Errorf("Expected reading tags without decrypting to be rejected")
+	}
+}
+
+func TestRootName(t *testing.T) {
+	storePath := makeStore(t, "work/github.gpg")
+	defer os.RemoveAll(storePath)
+	setSecrets(map[string]string{"work/github": "hunter2\n"})
+
+	fs, err := newPassFS(storePath, "", PassFsOptions{ContentFiles: true, ShowControl: true, RootName: "store"})
+	if err != nil {
+		t.Fatalf("Error creating filesystem: %s", err)
+	}
+	names := readDirNames(t, fs, fuseops.RootInodeID, 0)
+	if strings.Join(names, " ") != "store .passfuse" {
+		t.Errorf("Expected the root directory and the control directory, got %v", names)
+	}
+	store := lookUp(t, fs, fuseops.RootInodeID, "store")
+	content, err := readFile(fs, lookUp(t, fs, lookUp(t, fs, store, "work"), "github.contents"))
+	if err != nil {
+		t.Fatalf("Error reading file: %s", err)
+	}
+	if content != "hunter2\n" {
+		t.Errorf("Unexpected content %q", content)
+	}
+
+	for _, rootName := range []string{"..", "a/b", ".passfuse"} {
+		_, err = newPassFS(storePath, "", PassFsOptions{ContentFiles: true, RootName: rootName})
+		if err == nil {
+			t.Errorf("Expected root name %s to be rejected", rootName)
+		}
+	}
+}
+
+func TestReadWhileRebuilding(t *testing.T) {
+	storePath := makeStore(t, "work/github.gpg", "work/aws.gpg")
+	defer os.RemoveAll(storePath)
+	setSecrets(map[string]string{"work/github": "hunter2\n", "work/aws": "hunter3\n"})
+
+	fs, err := newPassFS(storePath, "", PassFsOptions{ContentFiles: true, FirstLineFiles: true,
+		EnableCurrent: true})
+	if err != nil {
+		t.Fatalf("Error creating filesystem: %s", err)
+	}
+
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			// Reads racing with a rebuild may fail with stale or missing inodes, they mustn't race on the tree.
+			op := fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID, Name: "work"}
+			if fs.LookUpInode(context.Background(), &op) != nil {
+				continue
+			}
+			work := op.Entry.Child
+			fs.ReadDir(context.Background(), &fuseops.ReadDirOp{Inode: work, Dst: make([]byte, 4096)})
+			fs.GetInodeAttributes(context.Background(), &fuseops.GetInodeAttributesOp{Inode: work})
+			op = fuseops.LookUpInodeOp{Parent: work, Name: "github.contents"}
+			if fs.LookUpInode(context.Background(), &op) == nil {
+				readFile(fs, op.Entry.Child)
+			}
+		}
+	}()
+
+	for i := 0; i < 50; i++ {
+		err = fs.refresh()
+		if err != nil {
+			t.Fatalf("Error refreshing filesystem: %s", err)
+		}
+		err = fs.reload(PassFsOptions{ContentFiles: true, FirstLineFiles: i%2 == 0, EnableCurrent: true})
+		if err != nil {
+			t.Fatalf("Error reloading filesystem: %s", err)
+		}
+		// Let the reads run in between rebuilds with a single processor too.
+		runtime.Gosched()
+	}
+	close(done)
+	<-finished
+}
+
+func TestAllEnv(t *testing.T) {
+	storePath := makeStore(t, "work/github-token.gpg", "work/github.token.gpg", "work/aws.gpg")
+	defer os.RemoveAll(storePath)
+	secrets := map[string]string{
+		"work/github-token": "hunter2\nusername: foo\n",
+		"work/github.token": "hunter3\n",
+		"work/aws":          `say "hi" \o/` + "\n",
+	}
+	decrypted := 0
+	pass.SetCommandRunner(func(name string, args ...string) (io.ReadCloser, error) {
+		decrypted++
+		return ioutil.NopCloser(strings.NewReader(secrets[args[len(args)-1]])), nil
+	})
+	defer setSecrets(map[string]string{})
+
+	fs, err := newPassFS(storePath, "", PassFsOptions{ContentFiles: true, AllEnv: true})
+	if err != nil {
+		t.Fatalf("Error creating filesystem: %s", err)
+	}
+	op := fuseops.LookUpInodeOp{Parent: lookUp(t, fs, fuseops.RootInodeID, ".passfuse"), Name: "all.env"}
+	err = fs.LookUpInode(context.Background(), &op)
+	if err != nil {
+		t.Fatalf("Error looking up all.env: %s", err)
+	}
+	content, err := readFile(fs, op.Entry.Child)
+	if err != nil {
+		t.Fatalf("Error reading all.env: %s", err)
+	}
+	expected := `WORK_AWS="say \"hi\" \\o/"` + "\nWORK_GITHUB_TOKEN=\"hunter2\"\nWORK_GITHUB_TOKEN_2=\"hunter3\"\n"
+	if content != expected {
+		t.Errorf("Expected %q, got %q", expected, content)
+	}
+	if op.Entry.Attributes.Size != uint64(len(expected)) {
+		t.Errorf("Expected size %d, got %d", len(expected), op.Entry.Attributes.Size)
+	}
+	if decrypted != 3 {
+		t.Errorf("Expected first lines to be cached, decrypted %d times", decrypted)
+	}
+}
+
+func TestAliases(t *testing.T) {
+	storePath := makeStore(t, "work/github.gpg", "personal/mail.gpg")
+	defer os.RemoveAll(storePath)
+	setSecrets(map[string]string{"work/github": "hunter2\nusername: foo\n"})
+
+	fs, err := newPassFS(storePath, "", PassFsOptions{ContentFiles: true, FirstLineFiles: true,
+		Aliases: []string{"gh=work/github.gpg", "personal/github=work/github", "missing/gh=work/github",
+			"personal/mail=work/github", "other=work/missing"}})
+	if err != nil {
+		t.Fatalf("Error creating filesystem: %s", err)
+	}
+	names := readDirNames(t, fs, fuseops.RootInodeID, 0)
+	if strings.Join(names, " ") != "personal work gh.contents gh.first-line" {
+		t.Errorf("Expected aliases at the root, got %v", names)
+	}
+	personal := lookUp(t, fs, fuseops.RootInodeID, "personal")
+	names = readDirNames(t, fs, personal, 0)
+	if strings.Join(names, " ") != "mail.contents mail.first-line github.contents github.first-line" {
+		t.Errorf("Expected the alias next to the secret, without replacing it, got %v", names)
+	}
+
+	original := lookUp(t, fs, lookUp(t, fs, fuseops.RootInodeID, "work"), "github.contents")
+	for _, alias := range []fuseops.InodeID{lookUp(t, fs, fuseops.RootInodeID, "gh.contents"),
+		lookUp(t, fs, personal, "github.contents")} {
+		if alias != original {
+			t.Errorf("Expected the alias to share inode %d, got %d", original, alias)
+		}
+	}
+	attributesOp := fuseops.GetInodeAttributesOp{Inode: original}
+	err = fs.GetInodeAttributes(context.Background(), &attributesOp)
+	if err != nil {
+		t.Fatalf("Error getting attributes: %s", err)
+	}
+	if attributesOp.Attributes.Nlink != 3 {
+		t.Errorf("Expected a link count of 3, got %d", attributesOp.Attributes.Nlink)
+	}
+	content, err := readFile(fs, lookUp(t, fs, fuseops.RootInodeID, "gh.first-line"))
+	if err != nil {
+		t.Fatalf("Error reading alias: %s", err)
+	}
+	if content != "hunter2" {
+		t.Errorf("Unexpected content %q", content)
+	}
+
+	_, err = newPassFS(storePath, "", PassFsOptions{ContentFiles: true, Aliases: []string{"gh"}})
+	if err == nil {
+		t.Errorf("Expected an alias without a secret to be rejected")
+	}
+}
+
+func TestNoAttrCache(t *testing.T) {
+	storePath := makeStore(t, "work/github.gpg")
+	defer os.RemoveAll(storePath)
+	setSecrets(map[string]string{"work/github": "hunter2\n"})
+
+	for _, noAttrCache := range []bool{false, true} {
+		fs, err := newPassFS(storePath, "", PassFsOptions{ContentFiles: true, NoAttrCache: noAttrCache})
+		if err != nil {
+			t.Fatalf("Error creating filesystem: %s", err)
+		}
+		work := lookUp(t, fs, fuseops.RootInodeID, "work")
+		lookUpOp := fuseops.LookUpInodeOp{Parent: work, Name: "github.contents"}
+		err = fs.LookUpInode(context.Background(), &lookUpOp)
+		if err != nil {
+			t.Fatalf("Error looking up file: %s", err)
+		}
+		attributesOp := fuseops.GetInodeAttributesOp{Inode: work}
+		err = fs.GetInodeAttributes(context.Background(), &attributesOp)
+		if err != nil {
+			t.Fatalf("Error getting attributes: %s", err)
+		}
+		for _, expiration := range []time.Time{lookUpOp.Entry.AttributesExpiration, attributesOp.AttributesExpiration} {
+			cached := time.Until(expiration) > time.Minute
+			if cached == noAttrCache {
+				t.Errorf("Expected attributes to be cached %t with no attribute cache %t, expiring at %s", !noAttrCache,
+					noAttrCache, expiration)
+			}
+		}
+	}
+}
+
+func TestFramedFiles(t *testing.T) {
+	storePath := makeStore(t, "work/github.gpg")
+	defer os.RemoveAll(storePath)
+	setSecrets(map[string]string{"work/github": "hunter2\n"})
+
+	fs, err := newPassFS(storePath, "", PassFsOptions{ContentFiles: true, FramedFiles: true})
+	if err != nil {
+		t.Fatalf("Error creating filesystem: %s", err)
+	}
+	work := lookUp(t, fs, fuseops.RootInodeID, "work")
+	names := readDirNames(t, fs, work, 0)
+	if strings.Join(names, " ") != "github.contents github.framed" {
+		t.Errorf("Expected content and framed files, got %v", names)
+	}
+	op := fuseops.LookUpInodeOp{Parent: work, Name: "github.framed"}
+	err = fs.LookUpInode(context.Background(), &op)
+	if err != nil {
+		t.Fatalf("Error looking up framed file: %s", err)
+	}
+	if op.Entry.Attributes.Size != 12 {
+		t.Errorf("Expected the size of the length and the content, got %d", op.Entry.Attributes.Size)
+	}
+	content, err := readFile(fs, op.Entry.Child)
+	if err != nil {
+		t.Fatalf("Error reading framed file: %s", err)
+	}
+	if len(content) != 12 || content[4:] != "hunter2\n" || binary.BigEndian.Uint32([]byte(content[:4])) != 8 {
+		t.Errorf("Unexpected framed content %q", content)
+	}
+}
+
+func getXattr(t *testing.T, fs *passFS, inode fuseops.InodeID, name string) string {
+	t.Helper()
+	op := fuseops.GetXattrOp{Inode: inode, Name: name}
+	err := fs.GetXattr(context.Background(), &op)
+	if err != nil {
+		t.Fatalf("Error getting size of extended attribute %s: %s", name, err)
+	}
+	op.Dst = make([]byte, op.BytesRead)
+	err = fs.GetXattr(context.Background(), &op)
+	if err != nil {
+		t.Fatalf("Error getting extended attribute %s: %s", name, err)
+	}
+	return string(op.Dst[:op.BytesRead])
+}
+
+func TestSecretCountXattr(t *testing.T) {
+	storePath := makeStore(t, "work/github.gpg", "work/ops/ci.gpg", "work/ops/db/prod.gpg", "personal/mail.gpg")
+	defer os.RemoveAll(storePath)
+	setSecrets(map[string]string{})
+
+	fs, err := newPassFS(storePath, "", PassFsOptions{ContentFiles: true})
+	if err != nil {
+		t.Fatalf("Error creating filesystem: %s", err)
+	}
+	work := lookUp(t, fs, fuseops.RootInodeID, "work")
+	for inode, expected := range map[fuseops.InodeID]string{
+		fuseops.RootInodeID:        "4",
+		work:                       "3",
+		lookUp(t, fs, work, "ops"): "2",
+	} {
+		count := getXattr(t, fs, inode, "user.passfuse.count")
+		if count != expected {
+			t.Errorf("Expected %s secrets under inode %d, got %s", expected, inode, count)
+		}
+	}
+
+	err = fs.GetXattr(context.Background(), &fuseops.GetXattrOp{Inode: work, Name: "user.other"})
+	if err != syscall.ENODATA {
+		t.Errorf("Expected ENODATA for another attribute, got %v", err)
+	}
+	err = fs.GetXattr(context.Background(), &fuseops.GetXattrOp{Inode: work, Name: "user.passfuse.count",
+		Dst: make([]byte, 0, 1)[:0]})
+	if err != nil {
+		t.Errorf("Expected an empty destination to get the size, got %v", err)
+	}
+	listOp := fuseops.ListXattrOp{Inode: work, Dst: make([]byte, 64)}
+	err = fs.ListXattr(context.Background(), &listOp)
+	if err != nil {
+		t.Fatalf("Error listing extended attributes: %s", err)
+	}
+	if string(listOp.Dst[:listOp.BytesRead]) != "user.passfuse.count\x00" {
+		t.Errorf("Unexpected extended attributes %q", listOp.Dst[:listOp.BytesRead])
+	}
+}
+
+func TestAllowReadFile(t *testing.T) {
+	storePath := makeStore(t, "work/github.gpg", "work/aws.gpg")
+	defer os.RemoveAll(storePath)
+	allowlistFile, err := ioutil.TempFile("", "passfuse-allowlist")
+	if err != nil {
+		t.Fatalf("Error creating allowlist: %s", err)
+	}
+	defer os.Remove(allowlistFile.Name())
+	_, err = allowlistFile.WriteString("# only GitHub\nwork/github.gpg\n")
+	if err != nil {
+		t.Fatalf("Error writing allowlist: %s", err)
+	}
+	allowlistFile.Close()
+	secrets := map[string]string{"work/github": "hunter2\n", "work/aws": "hunter3\n"}
+	var decrypted []string
+	pass.SetCommandRunner(func(name string, args ...string) (io.ReadCloser, error) {
+		decrypted = append(decrypted, args[len(args)-1])
+		return ioutil.NopCloser(strings.NewReader(secrets[args[len(args)-1]])), nil
+	})
+	defer setSecrets(map[string]string{})
+
+	fs, err := newPassFS(storePath, "", PassFsOptions{ContentFiles: true, AllowReadFile: allowlistFile.Name()})
+	if err != nil {
+		t.Fatalf("Error creating filesystem: %s", err)
+	}
+	work := lookUp(t, fs, fuseops.RootInodeID, "work")
+	content, err := readFile(fs, lookUp(t, fs, work, "github.contents"))
+	if err != nil || content != "hunter2\n" {
+		t.Errorf("Expected to read an allowed secret, got %q and %v", content, err)
+	}
+
+	op := fuseops.LookUpInodeOp{Parent: work, Name: "aws.contents"}
+	err = fs.LookUpInode(context.Background(), &op)
+	if err != nil {
+		t.Fatalf("Error looking up a denied secret: %s", err)
+	}
+	if op.Entry.Attributes.Size != 0 {
+		t.Errorf("Expected a denied secret to be empty, got size %d", op.Entry.Attributes.Size)
+	}
+	_, err = readFile(fs, op.Entry.Child)
+	if err != syscall.EACCES {
+		t.Errorf("Expected EACCES reading a denied secret, got %v", err)
+	}
+	for _, secret := range decrypted {
+		if secret != "work/github" {
+			t.Errorf("Expected only the allowed secret to be decrypted, decrypted %s", secret)
+		}
+	}
+}
+
+func TestStoreRetries(t *testing.T) {
+	storePath := makeStore(t, "foo.gpg")
+	defer os.RemoveAll(storePath)
+	failures := 0
+	pass.SetCommandRunner(func(name string, args ...string) (io.ReadCloser, error) {
+		if failures > 0 {
+			failures--
+			return nil, &os.PathError{Op: "read", Path: "foo.gpg", Err: syscall.EIO}
+		}
+		return ioutil.NopCloser(strings.NewReader("hunter2\n")), nil
+	})
+	defer setSecrets(map[string]string{})
+
+	for _, test := range []struct {
+		retries  int
+		failures int
+		err      error
+	}{
+		{retries: 0, failures: 1, err: syscall.EIO},
+		{retries: 2, failures: 2, err: nil},
+		{retries: 2, failures: 3, err: syscall.EIO},
+	} {
+		fs, err := newPassFS(storePath, "", PassFsOptions{ContentFiles: true, StoreRetries: test.retries})
+		if err != nil {
+			t.Fatalf("Error creating filesystem: %s", err)
+		}
+		inode := lookUp(t, fs, fuseops.RootInodeID, "foo.contents")
+		failures = test.failures
+		content, err := readFile(fs, inode)
+		if err != test.err {
+			t.Errorf("Expected %v with %d retries after %d failures, got %v", test.err, test.retries, test.failures,
+				err)
+		}
+		if err == nil && content != "hunter2\n" {
+			t.Errorf("Unexpected content %q", content)
+		}
+	}
+}
+
+func TestTomlAndIniFiles(t *testing.T) {
+	storePath := makeStore(t, "foo.gpg")
+	defer os.RemoveAll(storePath)
+	setSecrets(map[string]string{"foo": "hunter\"2\\\nuser name: foo\t bar\na=b: c\nurl: https://example.com\n"})
+	defer setSecrets(map[string]string{})
+
+	tomlFields := "\"user name\" = \"foo\\t bar\"\n\"a=b\" = \"c\"\nurl = \"https://example.com\"\n"
+	iniFields := "user name = \"foo\\t bar\"\nurl = \"https://example.com\"\n"
+	password := "password = \"hunter\\\"2\\\\\"\n"
+	for _, includePassword := range []bool{false, true} {
+		fs, err := newPassFS(storePath, "", PassFsOptions{TomlFiles: true, IniFiles: true,
+			IncludePassword: includePassword})
+		if err != nil {
+			t.Fatalf("Error creating filesystem: %s", err)
+		}
+		expectedFiles := map[string]string{"foo.toml": tomlFields, "foo.ini": iniFields}
+		if includePassword {
+			expectedFiles = map[string]string{"foo.toml": password + tomlFields, "foo.ini": password + iniFields}
+		}
+		for name, expected := range expectedFiles {
+			op := fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID, Name: name}
+			err = fs.LookUpInode(context.Background(), &op)
+			if err != nil {
+				t.Fatalf("Error looking up %s: %s", name, err)
+			}
+			content, err := readFile(fs, op.Entry.Child)
+			if err != nil {
+				t.Fatalf("Error reading %s: %s", name, err)
+			}
+			if content != expected {
+				t.Errorf("Expected %s to be %q including the password %t, got %q", name, expected, includePassword,
+					content)
+			}
+			if op.Entry.Attributes.Size != uint64(len(expected)) {
+				t.Errorf("Expected size %d for %s, got %d", len(expected), name, op.Entry.Attributes.Size)
+			}
+		}
+	}
+}
+
+func TestRenderOncePerHandle(t *testing.T) {
+	storePath := makeStore(t, "foo.gpg")
+	defer os.RemoveAll(storePath)
+	decrypted := 0
+	pass.SetCommandRunner(func(name string, args ...string) (io.ReadCloser, error) {
+		decrypted++
+		return ioutil.NopCloser(strings.NewReader("hunter2\nuser: foo\nurl: https://example.com\n")), nil
+	})
+	defer setSecrets(map[string]string{})
+
+	fs, err := newPassFS(storePath, "", PassFsOptions{TomlFiles: true})
+	if err != nil {
+		t.Fatalf("Error creating filesystem: %s", err)
+	}
+	inode := lookUp(t, fs, fuseops.RootInodeID, "foo.toml")
+	lookUp(t, fs, fuseops.RootInodeID, "foo.toml")
+	if decrypted != 1 {
+		t.Errorf("Expected the size of the rendered file to be cached, decrypted %d times", decrypted)
+	}
+
+	open := fuseops.OpenFileOp{Inode: inode}
+	err = fs.OpenFile(context.Background(), &open)
+	if err != nil {
+		t.Fatalf("Error opening file: %s", err)
+	}
+	var content string
+	for offset := int64(0); ; offset += 4 {
+		op := fuseops.ReadFileOp{Inode: inode, Handle: open.Handle, Offset: offset, Dst: make([]byte, 4)}
+		err = fs.ReadFile(context.Background(), &op)
+		if err != nil {
+			t.Fatalf("Error reading file: %s", err)
+		}
+		if op.BytesRead == 0 {
+			break
+		}
+		content += string(op.Dst[:op.BytesRead])
+	}
+	expected := "user = \"foo\"\nurl = \"https://example.com\"\n"
+	if content != expected {
+		t.Errorf("Expected %q, got %q", expected, content)
+	}
+	if decrypted != 2 {
+		t.Errorf("Expected reading the rendered file in chunks to render it once, decrypted %d times", decrypted)
+	}
+}
+
+func TestAgeFiles(t *testing.T) {
+	storePath := makeStore(t, "foo.gpg")
+	defer os.RemoveAll(storePath)
+	committed := time.Now().Add(-49 * time.Hour)
+	pass.SetCommandRunner(func(name string, args ...string) (io.ReadCloser, error) {
+		return ioutil.NopCloser(strings.NewReader(fmt.Sprintf("%d\n", committed.Unix()))), nil
+	})
+	defer setSecrets(map[string]string{})
+
+	fs, err := newPassFS(storePath, "", PassFsOptions{AgeFiles: true, AgeSuffix: ".rotated"})
+	if err != nil {
+		t.Fatalf("Error creating filesystem: %s", err)
+	}
+	op := fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID, Name: "foo.rotated"}
+	err = fs.LookUpInode(context.Background(), &op)
+	if err != nil {
+		t.Fatalf("Error looking up age file: %s", err)
+	}
+	if op.Entry.AttributesExpiration.After(time.Now().Add(time.Minute)) {
+		t.Errorf("Expected the attributes of age files to expire within a minute, expire at %s",
+			op.Entry.AttributesExpiration)
+	}
+	content, err := readFile(fs, op.Entry.Child)
+	if err != nil {
+		t.Fatalf("Error reading age file: %s", err)
+	}
+	if !strings.HasPrefix(content, "2d1h0m") || !strings.HasSuffix(content, "s\n") {
+		t.Errorf("Expected an age of 2 days and an hour, got %q", content)
+	}
+}
+
+func TestLastError(t *testing.T) {
+	storePath := makeStore(t, "foo.gpg")
+	defer os.RemoveAll(storePath)
+	pass.SetCommandRunner(func(name string, args ...string) (io.ReadCloser, error) {
+		return failingOutput{Reader: strings.NewReader(""), err: errors.New("gpg: decryption failed: No secret key")}, nil
+	})
+	defer setSecrets(map[string]string{})
+
+	fs, err := newPassFS(storePath, "", PassFsOptions{ContentFiles: true, ShowControl: true})
+	if err != nil {
+		t.Fatalf("Error creating filesystem: %s", err)
+	}
+	control := lookUp(t, fs, fuseops.RootInodeID, ".passfuse")
+	content, err := readFile(fs, lookUp(t, fs, control, "last-error"))
+	if err != nil || content != "" {
+		t.Errorf("Expected no last error before failing, got %q and %v", content, err)
+	}
+
+	err = fs.LookUpInode(context.Background(), &fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID, Name: "foo.contents"})
+	if err == nil {
+		t.Fatalf("Expected looking up a secret failing to decrypt to fail")
+	}
+	content, err = readFile(fs, lookUp(t, fs, control, "last-error"))
+	if err != nil {
+		t.Fatalf("Error reading last error: %s", err)
+	}
+	if !strings.Contains(content, "foo") || !strings.Contains(content, "No secret key") {
+		t.Errorf("Expected the last error to name the secret and the cause, got %q", content)
+	}
+}
+
+func TestQrFiles(t *testing.T) {
+	storePath := makeStore(t, "foo.gpg")
+	defer os.RemoveAll(storePath)
+	setSecrets(map[string]string{"foo": "hunter2\notpauth: otpauth://totp/foo?secret=JBSWY3DPEHPK3PXP\n"})
+	defer setSecrets(map[string]string{})
+
+	for _, field := range []string{"", "otpauth"} {
+		fs, err := newPassFS(storePath, "", PassFsOptions{QrFiles: true, QrField: field})
+		if err != nil {
+			t.Fatalf("Error creating filesystem: %s", err)
+		}
+		op := fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID, Name: "foo.qr"}
+		err = fs.LookUpInode(context.Background(), &op)
+		if err != nil {
+			t.Fatalf("Error looking up QR code file: %s", err)
+		}
+		readOp := fuseops.ReadFileOp{Inode: op.Entry.Child, Dst: make([]byte, 64<<10)}
+		err = fs.ReadFile(context.Background(), &readOp)
+		if err != nil {
+			t.Fatalf("Error reading QR code file: %s", err)
+		}
+		if uint64(readOp.BytesRead) != op.Entry.Attributes.Size {
+			t.Errorf("Expected size %d of the QR code of field %q, read %d bytes", op.Entry.Attributes.Size, field,
+				readOp.BytesRead)
+		}
+		config, err := png.DecodeConfig(bytes.NewReader(readOp.Dst[:readOp.BytesRead]))
+		if err != nil {
+			t.Fatalf("Error decoding QR code of field %q: %s", field, err)
+		}
+		if config.Width != 256 || config.Height != 256 {
+			t.Errorf("Expected a 256x256 image, got %dx%d", config.Width, config.Height)
+		}
+	}
+}
+
+func TestCacheToggles(t *testing.T) {
+	storePath := makeStore(t, "foo.gpg")
+	defer os.RemoveAll(storePath)
+	decrypted := 0
+	pass.SetCommandRunner(func(name string, args ...string) (io.ReadCloser, error) {
+		decrypted++
+		return ioutil.NopCloser(strings.NewReader("hunter2\n")), nil
+	})
+	defer setSecrets(map[string]string{})
+
+	for _, test := range []struct {
+		options   PassFsOptions
+		decrypted int
+	}{
+		{PassFsOptions{ContentFiles: true, AllEnv: true}, 2},
+		{PassFsOptions{ContentFiles: true, AllEnv: true, NoSizeCache: true}, 3},
+		{PassFsOptions{ContentFiles: true, AllEnv: true, NoContentCache: true}, 3},
+	} {
+		fs, err := newPassFS(storePath, "", test.options)
+		if err != nil {
+			t.Fatalf("Error creating filesystem: %s", err)
+		}
+		decrypted = 0
+		lookUp(t, fs, fuseops.RootInodeID, "foo.contents")
+		lookUp(t, fs, fuseops.RootInodeID, "foo.contents")
+		allEnv := lookUp(t, fs, lookUp(t, fs, fuseops.RootInodeID, ".passfuse"), "all.env")
+		_, err = readFile(fs, allEnv)
+		if err != nil {
+			t.Fatalf("Error reading all.env: %s", err)
+		}
+		if decrypted != test.decrypted {
+			t.Errorf("Expected %d decryptions with %+v, got %d", test.decrypted, test.options, decrypted)
+		}
+	}
+
+	_, err := newPassFS(storePath, "", PassFsOptions{PersistSizeCache: true, NoSizeCache: true})
+	if err == nil {
+		t.Errorf("Expected persisting sizes without caching them to fail")
+	}
+	pass.SetSnapshotWindow(storePath, time.Minute)
+	defer pass.SetSnapshotWindow("", 0)
+	_, err = newPassFS(storePath, "", PassFsOptions{ContentFiles: true, NoContentCache: true})
+	if err == nil {
+		t.Errorf("Expected snapshots without caching contents to fail")
+	}
+}
+
+func TestLock(t *testing.T) {
+	storePath := makeStore(t, "foo.gpg")
+	defer os.RemoveAll(storePath)
+	decrypted := 0
+	pass.SetCommandRunner(func(name string, args ...string) (io.ReadCloser, error) {
+		decrypted++
+		return ioutil.NopCloser(strings.NewReader("hunter2\n")), nil
+	})
+	defer setSecrets(map[string]string{})
+	killed := 0
+	killAgent = func() error {
+		killed++
+		return nil
+	}
+	defer func() { killAgent = killGpgAgent }()
+
+	fs, err := newPassFS(storePath, "", PassFsOptions{ContentFiles: true, EnableLock: true})
+	if err != nil {
+		t.Fatalf("Error creating filesystem: %s", err)
+	}
+	lookUp(t, fs, fuseops.RootInodeID, "foo.contents")
+	lock := lookUp(t, fs, lookUp(t, fs, fuseops.RootInodeID, ".passfuse"), "lock")
+	size := uint64(0)
+	err = fs.SetInodeAttributes(context.Background(), &fuseops.SetInodeAttributesOp{Inode: lock, Size: &size})
+	if err != nil {
+		t.Fatalf("Error truncating lock file: %s", err)
+	}
+	err = fs.WriteFile(context.Background(), &fuseops.WriteFileOp{Inode: lock, Data: []byte("\n")})
+	if err != nil {
+		t.Fatalf("Error writing lock file: %s", err)
+	}
+	if killed != 1 {
+		t.Errorf("Expected locking to stop the agent once, stopped %d times", killed)
+	}
+	lookUp(t, fs, fuseops.RootInodeID, "foo.contents")
+	if decrypted != 2 {
+		t.Errorf("Expected the size to be determined again after locking, decrypted %d times", decrypted)
+	}
+
+	err = fs.WriteFile(context.Background(), &fuseops.WriteFileOp{Inode: lookUp(t, fs, fuseops.RootInodeID,
+		"foo.contents"), Data: []byte("\n")})
+	if err != syscall.EPERM {
+		t.Errorf("Expected EPERM writing to a secret, got %v", err)
+	}
+}
+
+func TestDirFiles(t *testing.T) {
+	storePath := makeStore(t, "work/foo.gpg", "work/ci/bar.gpg", "home/baz.gpg", "qux.gpg")
+	defer os.RemoveAll(storePath)
+
+	fs, err := newPassFS(storePath, "", PassFsOptions{ContentFiles: true,
+		DirFiles: []string{"work=first-line,toml", "work/ci=contents", "home/=framed"}})
+	if err != nil {
+		t.Fatalf("Error creating filesystem: %s", err)
+	}
+	work := lookUp(t, fs, fuseops.RootInodeID, "work")
+	expected := map[fuseops.InodeID][]string{
+		fuseops.RootInodeID:       {"home", "qux.contents", "work"},
+		work:                      {"ci", "foo.first-line", "foo.toml"},
+		lookUp(t, fs, work, "ci"): {"bar.contents"},
+		lookUp(t, fs, fuseops.RootInodeID, "home"): {"baz.framed"},
+	}
+	for inode, names := range expected {
+		actual := readDirNames(t, fs, inode, 0)
+		if strings.Join(actual, " ") != strings.Join(names, " ") {
+			t.Errorf("Expected entries %v, got %v", names, actual)
+		}
+	}
+
+	for _, dirFiles := range []string{"work", "work=", "work=contents,foo"} {
+		_, err = newPassFS(storePath, "", PassFsOptions{ContentFiles: true, DirFiles: []string{dirFiles}})
+		if err == nil {
+			t.Errorf("Expected an error for directory file types %q", dirFiles)
+		}
+	}
+}
+
+func TestTarExport(t *testing.T) {
+	storePath := makeStore(t, "a.gpg", "b.gpg", "work/c.gpg", "work/d.gpg", "work/ci/e.gpg", "f.gpg")
+	defer os.RemoveAll(storePath)
+	secrets := map[string]string{"a": "foo\n", "b": "", "work/c": strings.Repeat("bar", 100), "work/d": "baz\nqux\n",
+		"work/ci/e": "e", "f": "f\n"}
+	setSecrets(secrets)
+	defer setSecrets(map[string]string{})
+
+	fs, err := newPassFS(storePath, "", PassFsOptions{ContentFiles: true, TarExport: true})
+	if err != nil {
+		t.Fatalf("Error creating filesystem: %s", err)
+	}
+	inode := lookUp(t, fs, lookUp(t, fs, fuseops.RootInodeID, controlDirName), tarExportName)
+	openOp := fuseops.OpenFileOp{Inode: inode}
+	err = fs.OpenFile(context.Background(), &openOp)
+	if err != nil {
+		t.Fatalf("Error opening %s: %s", tarExportName, err)
+	}
+	if !openOp.UseDirectIO {
+		t.Errorf("Expected direct I/O for %s", tarExportName)
+	}
+	defer fs.ReleaseFileHandle(context.Background(), &fuseops.ReleaseFileHandleOp{Handle: openOp.Handle})
+
+	var archive bytes.Buffer
+	for {
+		op := fuseops.ReadFileOp{Inode: inode, Handle: openOp.Handle, Offset: int64(archive.Len()),
+			Dst: make([]byte, 100)}
+		err = fs.ReadFile(context.Background(), &op)
+		if err != nil {
+			t.Fatalf("Error reading %s: %s", tarExportName, err)
+		}
+		if op.BytesRead == 0 {
+			break
+		}
+		archive.Write(op.Dst[:op.BytesRead])
+	}
+
+	reader := tar.NewReader(&archive)
+	var names []string
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("Error reading archive: %s", err)
+		}
+		content, err := ioutil.ReadAll(reader)
+		if err != nil {
+			t.Fatalf("Error reading %s from archive: %s", header.Name, err)
+		}
+		if string(content) != secrets[header.Name] {
+			t.Errorf("Expected %q for %s, got %q", secrets[header.Name], header.Name, content)
+		}
+		names = append(names, header.Name)
+	}
+	expectedNames := "a b f work/c work/ci/e work/d"
+	if strings.Join(names, " ") != expectedNames {
+		t.Errorf("Expected archive entries %s, got %v", expectedNames, names)
+	}
+
+	delete(secrets, "a")
+	_, err = readFile(fs, inode)
+	if !errors.Is(err, syscall.ENOENT) {
+		t.Errorf("Expected ENOENT for exporting a secret failing to decrypt, got %v", err)
+	}
+}
+
+func TestTemplates(t *testing.T) {
+	storePath := makeStore(t, "app/config.gpg", "app/config.tmpl", "app/broken.gpg", "app/broken.tmpl")
+	defer os.RemoveAll(storePath)
+	for name, content := range map[string]string{
+		"app/config.tmpl": "user = {{ .fields.username }}\npassword = {{ .password }}\n",
+		"app/broken.tmpl": "url = {{ .fields.url }}\n",
+	} {
+		err := ioutil.WriteFile(path.Join(storePath, name), []byte(content), 0600)
+		if err != nil {
+			t.Fatalf("Error writing template %s: %s", name, err)
+		}
+	}
+	setSecrets(map[string]string{"app/config": "hunter2\nusername: foo\n", "app/broken": "hunter2\n"})
+	defer setSecrets(map[string]string{})
+
+	fs, err := newPassFS(storePath, "", PassFsOptions{ContentFiles: true, Templates: true, ShowControl: true})
+	if err != nil {
+		t.Fatalf("Error creating filesystem: %s", err)
+	}
+	app := lookUp(t, fs, fuseops.RootInodeID, "app")
+	names := strings.Join(readDirNames(t, fs, app, 0), " ")
+	if names != "broken.contents config.contents broken config" {
+		t.Errorf("Expected rendered templates next to the secrets, got %s", names)
+	}
+
+	content, err := readFile(fs, lookUp(t, fs, app, "config"))
+	if err != nil {
+		t.Fatalf("Error reading rendered template: %s", err)
+	}
+	expected := "user = foo\npassword = hunter2\n"
+	if content != expected {
+		t.Errorf("Expected rendered template %q, got %q", expected, content)
+	}
+
+	err = fs.LookUpInode(context.Background(), &fuseops.LookUpInodeOp{Parent: app, Name: "broken"})
+	if !errors.Is(err, syscall.EIO) {
+		t.Errorf("Expected EIO for a template using a missing field, got %v", err)
+	}
+	lastError, _ := readFile(fs, lookUp(t, fs, lookUp(t, fs, fuseops.RootInodeID, controlDirName), lastErrorName))
+	if !strings.Contains(lastError, "app/broken.tmpl") || !strings.Contains(lastError, "url") {
+		t.Errorf("Expected the last error to describe the template failure, got %q", lastError)
+	}
+}
+
+func TestLowercaseNames(t *testing.T) {
+	storePath := makeStore(t, "Work/GitHub.gpg", "Work/CI/Token.gpg", "Mail.gpg", "mail.gpg")
+	defer os.RemoveAll(storePath)
+	setSecrets(map[string]string{"Work/GitHub": "hunter2\n", "Work/CI/Token": "t", "Mail": "foo\n", "mail": "bar\n"})
+	defer setSecrets(map[string]string{})
+
+	options := PassFsOptions{ContentFiles: true, LowercaseNames: true}
+	fs, err := newPassFS(storePath, "", options)
+	if err != nil {
+		t.Fatalf("Error creating filesystem: %s", err)
+	}
+	work := lookUp(t, fs, fuseops.RootInodeID, "work")
+	names := strings.Join(readDirNames(t, fs, work, 0), " ")
+	if names != "ci github.contents" {
+		t.Errorf("Expected lowercased names, got %s", names)
+	}
+	lookUp(t, fs, lookUp(t, fs, work, "ci"), "token.contents")
+	content, err := readFile(fs, lookUp(t, fs, work, "github.contents"))
+	if err != nil || content != "hunter2\n" {
+		t.Errorf("Expected the content of Work/GitHub, got %q, error %v", content, err)
+	}
+
+	collisions, err := FindNameCollisions(storePath, "", options)
+	if err != nil {
+		t.Fatalf("Error finding collisions: %s", err)
+	}
+	if strings.Join(collisions, " ") != "mail.contents" {
+		t.Errorf("Expected a collision of Mail.gpg and mail.gpg, got %v", collisions)
+	}
+
+	// Entries whose names only differ by case are handled by the name collision policy.
+	options.NameCollisions = collisionSkip
+	fs, err = newPassFS(storePath, "", options)
+	if err != nil {
+		t.Fatalf("Error creating filesystem: %s", err)
+	}
+	names = strings.Join(readDirNames(t, fs, fuseops.RootInodeID, 0), " ")
+	if names != "mail.contents work" {
+		t.Errorf("Expected one entry for Mail.gpg and mail.gpg, got %s", names)
+	}
+	options.NameCollisions = collisionError
+	_, err = newPassFS(storePath, "", options)
+	if err == nil {
+		t.Errorf("Expected entries whose names only differ by case to be refused with the error policy")
+	}
+}
+
+func TestShowRecipients(t *testing.T) {
+	storePath := makeStore(t, "work/github.gpg", "work/ops/deploy.gpg")
+	defer os.RemoveAll(storePath)
+	for dir, recipients := range map[string]string{"": "me@example.com\n", "work/ops": "ops@example.com\n"} {
+		err := ioutil.WriteFile(path.Join(storePath, dir, ".gpg-id"), []byte(recipients), 0600)
+		if err != nil {
+			t.Fatalf("Error writing .gpg-id: %s", err)
+		}
+	}
+	// Nothing is decrypted for the recipients.
+	decrypted := 0
+	pass.SetCommandRunner(func(name string, args ...string) (io.ReadCloser, error) {
+		decrypted++
+		return ioutil.NopCloser(strings.NewReader("")), nil
+	})
+	defer setSecrets(map[string]string{})
+
+	for prefix, expected := range map[string]string{"": "me@example.com\n", "work": "me@example.com\n",
+		"work/ops": "ops@example.com\n"} {
+		fs, err := newPassFS(storePath, prefix, PassFsOptions{ContentFiles: true, ShowRecipients: true})
+		if err != nil {
+			t.Fatalf("Error creating filesystem: %s", err)
+		}
+		content, err := readFile(fs, lookUp(t, fs, lookUp(t, fs, fuseops.RootInodeID, controlDirName), recipientsName))
+		if err != nil {
+			t.Fatalf("Error reading recipients: %s", err)
+		}
+		if content != expected {
+			t.Errorf("Expected recipients %q with prefix %q, got %q", expected, prefix, content)
+		}
+	}
+	if decrypted != 0 {
+		t.Errorf("Expected no secrets to be decrypted, %d were", decrypted)
+	}
+}
+
+// partialOutput is the output of a show command for a large secret, recording how much of it has been read and
+// whether it has been closed.
+type partialOutput struct {
+	size   int64
+	read   *int64
+	closed *bool
+}
+
+func (o partialOutput) Read(p []byte) (int, error) {
+	if *o.read >= o.size {
+		return 0, io.EOF
+	}
+	n := int64(len(p))
+	if n > o.size-*o.read {
+		n = o.size - *o.read
+	}
+	for i := range p[:n] {
+		p[i] = 'x'
+	}
+	*o.read += n
+	return int(n), nil
+}
+
+func (o partialOutput) Close() error {
+	*o.closed = true
+	return nil
+}
+
+func TestPartialRead(t *testing.T) {
+	storePath := makeStore(t, "large.gpg")
+	defer os.RemoveAll(storePath)
+	const secretSize = 10 << 20
+	var read int64
+	var closed bool
+	pass.SetCommandRunner(func(name string, args ...string) (io.ReadCloser, error) {
+		read = 0
+		closed = false
+		return partialOutput{size: secretSize, read: &read, closed: &closed}, nil
+	})
+	defer setSecrets(map[string]string{})
+
+	fs, err := newPassFS(storePath, "", PassFsOptions{ContentFiles: true})
+	if err != nil {
+		t.Fatalf("Error creating filesystem: %s", err)
+	}
+	inode := lookUp(t, fs, fuseops.RootInodeID, "large.contents")
+	for _, opened := range []bool{false, true} {
+		op := fuseops.ReadFileOp{Inode: inode, Dst: make([]byte, 512)}
+		if opened {
+			openOp := fuseops.OpenFileOp{Inode: inode}
+			err = fs.OpenFile(context.Background(), &openOp)
+			if err != nil {
+				t.Fatalf("Error opening file: %s", err)
+			}
+			op.Handle = openOp.Handle
+		}
+		err = fs.ReadFile(context.Background(), &op)
+		if err != nil {
+			t.Fatalf("Error reading file: %s", err)
+		}
+		if op.BytesRead != 512 {
+			t.Errorf("Expected to read 512 bytes, read %d", op.BytesRead)
+		}
+		// Reading more than the pipe buffer of a command would mean the rest of the secret is being buffered.
+		if read > 64<<10 {
+			t.Errorf("Expected a 512 byte read with an open handle %t to stop reading the secret early, read %d "+
+				"bytes", opened, read)
+		}
+		if !opened && !closed {
+			t.Errorf("Expected the show command to be stopped after reading without an open handle")
+		}
+		if opened {
+			fs.ReleaseFileHandle(context.Background(), &fuseops.ReleaseFileHandleOp{Handle: op.Handle})
+			if !closed {
+				t.Errorf("Expected the show command to be stopped when releasing the handle")
+			}
+		}
+	}
+}
+
+func TestByDate(t *testing.T) {
+	storePath := makeStore(t, "work/github.gpg", "work/aws.gpg", "personal/mail.gpg", "personal/bank.gpg")
+	defer os.RemoveAll(storePath)
+	secrets := map[string]string{
+		"work/github":   "hunter2\nRotated: 2024-03-14\n",
+		"work/aws":      "hunter3\nrotated: 2024-03-01T10:00:00Z\n",
+		"personal/mail": "hunter4\n",
+		"personal/bank": "hunter5\nrotated: last spring\n",
+	}
+	decrypted := 0
+	pass.SetCommandRunner(func(name string, args ...string) (io.ReadCloser, error) {
+		decrypted++
+		return ioutil.NopCloser(strings.NewReader(secrets[args[len(args)-1]])), nil
+	})
+	defer setSecrets(map[string]string{})
+
+	fs, err := newPassFS(storePath, "", PassFsOptions{ContentFiles: true, ByDate: "rotated"})
+	if err != nil {
+		t.Fatalf("Error creating filesystem: %s", err)
+	}
+	byDate := lookUp(t, fs, fuseops.RootInodeID, dateDirName)
+	expected := map[string]string{"": "2024-03 unknown", "2024-03": "aws github", "unknown": "bank mail"}
+	for dir, names := range expected {
+		inode := byDate
+		if dir != "" {
+			inode = lookUp(t, fs, byDate, dir)
+		}
+		actual := strings.Join(readDirNames(t, fs, inode, 0), " ")
+		if actual != names {
+			t.Errorf("Expected entries %s in %s, got %s", names, dir, actual)
+		}
+	}
+	readOp := fuseops.ReadSymlinkOp{Inode: lookUp(t, fs, lookUp(t, fs, byDate, "2024-03"), "github")}
+	err = fs.ReadSymlink(context.Background(), &readOp)
+	if err != nil {
+		t.Fatalf("Error reading symlink: %s", err)
+	}
+	if readOp.Target != "../../work/github.contents" {
+		t.Errorf("Expected the link to point to the content file, got %s", readOp.Target)
+	}
+
+	// Unchanged secrets aren't decrypted again when refreshing.
+	decrypted = 0
+	err = fs.refresh()
+	if err != nil {
+		t.Fatalf("Error refreshing: %s", err)
+	}
+	if decrypted != 0 {
+		t.Errorf("Expected no decryptions for unchanged secrets, got %d", decrypted)
+	}
+}
+
+func TestSingleSecret(t *testing.T) {
+	storePath := makeStore(t, "work/github.gpg", "work/gitlab.gpg", "mail.gpg")
+	defer os.RemoveAll(storePath)
+	setSecrets(map[string]string{"work/github": "hunter2\nusername: foo\n"})
+	defer setSecrets(map[string]string{})
+
+	fs, err := newPassFS(storePath, "", PassFsOptions{ContentFiles: true, FirstLineFiles: true,
+		SingleSecret: "/work/github.gpg"})
+	if err != nil {
+		t.Fatalf("Error creating filesystem: %s", err)
+	}
+	names := strings.Join(readDirNames(t, fs, fuseops.RootInodeID, 0), " ")
+	if names != "github.contents github.first-line" {
+		t.Errorf("Expected only the files of the secret at the root, got %s", names)
+	}
+	content, err := readFile(fs, lookUp(t, fs, fuseops.RootInodeID, "github.contents"))
+	if err != nil || content != "hunter2\nusername: foo\n" {
+		t.Errorf("Expected the content of the secret, got %q and %v", content, err)
+	}
+
+	_, err = newPassFS(storePath, "", PassFsOptions{ContentFiles: true, SingleSecret: "work/missing"})
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected mounting a missing secret to fail, got %v", err)
+	}
+}
+
+func TestNameCollisions(t *testing.T) {
+	storePath := makeStore(t, "work/github.gpg", "work/github/token.gpg")
+	defer os.RemoveAll(storePath)
+	setSecrets(map[string]string{"work/github": "hunter2\nusername: foo\n", "work/github/token": "t0k3n\n"})
+	defer setSecrets(map[string]string{})
+
+	tests := []struct {
+		policy   string
+		expected string
+	}{
+		{policy: "", expected: "github github"},
+		{policy: collisionSuffix, expected: "github.dir github"},
+		{policy: collisionSkip, expected: "github"},
+	}
+	for _, test := range tests {
+		fs, err := newPassFS(storePath, "", PassFsOptions{ContentFiles: true, FieldDirs: true,
+			NameCollisions: test.policy})
+		if err != nil {
+			t.Fatalf("Error creating filesystem with policy %q: %s", test.policy, err)
+		}
+		work := lookUp(t, fs, fuseops.RootInodeID, "work")
+		names := strings.Join(readDirNames(t, fs, work, 0), " ")
+		if names != test.expected {
+			t.Errorf("Expected entries %s with policy %q, got %s", test.expected, test.policy, names)
+		}
+		if test.policy == "" {
+			continue
+		}
+		username, err := readFile(fs, lookUp(t, fs, lookUp(t, fs, work, "github"), "username"))
+		if err != nil || username != "foo" {
+			t.Errorf("Expected the field directory of the secret with policy %q, got %q and %v", test.policy,
+				username, err)
+		}
+	}
+
+	fs, err := newPassFS(storePath, "", PassFsOptions{ContentFiles: true, FieldDirs: true,
+		NameCollisions: collisionSuffix})
+	if err != nil {
+		t.Fatalf("Error creating filesystem: %s", err)
+	}
+	dir := lookUp(t, fs, lookUp(t, fs, fuseops.RootInodeID, "work"), "github.dir")
+	if names := strings.Join(readDirNames(t, fs, dir, 0), " "); names != "token" {
+		t.Errorf("Expected the directory of the store with a suffix, got %s", names)
+	}
+
+	_, err = newPassFS(storePath, "", PassFsOptions{ContentFiles: true, FieldDirs: true,
+		NameCollisions: collisionError})
+	if err == nil || !strings.Contains(err.Error(), "work/github") {
+		t.Errorf("Expected mounting with colliding names to fail, got %v", err)
+	}
+	_, err = newPassFS(storePath, "", PassFsOptions{ContentFiles: true, NameCollisions: collisionError})
+	if err != nil {
+		t.Errorf("Expected mounting without colliding names to succeed, got %v", err)
+	}
+}
+
+func TestSearch(t *testing.T) {
+	storePath := makeStore(t, "work/github.gpg", "work/GitLab.gpg", "personal/github.gpg", "mail.gpg")
+	defer os.RemoveAll(storePath)
+
+	fs, err := newPassFS(storePath, "", PassFsOptions{ContentFiles: true, EnableSearch: true})
+	if err != nil {
+		t.Fatalf("Error creating filesystem: %s", err)
+	}
+	search := lookUp(t, fs, lookUp(t, fs, fuseops.RootInodeID, controlDirName), searchName)
+	content, err := readFile(fs, search)
+	if err != nil || content != "" {
+		t.Errorf("Expected no results without a query, got %q and %v", content, err)
+	}
+
+	tests := []struct {
+		query    string
+		expected string
+	}{
+		{query: "GIT\n", expected: "personal/github\nwork/GitLab\nwork/github\n"},
+		{query: "work git", expected: "work/GitLab\nwork/github\n"},
+		{query: "hub per", expected: "personal/github\n"},
+		{query: "missing", expected: ""},
+	}
+	size := uint64(0)
+	for _, test := range tests {
+		err = fs.SetInodeAttributes(context.Background(), &fuseops.SetInodeAttributesOp{Inode: search, Size: &size})
+		if err != nil {
+			t.Fatalf("Error truncating search file: %s", err)
+		}
+		err = fs.WriteFile(context.Background(), &fuseops.WriteFileOp{Inode: search, Data: []byte(test.query)})
+		if err != nil {
+			t.Fatalf("Error writing search query: %s", err)
+		}
+		content, err = readFile(fs, search)
+		if err != nil || content != test.expected {
+			t.Errorf("Expected results %q for query %q, got %q and %v", test.expected, test.query, content, err)
+		}
+	}
+
+	err = fs.WriteFile(context.Background(), &fuseops.WriteFileOp{Inode: search, Data: []byte("mail")})
+	if err != nil {
+		t.Fatalf("Error writing search query: %s", err)
+	}
+	err = fs.WriteFile(context.Background(), &fuseops.WriteFileOp{Inode: search, Data: []byte(" hub"), Offset: 4})
+	if err != nil {
+		t.Fatalf("Error writing search query: %s", err)
+	}
+	content, _ = readFile(fs, search)
+	if content != "" {
+		t.Errorf("Expected a query written in parts to be matched as a whole, got %q", content)
+	}
+}
+
+func TestHideSizes(t *testing.T) {
+	storePath := makeStore(t, "work/github.gpg")
+	defer os.RemoveAll(storePath)
+	decrypted := 0
+	pass.SetCommandRunner(func(name string, args ...string) (io.ReadCloser, error) {
+		decrypted++
+		return ioutil.NopCloser(strings.NewReader("hunter2\nusername: foo\n")), nil
+	})
+	defer setSecrets(map[string]string{})
+
+	fs, err := newPassFS(storePath, "", PassFsOptions{ContentFiles: true, FirstLineFiles: true, HideSizes: true})
+	if err != nil {
+		t.Fatalf("Error creating filesystem: %s", err)
+	}
+	work := lookUp(t, fs, fuseops.RootInodeID, "work")
+	op := fuseops.LookUpInodeOp{Parent: work, Name: "github.first-line"}
+	err = fs.LookUpInode(context.Background(), &op)
+	if err != nil {
+		t.Fatalf("Error looking up first line file: %s", err)
+	}
+	if op.Entry.Attributes.Size != 0 || decrypted != 0 {
+		t.Errorf("Expected size 0 without decrypting, got %d after decrypting %d times", op.Entry.Attributes.Size,
+			decrypted)
+	}
+	open := fuseops.OpenFileOp{Inode: op.Entry.Child}
+	err = fs.OpenFile(context.Background(), &open)
+	if err != nil || !open.UseDirectIO {
+		t.Errorf("Expected reads of the first line file to bypass the size, got %v", err)
+	}
+	content, err := readFile(fs, op.Entry.Child)
+	if err != nil || content != "hunter2" {
+		t.Errorf("Expected reading the first line file to return the password, got %q and %v", content, err)
+	}
+
+	contents := fuseops.LookUpInodeOp{Parent: work, Name: "github.contents"}
+	err = fs.LookUpInode(context.Background(), &contents)
+	if err != nil || contents.Entry.Attributes.Size != 22 {
+		t.Errorf("Expected the size of the contents file, got %d and %v", contents.Entry.Attributes.Size, err)
+	}
+
+	fs, err = newPassFS(storePath, "", PassFsOptions{FieldDirs: true, HideSizes: true})
+	if err != nil {
+		t.Fatalf("Error creating filesystem: %s", err)
+	}
+	github := lookUp(t, fs, lookUp(t, fs, fuseops.RootInodeID, "work"), "github")
+	for field, size := range map[string]uint64{"password": 0, "username": 3} {
+		fieldOp := fuseops.LookUpInodeOp{Parent: github, Name: field}
+		err = fs.LookUpInode(context.Background(), &fieldOp)
+		if err != nil || fieldOp.Entry.Attributes.Size != size {
+			t.Errorf("Expected size %d of field %s, got %d and %v", size, field, fieldOp.Entry.Attributes.Size, err)
+		}
+	}
+}
+
+func TestOpTimeout(t *testing.T) {
+	storePath := makeStore(t, "work/github.gpg")
+	defer os.RemoveAll(storePath)
+	setSecrets(map[string]string{})
+	defer setSecrets(map[string]string{})
+
+	fs, err := newPassFS(storePath, "", PassFsOptions{FieldDirs: true, OpTimeout: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Error creating filesystem: %s", err)
+	}
+	work := lookUp(t, fs, fuseops.RootInodeID, "work")
+	github := lookUp(t, fs, work, "github")
+
+	// Simulate a show command which is slower than the operation timeout, for the listing of a field directory.
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	pass.SetCommandRunner(func(name string, args ...string) (io.ReadCloser, error) {
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+		<-release
+		return ioutil.NopCloser(strings.NewReader("hunter2\nusername: foo\nurl: https://github.com\n")), nil
+	})
+
+	timed := opTimeoutFS{fs}
+	op := fuseops.ReadDirOp{Inode: github, Dst: make([]byte, 4096)}
+	start := time.Now()
+	err = timed.ReadDir(context.Background(), &op)
+	if err != syscall.EIO {
+		t.Errorf("Expected EIO for a listing taking longer than the operation timeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the listing to fail after the operation timeout, took %s", elapsed)
+	}
+	if op.BytesRead != 0 {
+		t.Errorf("Expected no entries for a listing which timed out, got %d bytes", op.BytesRead)
+	}
+
+	<-started
+	close(release)
+	op = fuseops.ReadDirOp{Inode: github, Dst: make([]byte, 4096)}
+	err = timed.ReadDir(context.Background(), &op)
+	if err != nil {
+		t.Fatalf("Error reading directory after the show command finished: %s", err)
+	}
+	names := readDirNames(t, fs, github, 0)
+	if strings.Join(names, " ") != "password url username" {
+		t.Errorf("Expected files for the fields, got %v", names)
+	}
+}
+
+func TestStoreUnavailable(t *testing.T) {
+	storePath := makeStore(t, "foo.gpg")
+	defer os.RemoveAll(storePath)
+	setSecrets(map[string]string{"foo": "hunter2\n"})
+
+	fs, err := newPassFS(storePath, "", PassFsOptions{ContentFiles: true})
+	if err != nil {
+		t.Fatalf("Error creating filesystem: %s", err)
+	}
+	inode := lookUp(t, fs, fuseops.RootInodeID, "foo.contents")
+
+	// Once the store is moved, the show command fails as if the secret didn't exist.
+	movedPath := storePath + "-moved"
+	err = os.Rename(storePath, movedPath)
+	if err != nil {
+		t.Fatalf("Error moving store: %s", err)
+	}
+	defer os.RemoveAll(movedPath)
+	setSecrets(map[string]string{})
+	defer setSecrets(map[string]string{})
+
+	_, err = readFile(fs, inode)
+	if err != syscall.EIO {
+		t.Errorf("Expected EIO reading from a moved store, got %v", err)
+	}
+	if !strings.Contains(fs.lastError, pass.ErrStoreUnavailable.Error()) {
+		t.Errorf("Expected the last error to say the store isn't available, got %q", fs.lastError)
+	}
+	err = fs.refresh()
+	if !strings.Contains(fmt.Sprint(err), pass.ErrStoreUnavailable.Error()) {
+		t.Errorf("Expected rebuilding to fail as the store isn't available, got %v", err)
+	}
+}
+
+func TestFollowStoreLink(t *testing.T) {
+	first := makeStore(t, "foo.gpg")
+	defer os.RemoveAll(first)
+	second := makeStore(t, "bar.gpg")
+	defer os.RemoveAll(second)
+	linkDir, err := ioutil.TempDir("", "passfuse-test")
+	if err != nil {
+		t.Fatalf("Error creating directory: %s", err)
+	}
+	defer os.RemoveAll(linkDir)
+	link := path.Join(linkDir, "store")
+	err = os.Symlink(first, link)
+	if err != nil {
+		t.Fatalf("Error linking store: %s", err)
+	}
+
+	fs, err := newPassFS(link, "", PassFsOptions{ContentFiles: true})
+	if err != nil {
+		t.Fatalf("Error creating filesystem: %s", err)
+	}
+	err = os.Remove(link)
+	if err == nil {
+		err = os.Symlink(second, link)
+	}
+	if err != nil {
+		t.Fatalf("Error retargeting store link: %s", err)
+	}
+
+	err = fs.refresh()
+	if err == nil {
+		t.Fatal("Expected rebuilding to fail after the store link was retargeted")
+	}
+	names := readDirNames(t, fs, fuseops.RootInodeID, 0)
+	if strings.Join(names, " ") != "foo.contents" {
+		t.Errorf("Expected the mounted tree to be kept, got %v", names)
+	}
+
+	err = fs.reload(PassFsOptions{ContentFiles: true, FollowStoreLink: true})
+	if err != nil {
+		t.Fatalf("Error following the store link: %s", err)
+	}
+	names = readDirNames(t, fs, fuseops.RootInodeID, 0)
+	if strings.Join(names, " ") != "bar.contents" {
+		t.Errorf("Expected the tree of the new store, got %v", names)
+	}
+}
+
+func TestDemoSource(t *testing.T) {
+	pass.SetCommandRunner(func(name string, args ...string) (io.ReadCloser, error) {
+		t.Errorf("Unexpected command %s %v", name, args)
+		return nil, syscall.ENOENT
+	})
+	defer setSecrets(map[string]string{})
+	defer pass.SetSource(nil)
+
+	server, err := NewPassFS("", "", PassFsOptions{ContentFiles: true, FirstLineFiles: true}, pass.NewDemoSource())
+	if err != nil {
+		t.Fatalf("Error creating filesystem: %s", err)
+	}
+	fs := server.fs
+
+	work := lookUp(t, fs, fuseops.RootInodeID, "work")
+	names := readDirNames(t, fs, work, 0)
+	expected := "database.contents database.first-line github.contents github.first-line vpn.contents vpn.first-line"
+	if strings.Join(names, " ") != expected {
+		t.Errorf("Expected files for the synthetic secrets, got %v", names)
+	}
+	content, err := readFile(fs, lookUp(t, fs, work, "github.first-line"))
+	if err != nil {
+		t.Fatalf("Error reading synthetic secret: %s", err)
+	}
+	if content != "hunter2" {
+		t.Errorf("Expected the password of the synthetic secret, got %q", content)
+	}
+}
+
+func TestOverlay(t *testing.T) {
+	storePath := makeStore(t, "foo.gpg", "work/github.gpg")
+	defer os.RemoveAll(storePath)
+	setSecrets(map[string]string{"foo": "hunter2\n", "work/github": "s3cr3t\n"})
+	overlay := makeStore(t, "config.yml", "foo.contents", "work/notes.txt", "extra/deep.txt")
+	defer os.RemoveAll(overlay)
+	err := ioutil.WriteFile(path.Join(overlay, "config.yml"), []byte("token: placeholder\n"), 0644)
+	if err != nil {
+		t.Fatalf("Error writing overlay file: %s", err)
+	}
+
+	fs, err := newPassFS(storePath, "", PassFsOptions{ContentFiles: true, Overlay: overlay})
+	if err != nil {
+		t.Fatalf("Error creating filesystem: %s", err)
+	}
+	names := readDirNames(t, fs, fuseops.RootInodeID, 0)
+	if strings.Join(names, " ") != "foo.contents work config.yml extra" {
+		t.Errorf("Expected the entries of the overlay after the secrets, got %v", names)
+	}
+	content, err := readFile(fs, lookUp(t, fs, fuseops.RootInodeID, "foo.contents"))
+	if err != nil || content != "hunter2\n" {
+		t.Errorf("Expected the secret to take precedence over the overlay, got %q, error %v", content, err)
+	}
+
+	op := fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID, Name: "config.yml"}
+	err = fs.LookUpInode(context.Background(), &op)
+	if err != nil {
+		t.Fatalf("Error looking up overlay file: %s", err)
+	}
+	if op.Entry.Attributes.Size != uint64(len("token: placeholder\n")) || op.Entry.Attributes.Mode != 0400 {
+		t.Errorf("Expected the size and read-only mode of the overlay file, got %d and %s",
+			op.Entry.Attributes.Size, op.Entry.Attributes.Mode)
+	}
+	content, err = readFile(fs, op.Entry.Child)
+	if err != nil || content != "token: placeholder\n" {
+		t.Errorf("Expected the content of the overlay file, got %q, error %v", content, err)
+	}
+
+	work := lookUp(t, fs, fuseops.RootInodeID, "work")
+	names = readDirNames(t, fs, work, 0)
+	if strings.Join(names, " ") != "github.contents notes.txt" {
+		t.Errorf("Expected the overlay directory to be merged with the store directory, got %v", names)
+	}
+	extra := lookUp(t, fs, fuseops.RootInodeID, "extra")
+	names = readDirNames(t, fs, extra, 0)
+	if strings.Join(names, " ") != "deep.txt" {
+		t.Errorf("Expected the entries of a directory only in the overlay, got %v", names)
+	}
+}
+
+func TestConcurrentSizeLookups(t *testing.T) {
+	storePath := makeStore(t, "foo.gpg", "bar.gpg")
+	defer os.RemoveAll(storePath)
+	setSecrets(map[string]string{"foo": "hunter2\n"})
+	defer setSecrets(map[string]string{})
+
+	fs, err := newPassFS(storePath, "", PassFsOptions{ContentFiles: true})
+	if err != nil {
+		t.Fatalf("Error creating filesystem: %s", err)
+	}
+	inode := lookUp(t, fs, fuseops.RootInodeID, "foo.contents")
+	fs.clearDecryptions()
+
+	// Simulate a show command for foo waiting for a passphrase.
+	var calls int32
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	pass.SetCommandRunner(func(name string, args ...string) (io.ReadCloser, error) {
+		if args[len(args)-1] != "foo" {
+			return ioutil.NopCloser(strings.NewReader("swordfish\n")), nil
+		}
+		atomic.AddInt32(&calls, 1)
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+		<-release
+		return ioutil.NopCloser(strings.NewReader("hunter2\n")), nil
+	})
+
+	sizes := make(chan uint64, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			size, err := fs.getSize(inode)
+			if err != nil {
+				t.Errorf("Error getting size: %s", err)
+			}
+			sizes <- size
+		}()
+	}
+	<-started
+	// Lookups of other secrets don't wait for the decryption.
+	lookUp(t, fs, fuseops.RootInodeID, "bar.contents")
+	close(release)
+	for i := 0; i < 2; i++ {
+		if size := <-sizes; size != uint64(len("hunter2\n")) {
+			t.Errorf("Unexpected size %d", size)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("Expected concurrent size lookups to decrypt the secret once, decrypted %d times", calls)
+	}
+}
@@ -0,0 +1,31 @@
+package fs
+
+import (
+	"github.com/jacobsa/fuse/fuseutil"
+	"strings"
+)
+
+// lowercaseNames lowercases the names of the entries of a directory if names are lowercased, leaving the secrets they
+// read as they are. It's applied before resolving collisions, so that entries whose names only differ by case are
+// handled by the name collision policy like other entries with the same name.
+func (fs *passFS) lowercaseNames(children []fuseutil.Dirent) {
+	for i := range children {
+		children[i].Name = fs.entryName(children[i].Name)
+	}
+}
+
+// entryName returns the name of an entry, which is lowercased if names are.
+func (fs *passFS) entryName(name string) string {
+	if fs.options.LowercaseNames {
+		return strings.ToLower(name)
+	}
+	return name
+}
+
+// displayedPath returns how a path relative to the mount point is displayed, which is lowercased if names are.
+func (options PassFsOptions) displayedPath(entryPath string) string {
+	if options.LowercaseNames {
+		return strings.ToLower(entryPath)
+	}
+	return entryPath
+}
@@ -0,0 +1,41 @@
+package fs
+
+import (
+	"github.com/femnad/passfuse/pkg/pass"
+	"log"
+	"os/exec"
+	"time"
+)
+
+// Minimum time between notifications, so that listing a directory doesn't send a notification per secret
+const notificationInterval = time.Minute
+
+var notify = sendNotification
+
+// sendNotification shows a desktop notification without waiting for it to be dismissed.
+func sendNotification(message string) error {
+	cmd := exec.Command("notify-send", "--app-name=passfuse", "passfuse", message)
+	err := cmd.Start()
+	if err != nil {
+		return err
+	}
+	go cmd.Wait()
+	return nil
+}
+
+// notifyAgentLocked sends a desktop notification about the GPG agent being unable to ask for a passphrase, if
+// notifications are enabled and one hasn't been sent recently.
+func (fs *passFS) notifyAgentLocked() {
+	fs.mutex.Lock()
+	if !fs.options.Notify || time.Since(fs.lastNotification) < notificationInterval {
+		fs.mutex.Unlock()
+		return
+	}
+	fs.lastNotification = time.Now()
+	fs.mutex.Unlock()
+
+	err := notify(pass.ErrAgentLocked.Error())
+	if err != nil {
+		log.Printf("Error sending notification: %s", err)
+	}
+}
@@ -0,0 +1,90 @@
+package fs
+
+import (
+	"context"
+	"fmt"
+	"github.com/jacobsa/fuse/fuseops"
+	"log"
+	"syscall"
+	"time"
+)
+
+// opTimeoutFS fails the operations which may run commands with EIO if they don't finish within the operation timeout,
+// so that the kernel isn't blocked by an operation decrypting secrets for longer than the command timeout, e.g. when
+// retrying. An operation which times out keeps running in the background until its commands finish or time out. It
+// works on a copy of the operation, as the kernel reuses the buffers of operations once they have been replied to.
+type opTimeoutFS struct {
+	*passFS
+}
+
+// runOp calls an operation, then reply for copying its results to the operation the kernel gets, unless the operation
+// times out.
+func (fs opTimeoutFS) runOp(description string, op func() error, reply func()) error {
+	timeout := fs.getOptions().OpTimeout
+	if timeout == 0 {
+		err := op()
+		reply()
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- op()
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		reply()
+		return err
+	case <-timer.C:
+		log.Printf("Failing %s, it didn't finish within %s", description, timeout)
+		return syscall.EIO
+	}
+}
+
+func (fs opTimeoutFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) (err error) {
+	inner := *op
+	return fs.runOp("looking up "+op.Name, func() error {
+		return fs.passFS.LookUpInode(ctx, &inner)
+	}, func() {
+		*op = inner
+	})
+}
+
+func (fs opTimeoutFS) ReadDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) (err error) {
+	inner := *op
+	inner.Dst = make([]byte, len(op.Dst))
+	return fs.runOp(fmt.Sprintf("reading directory %d", op.Inode), func() error {
+		return fs.passFS.ReadDir(ctx, &inner)
+	}, func() {
+		op.BytesRead = copy(op.Dst, inner.Dst[:inner.BytesRead])
+	})
+}
+
+func (fs opTimeoutFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) (err error) {
+	inner := *op
+	inner.Dst = make([]byte, len(op.Dst))
+	return fs.runOp(fmt.Sprintf("reading file %d", op.Inode), func() error {
+		return fs.passFS.ReadFile(ctx, &inner)
+	}, func() {
+		op.BytesRead = copy(op.Dst, inner.Dst[:inner.BytesRead])
+	})
+}
+
+// WriteFile may stop the GPG agent when locking the mount.
+func (fs opTimeoutFS) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) (err error) {
+	inner := *op
+	inner.Data = append([]byte(nil), op.Data...)
+	return fs.runOp(fmt.Sprintf("writing file %d", op.Inode), func() error {
+		return fs.passFS.WriteFile(ctx, &inner)
+	}, func() {})
+}
@@ -0,0 +1,163 @@
+package fs
+
+import (
+	"fmt"
+	"github.com/femnad/passfuse/pkg/pass"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+)
+
+// openOverlay opens the overlay directory and returns the path its entries are read from. Where /proc is available
+// that's the path of the open directory in it, which keeps referring to the real directory once the filesystem is
+// mounted over it, so that the overlay can be the mount point itself.
+func openOverlay(dir string) (*os.File, string, error) {
+	file, err := os.Open(dir)
+	if err != nil {
+		return nil, "", fmt.Errorf("error opening overlay %s: %s", dir, err)
+	}
+	info, err := file.Stat()
+	if err == nil && !info.IsDir() {
+		err = fmt.Errorf("not a directory")
+	}
+	if err != nil {
+		file.Close()
+		return nil, "", fmt.Errorf("error opening overlay %s: %s", dir, err)
+	}
+	procPath := fmt.Sprintf("/proc/self/fd/%d", file.Fd())
+	_, err = os.Stat(procPath)
+	if err != nil {
+		return file, dir, nil
+	}
+	return file, procPath, nil
+}
+
+// setOverlay opens the overlay directory of the options, closing the previous one, unless it didn't change.
+func (fs *passFS) setOverlay(options PassFsOptions) error {
+	fs.mutex.RLock()
+	current := fs.options.Overlay
+	open := fs.overlayFile != nil
+	fs.mutex.RUnlock()
+	if open && options.Overlay == current {
+		return nil
+	}
+
+	var file *os.File
+	var root string
+	if options.Overlay != "" {
+		var err error
+		file, root, err = openOverlay(options.Overlay)
+		if err != nil {
+			return err
+		}
+	}
+	fs.mutex.Lock()
+	previous := fs.overlayFile
+	fs.overlayFile = file
+	fs.overlayRoot = root
+	fs.mutex.Unlock()
+	if previous != nil {
+		previous.Close()
+	}
+	return nil
+}
+
+// addOverlay adds the entries of the directory of the overlay at a path relative to the mount point to the entries of
+// the directory there, with directories of the overlay which aren't in the tree created along with their entries. The
+// entries of the tree take precedence, entries of the overlay with the same names are left out, except for
+// directories, whose entries are added to the directory of the tree. Symlinks are followed, and entries other than
+// files and directories are left out.
+func (fs *passFS) addOverlay(dirPath string, children []fuseutil.Dirent,
+	inodes map[fuseops.InodeID]inodeInfo) []fuseutil.Dirent {
+	if fs.overlayRoot == "" {
+		return children
+	}
+	realDir := path.Join(fs.overlayRoot, dirPath)
+	entries, err := ioutil.ReadDir(realDir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Not adding the entries of overlay directory %s: %s", path.Join(fs.options.Overlay, dirPath), err)
+		}
+		return children
+	}
+	for _, entry := range entries {
+		entryPath := path.Join(dirPath, entry.Name())
+		info, err := os.Stat(path.Join(realDir, entry.Name()))
+		if err != nil {
+			log.Printf("Not adding overlay entry %s: %s", path.Join(fs.options.Overlay, entryPath), err)
+			continue
+		}
+		if !info.IsDir() && !info.Mode().IsRegular() {
+			continue
+		}
+		name := fs.entryName(entry.Name())
+		id, err := findChildInode(name, children)
+		if err == nil {
+			if !info.IsDir() || !isStoreDir(inodes[id]) {
+				log.Printf("Not adding overlay entry %s, there is an entry named %s",
+					path.Join(fs.options.Overlay, entryPath), name)
+			}
+			// The entries of overlay directories are added to the directories of the tree when they are built.
+			continue
+		}
+		children = append(children, fs.getOverlayDirEnt(entryPath, info, fuseops.DirOffset(len(children)+1), inodes))
+	}
+	return children
+}
+
+func (fs *passFS) getOverlayDirEnt(entryPath string, info os.FileInfo, offset fuseops.DirOffset,
+	inodes map[fuseops.InodeID]inodeInfo) fuseutil.Dirent {
+	id := fs.allocateInode()
+	dirEnt := fuseutil.Dirent{
+		Offset: offset,
+		Inode:  id,
+		Name:   fs.entryName(info.Name()),
+		Type:   fuseutil.DT_File,
+	}
+	inode := inodeInfo{
+		attributes: fuseops.InodeAttributes{
+			Nlink: 1,
+			Mode:  info.Mode().Perm() &^ 0222,
+		},
+		inodeType:   pass.Overlay,
+		overlayPath: entryPath,
+	}
+	if info.IsDir() {
+		dirEnt.Type = fuseutil.DT_Directory
+		inode.attributes.Mode = dirPermission | os.ModeDir
+		inode.dir = true
+		inode.children = fs.addOverlay(entryPath, nil, inodes)
+	}
+	inodes[id] = inode
+	return dirEnt
+}
+
+// overlayDirPath returns the path relative to the mount point of the directory of the tree for a secret directory.
+func (fs *passFS) overlayDirPath(secretDir string) string {
+	return strings.Trim(strings.TrimPrefix(secretDir, strings.Trim(fs.prefix, "/")), "/")
+}
+
+// readOverlayFile reads a file of the overlay, which is read from the real directory even if the filesystem is
+// mounted over it.
+func (fs *passFS) readOverlayFile(inode inodeInfo) ([]byte, error) {
+	fs.mutex.RLock()
+	root := fs.overlayRoot
+	fs.mutex.RUnlock()
+	return ioutil.ReadFile(path.Join(root, inode.overlayPath))
+}
+
+// getOverlaySize returns the current size of a file of the overlay.
+func (fs *passFS) getOverlaySize(inode inodeInfo) (uint64, error) {
+	fs.mutex.RLock()
+	root := fs.overlayRoot
+	fs.mutex.RUnlock()
+	info, err := os.Stat(path.Join(root, inode.overlayPath))
+	if err != nil {
+		return 0, err
+	}
+	return uint64(info.Size()), nil
+}
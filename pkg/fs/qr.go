@@ -0,0 +1,41 @@
+package fs
+
+import (
+	"context"
+	"fmt"
+	"github.com/femnad/passfuse/pkg/pass"
+	"github.com/skip2/go-qrcode"
+	"strings"
+)
+
+// Width and height of QR code images in pixels
+const qrImageSize = 256
+
+// renderQr renders the first line of a secret, or the value of a field if one is given, as a PNG image of a QR code.
+func renderQr(ctx context.Context, secretName, field string) ([]byte, error) {
+	var value string
+	if field != "" {
+		var err error
+		value, err = getFieldValue(ctx, secretName, strings.ToLower(field))
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		body, err := pass.GetSecret(ctx, secretName)
+		if err != nil {
+			return nil, err
+		}
+		value, err = pass.GetFirstLine(body)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if value == "" {
+		return nil, fmt.Errorf("secret %s has nothing to render as a QR code", secretName)
+	}
+	image, err := qrcode.Encode(value, qrcode.Medium, qrImageSize)
+	if err != nil {
+		return nil, fmt.Errorf("error rendering QR code of secret %s: %s", secretName, err)
+	}
+	return image, nil
+}
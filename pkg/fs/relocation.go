@@ -0,0 +1,47 @@
+package fs
+
+import (
+	"fmt"
+	"github.com/femnad/passfuse/pkg/pass"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// storeError replaces an error of getting a secret from a local store with pass.ErrStoreUnavailable if the store path
+// can't be found anymore, as the show command then fails as if the secret didn't exist.
+func (fs *passFS) storeError(err error) error {
+	if err == nil || !pass.IsLocalStore() {
+		return err
+	}
+	_, statErr := os.Stat(fs.storePath)
+	if statErr != nil {
+		return fmt.Errorf("%w: %s", pass.ErrStoreUnavailable, statErr)
+	}
+	return err
+}
+
+// resolveStore records where the store path resolves to, e.g. when it's a symlink. If it resolves elsewhere than when
+// the tree was last built, as a symlink to the store was retargeted, the new target is followed with FollowStoreLink
+// and it's an error otherwise, so that the tree isn't rebuilt from a store other than the mounted one.
+func (fs *passFS) resolveStore() error {
+	if !pass.IsLocalStore() {
+		return nil
+	}
+	target, err := filepath.EvalSymlinks(fs.storePath)
+	if err != nil {
+		return fmt.Errorf("%w: %s", pass.ErrStoreUnavailable, err)
+	}
+
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	if fs.storeTarget != "" && fs.storeTarget != target {
+		if !fs.options.FollowStoreLink {
+			return fmt.Errorf("password store %s now resolves to %s rather than %s, restart passfuse or enable "+
+				"following the store link to mount it", fs.storePath, target, fs.storeTarget)
+		}
+		log.Printf("Following password store %s from %s to %s", fs.storePath, fs.storeTarget, target)
+	}
+	fs.storeTarget = target
+	return nil
+}
@@ -0,0 +1,52 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"log"
+	"syscall"
+	"time"
+)
+
+// Time to wait before retrying after a transient error
+const retryDelay = 200 * time.Millisecond
+
+// Errors which a store on a network filesystem might return while it's disconnected, and which might go away once it
+// reconnects. Commands timing out are considered transient as well, as they're usually blocked on reading the store.
+var transientErrors = []error{
+	syscall.EIO,
+	syscall.ESTALE,
+	syscall.ETIMEDOUT,
+	syscall.ENOTCONN,
+	syscall.ECONNRESET,
+	syscall.EHOSTDOWN,
+	syscall.EHOSTUNREACH,
+	context.DeadlineExceeded,
+}
+
+func isTransient(err error) bool {
+	for _, transient := range transientErrors {
+		if errors.Is(err, transient) {
+			return true
+		}
+	}
+	return false
+}
+
+// retryTransient calls a function until it succeeds, fails with an error which isn't transient, or the retries are
+// used up. The filesystem context stops retrying as well, so that unmounting doesn't wait for it. The number of
+// retries is passed in, so that an operation retries as often as the options it started with allow.
+func (fs *passFS) retryTransient(retries int, secret string, f func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := f()
+		if err == nil || !isTransient(err) || attempt >= retries {
+			return err
+		}
+		log.Printf("Retrying reading %s after %s", secret, err)
+		select {
+		case <-time.After(retryDelay):
+		case <-fs.ctx.Done():
+			return fs.ctx.Err()
+		}
+	}
+}
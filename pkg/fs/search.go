@@ -0,0 +1,76 @@
+package fs
+
+import (
+	"github.com/femnad/passfuse/pkg/pass"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+	"sort"
+	"strings"
+)
+
+const (
+	searchName       = "search"
+	searchPermission = 0600
+)
+
+// getSearchDirEnt creates the search file, which matches the query written to it against the secrets in the tree.
+func getSearchDirEnt(id fuseops.InodeID, rootNode pass.Node, inodes map[fuseops.InodeID]inodeInfo) fuseutil.Dirent {
+	dirEnt := getControlFileDirEnt(id, searchName, inodes)
+	info := inodes[id]
+	info.attributes.Mode = searchPermission
+	for _, leaf := range pass.GetLeaves(rootNode) {
+		info.secrets = append(info.secrets, leaf.Secret)
+	}
+	inodes[id] = info
+	return dirEnt
+}
+
+// writeSearchQuery sets the query of the search file to data written at the offset, so that consecutive writes of a
+// long query add to it.
+func (fs *passFS) writeSearchQuery(data []byte, offset int64) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	query := fs.searchQuery
+	if offset < int64(len(query)) {
+		query = query[:offset]
+	}
+	fs.searchQuery = query + string(data)
+}
+
+func (fs *passFS) clearSearchQuery() {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	fs.searchQuery = ""
+}
+
+// renderSearch returns the paths of the secrets matching the query relative to the mount point, one per line sorted by
+// path and without the secret suffix. Secrets match if their path contains every whitespace separated word of the
+// query, ignoring case. An empty query matches nothing.
+func (fs *passFS) renderSearch(secrets []string) []byte {
+	fs.mutex.RLock()
+	words := strings.Fields(strings.ToLower(fs.searchQuery))
+	fs.mutex.RUnlock()
+	if len(words) == 0 {
+		return nil
+	}
+
+	prefix := strings.Trim(fs.prefix, "/")
+	options := fs.getOptions()
+	var matches []string
+	for _, secret := range secrets {
+		secretPath := strings.TrimSuffix(strings.TrimPrefix(secret, prefix+"/"), pass.GetSecretSuffix())
+		folded := strings.ToLower(secretPath)
+		matched := true
+		for _, word := range words {
+			if !strings.Contains(folded, word) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			matches = append(matches, options.displayedPath(secretPath)+"\n")
+		}
+	}
+	sort.Strings(matches)
+	return []byte(strings.Join(matches, ""))
+}
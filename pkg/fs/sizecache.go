@@ -0,0 +1,162 @@
+package fs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/femnad/passfuse/pkg/pass"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+const (
+	sizeCacheDirPermission  = 0700
+	sizeCacheFilePermission = 0600
+	sizeCacheFileName       = "sizes.json"
+	// Version of the recorded sizes, entries of other versions are determined again
+	sizeCacheVersion = 2
+	// How long sizes are collected before writing them, so that looking up the sizes of many secrets writes the cache
+	// file once rather than for every secret
+	sizeCacheSaveDelay = 5 * time.Second
+)
+
+type sizeCacheEntry struct {
+	Hash    string
+	Size    pass.SecretSize
+	Version int
+}
+
+// sizeCache persists secret sizes across mounts, keyed by secret path. Entries are only valid as long as the hash of
+// the encrypted secret file matches the one recorded with the entry. Sizes are looked up concurrently, so the entries
+// have their own mutex.
+type sizeCache struct {
+	path    string
+	entries map[string]sizeCacheEntry
+	mutex   sync.Mutex
+	// Whether there are entries which haven't been written yet
+	dirty     bool
+	saveDelay time.Duration
+	saveTimer *time.Timer
+}
+
+func getSizeCachePath() string {
+	cacheHome := os.Getenv("XDG_CACHE_HOME")
+	if cacheHome == "" {
+		cacheHome = os.ExpandEnv("$HOME/.cache")
+	}
+	return path.Join(cacheHome, "passfuse", sizeCacheFileName)
+}
+
+// loadSizeCache reads the size cache. A cache file which can't be parsed, e.g. one truncated by a crash, is replaced by
+// an empty cache, as the sizes can be determined again.
+func loadSizeCache(cachePath string) (*sizeCache, error) {
+	cache := &sizeCache{path: cachePath, entries: make(map[string]sizeCacheEntry), saveDelay: sizeCacheSaveDelay}
+	content, err := ioutil.ReadFile(cachePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return cache, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("error reading size cache %s: %s", cachePath, err)
+	}
+
+	err = json.Unmarshal(content, &cache.entries)
+	if err != nil {
+		log.Printf("Starting with an empty size cache, error parsing size cache %s: %s", cachePath, err)
+		cache.entries = make(map[string]sizeCacheEntry)
+	}
+	return cache, nil
+}
+
+func hashSecretFile(secretPath string) (string, error) {
+	content, err := ioutil.ReadFile(secretPath)
+	if err != nil {
+		return "", fmt.Errorf("error hashing secret file %s: %s", secretPath, err)
+	}
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func (c *sizeCache) get(secret, hash string) (pass.SecretSize, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	entry, found := c.entries[secret]
+	if !found || entry.Hash != hash || entry.Version != sizeCacheVersion ||
+		entry.Size.UntilBlank != pass.GetPasswordUntilBlank() ||
+		entry.Size.PasswordField != pass.GetPasswordField() ||
+		entry.Size.InputEncoding != pass.GetInputEncoding() {
+		return pass.SecretSize{}, false
+	}
+	return entry.Size, true
+}
+
+// put records the size of a secret, which is written to the cache file after the save delay along with the sizes
+// recorded meanwhile.
+func (c *sizeCache) put(secret, hash string, size pass.SecretSize) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.entries[secret] = sizeCacheEntry{Hash: hash, Size: size, Version: sizeCacheVersion}
+	c.dirty = true
+	if c.saveTimer == nil {
+		c.saveTimer = time.AfterFunc(c.saveDelay, func() {
+			err := c.flush()
+			if err != nil {
+				log.Printf("Error persisting sizes: %s", err)
+			}
+		})
+	}
+}
+
+// flush writes the sizes recorded since the cache file was last written, if there are any.
+func (c *sizeCache) flush() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.saveTimer != nil {
+		c.saveTimer.Stop()
+		c.saveTimer = nil
+	}
+	if !c.dirty {
+		return nil
+	}
+	err := c.save()
+	if err != nil {
+		return err
+	}
+	c.dirty = false
+	return nil
+}
+
+// save writes the entries to the cache file, replacing it with a file written next to it so that the cache file is
+// never left partially written. The mutex must be held.
+func (c *sizeCache) save() error {
+	content, err := json.Marshal(c.entries)
+	if err != nil {
+		return fmt.Errorf("error serializing size cache: %s", err)
+	}
+	err = os.MkdirAll(path.Dir(c.path), sizeCacheDirPermission)
+	if err != nil {
+		return fmt.Errorf("error creating size cache directory: %s", err)
+	}
+	// TempFile creates the file with the permissions of the cache file.
+	file, err := ioutil.TempFile(path.Dir(c.path), sizeCacheFileName+".*")
+	if err != nil {
+		return fmt.Errorf("error writing size cache %s: %s", c.path, err)
+	}
+	_, err = file.Write(content)
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), c.path)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return fmt.Errorf("error writing size cache %s: %s", c.path, err)
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package fs
+
+import (
+	"github.com/femnad/passfuse/pkg/pass"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestSizeCachePersists(t *testing.T) {
+	cacheDir, err := ioutil.TempDir("", "passfuse-test")
+	if err != nil {
+		t.Fatalf("Error creating cache dir: %s", err)
+	}
+	defer os.RemoveAll(cacheDir)
+	cachePath := path.Join(cacheDir, "passfuse", sizeCacheFileName)
+
+	cache, err := loadSizeCache(cachePath)
+	if err != nil {
+		t.Fatalf("Error loading empty cache: %s", err)
+	}
+	size := pass.SecretSize{ContentsSize: 12, FirstLineSize: 5}
+	cache.put("foo.gpg", "abc", size)
+	err = cache.flush()
+	if err != nil {
+		t.Fatalf("Error saving cache: %s", err)
+	}
+
+	info, err := os.Stat(cachePath)
+	if err != nil {
+		t.Fatalf("Error checking cache file: %s", err)
+	}
+	if info.Mode().Perm() != sizeCacheFilePermission {
+		t.Errorf("Expected cache file mode %o, got %o", sizeCacheFilePermission, info.Mode().Perm())
+	}
+
+	cache, err = loadSizeCache(cachePath)
+	if err != nil {
+		t.Fatalf("Error reloading cache: %s", err)
+	}
+	cachedSize, found := cache.get("foo.gpg", "abc")
+	if !found || cachedSize != size {
+		t.Errorf("Expected cached size %v, got %v (found: %t)", size, cachedSize, found)
+	}
+	_, found = cache.get("foo.gpg", "def")
+	if found {
+		t.Errorf("Expected entry with a different hash to be invalid")
+	}
+	err = pass.SetInputEncoding("ISO-8859-1")
+	if err != nil {
+		t.Fatalf("Error setting input encoding: %s", err)
+	}
+	defer pass.SetInputEncoding("")
+	_, found = cache.get("foo.gpg", "abc")
+	if found {
+		t.Errorf("Expected entry counted without transcoding to be invalid with an input encoding")
+	}
+}
+
+func TestSizeCacheBatchesSaves(t *testing.T) {
+	cacheDir, err := ioutil.TempDir("", "passfuse-test")
+	if err != nil {
+		t.Fatalf("Error creating cache dir: %s", err)
+	}
+	defer os.RemoveAll(cacheDir)
+	cachePath := path.Join(cacheDir, sizeCacheFileName)
+
+	// A truncated cache file is replaced by an empty cache.
+	err = ioutil.WriteFile(cachePath, []byte(`{"foo.gpg": {"Hash": "ab`), sizeCacheFilePermission)
+	if err != nil {
+		t.Fatalf("Error writing cache file: %s", err)
+	}
+	cache, err := loadSizeCache(cachePath)
+	if err != nil {
+		t.Fatalf("Expected a corrupt cache to be replaced, got %s", err)
+	}
+	cache.saveDelay = 50 * time.Millisecond
+	cache.put("foo.gpg", "abc", pass.SecretSize{ContentsSize: 12})
+	cache.put("bar.gpg", "def", pass.SecretSize{ContentsSize: 7})
+
+	// The sizes are written together once the save delay passes.
+	deadline := time.Now().Add(time.Second)
+	for {
+		loaded, err := loadSizeCache(cachePath)
+		if err != nil {
+			t.Fatalf("Error loading cache: %s", err)
+		}
+		if len(loaded.entries) == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the sizes to be written after the save delay, got %v", loaded.entries)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	entries, err := ioutil.ReadDir(cacheDir)
+	if err != nil || len(entries) != 1 {
+		t.Errorf("Expected only the cache file to be left, got %v", entries)
+	}
+}
@@ -0,0 +1,104 @@
+package fs
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// fsCounters are the counters reported by stats and dumps. They have their own mutex, which is never held while
+// running commands or taking fs.mutex, so that they can be reported while operations hold fs.mutex, e.g. for diagnosing
+// a hanging mount.
+type fsCounters struct {
+	mutex       sync.Mutex
+	sizeHits    uint64
+	sizeMisses  uint64
+	activeReads int
+	reads       uint64
+	readErrors  uint64
+	inodes      int
+	staleInodes int
+	openHandles int
+	// Secrets whose sizes are cached
+	cachedSecrets map[string]bool
+}
+
+// countRead counts a read of a file and whether it failed.
+func (fs *passFS) countRead(err error) {
+	fs.counters.mutex.Lock()
+	defer fs.counters.mutex.Unlock()
+	fs.counters.reads++
+	if err != nil {
+		fs.counters.readErrors++
+	}
+}
+
+// countSizeLookup counts a lookup of the size of a file and whether its size was cached.
+func (fs *passFS) countSizeLookup(hit bool) {
+	fs.counters.mutex.Lock()
+	defer fs.counters.mutex.Unlock()
+	if hit {
+		fs.counters.sizeHits++
+	} else {
+		fs.counters.sizeMisses++
+	}
+}
+
+// countCachedSize records that the size of a secret is cached.
+func (fs *passFS) countCachedSize(secret string) {
+	fs.counters.mutex.Lock()
+	defer fs.counters.mutex.Unlock()
+	fs.counters.cachedSecrets[secret] = true
+}
+
+// clearCachedSizes records that no sizes are cached.
+func (fs *passFS) clearCachedSizes() {
+	fs.counters.mutex.Lock()
+	defer fs.counters.mutex.Unlock()
+	fs.counters.cachedSecrets = make(map[string]bool)
+}
+
+// countInodes records the number of inodes and open file handles. The mutex must be held.
+func (fs *passFS) countInodes() {
+	fs.counters.mutex.Lock()
+	defer fs.counters.mutex.Unlock()
+	fs.counters.inodes = len(fs.inodes)
+	fs.counters.openHandles = fs.openHandles()
+}
+
+// countStaleInodes counts inodes removed by refreshing the tree.
+func (fs *passFS) countStaleInodes(removed int) {
+	fs.counters.mutex.Lock()
+	defer fs.counters.mutex.Unlock()
+	fs.counters.staleInodes += removed
+}
+
+// stats returns a summary of the operation counters since mounting.
+func (fs *passFS) stats() string {
+	fs.counters.mutex.Lock()
+	defer fs.counters.mutex.Unlock()
+	return fmt.Sprintf("reads: %d, read errors: %d, size cache hits: %d, size cache misses: %d, open file handles: %d",
+		fs.counters.reads, fs.counters.readErrors, fs.counters.sizeHits, fs.counters.sizeMisses,
+		fs.counters.openHandles)
+}
+
+// logStats logs the operation counters every interval until the context is done.
+func (fs *passFS) logStats(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		log.Printf("Stats: %s", fs.stats())
+	}
+}
+
+// LogStats periodically logs operation counters, until the filesystem is interrupted.
+func (s *Server) LogStats(interval time.Duration) {
+	go s.fs.logStats(s.fs.ctx, interval)
+}
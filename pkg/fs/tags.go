@@ -0,0 +1,180 @@
+package fs
+
+import (
+	"github.com/femnad/passfuse/pkg/pass"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+const (
+	tagsDirName = "tags"
+	tagsField   = "tags"
+)
+
+// secretTags are the tags of a secret, for the hash of its file when it was decrypted.
+type secretTags struct {
+	hash string
+	tags []string
+}
+
+// parseTags returns the tags in the comma separated tags field of a secret, leaving out tags which can't be used as
+// directory names.
+func parseTags(secret, secretBody string) []string {
+	value, _ := pass.ParseSecret(secretBody).GetField(tagsField)
+	var tags []string
+	for _, tag := range strings.Split(value, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "" {
+			continue
+		}
+		if tag == "." || tag == ".." || strings.Contains(tag, "/") {
+			log.Printf("Ignoring tag %q of secret %s which isn't a valid directory name", tag, secret)
+			continue
+		}
+		tags = append(tags, tag)
+	}
+	return tags
+}
+
+// getTags decrypts a secret to read its tags, unless the tags of the secret in its current version are known. Tags
+// aren't kept if caching contents is disabled.
+func (fs *passFS) getTags(secret string) []string {
+	hash, err := hashSecretFile(path.Join(fs.storePath, secret))
+	if err == nil {
+		fs.mutex.RLock()
+		cached, found := fs.secretTags[secret]
+		fs.mutex.RUnlock()
+		if found && cached.hash == hash {
+			return cached.tags
+		}
+	}
+
+	body, err := pass.GetSecret(fs.ctx, secret)
+	if err != nil {
+		log.Printf("Leaving out secret %s which failed to decrypt for reading tags: %s", secret, err)
+		return nil
+	}
+	tags := parseTags(secret, body)
+	if hash != "" && !fs.options.NoContentCache {
+		fs.mutex.Lock()
+		fs.secretTags[secret] = secretTags{hash: hash, tags: tags}
+		fs.mutex.Unlock()
+	}
+	return tags
+}
+
+// findSecretPaths maps secrets to the path of their first entry relative to the mount point, which is the one their
+// links in tag and date directories point to.
+func findSecretPaths(children []fuseutil.Dirent, inodes map[fuseops.InodeID]inodeInfo) map[string]string {
+	paths := make(map[string]string)
+	var walk func(children []fuseutil.Dirent, dirPath string)
+	walk = func(children []fuseutil.Dirent, dirPath string) {
+		for _, child := range children {
+			info := inodes[child.Inode]
+			entryPath := path.Join(dirPath, child.Name)
+			if info.dir && info.inodeType != pass.Field {
+				walk(info.children, entryPath)
+				continue
+			}
+			_, found := paths[info.secret]
+			if info.secret != "" && !found {
+				paths[info.secret] = entryPath
+			}
+		}
+	}
+	walk(children, "")
+	return paths
+}
+
+// getTagsDirEnt creates the tags directory with a directory per tag, having symlinks to the secrets with the tag.
+func (fs *passFS) getTagsDirEnt(rootNode pass.Node, rootChildren []fuseutil.Dirent, offset fuseops.DirOffset,
+	inodes map[fuseops.InodeID]inodeInfo) fuseutil.Dirent {
+	tagged := make(map[string][]string)
+	for _, leaf := range pass.GetLeaves(rootNode) {
+		for _, tag := range fs.getTags(leaf.Secret) {
+			tagged[tag] = append(tagged[tag], leaf.Secret)
+		}
+	}
+	return fs.getGroupsDirEnt(tagsDirName, tagged, rootChildren, offset, inodes)
+}
+
+// getGroupsDirEnt creates a directory with the given name with a directory per group, having symlinks to the secrets
+// in the group. The links are named after the secrets, if secrets in different directories share a name only the
+// first one is linked.
+func (fs *passFS) getGroupsDirEnt(dirName string, groups map[string][]string, rootChildren []fuseutil.Dirent,
+	offset fuseops.DirOffset, inodes map[fuseops.InodeID]inodeInfo) fuseutil.Dirent {
+	secretPaths := findSecretPaths(rootChildren, inodes)
+	var names []string
+	for group := range groups {
+		names = append(names, group)
+	}
+	sort.Strings(names)
+
+	groupsInode := fs.allocateInode()
+	groupsInfo := inodeInfo{
+		attributes: fuseops.InodeAttributes{
+			Nlink: 1,
+			Mode:  dirPermission | os.ModeDir,
+		},
+		dir: true,
+	}
+	for _, group := range names {
+		groupInode := fs.allocateInode()
+		groupInfo := inodeInfo{
+			attributes: fuseops.InodeAttributes{
+				Nlink: 1,
+				Mode:  dirPermission | os.ModeDir,
+			},
+			dir: true,
+		}
+		linked := make(map[string]string)
+		for _, secret := range groups[group] {
+			name := strings.TrimSuffix(path.Base(secret), pass.GetSecretSuffix())
+			existing, found := linked[name]
+			if found {
+				log.Printf("Secrets %s and %s with the same name are both in %s/%s, only linking %s", existing,
+					secret, dirName, group, existing)
+				continue
+			}
+			target, found := secretPaths[secret]
+			if !found {
+				continue
+			}
+			linked[name] = secret
+			linkInode := fs.allocateInode()
+			inodes[linkInode] = inodeInfo{
+				attributes: fuseops.InodeAttributes{
+					Nlink: 1,
+					Mode:  symlinkPermission | os.ModeSymlink,
+				},
+				symlink: true,
+				target:  path.Join("..", "..", target),
+			}
+			groupInfo.children = append(groupInfo.children, fuseutil.Dirent{
+				Inode: linkInode,
+				Name:  name,
+				Type:  fuseutil.DT_Link,
+			})
+		}
+		numberDirents(groupInfo.children)
+		inodes[groupInode] = groupInfo
+		groupsInfo.children = append(groupsInfo.children, fuseutil.Dirent{
+			Inode: groupInode,
+			Name:  group,
+			Type:  fuseutil.DT_Directory,
+		})
+	}
+	numberDirents(groupsInfo.children)
+	inodes[groupsInode] = groupsInfo
+	return fuseutil.Dirent{
+		Offset: offset,
+		Inode:  groupsInode,
+		Name:   dirName,
+		Type:   fuseutil.DT_Directory,
+	}
+}
@@ -0,0 +1,217 @@
+package fs
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"github.com/femnad/passfuse/pkg/pass"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+	"io"
+	"io/ioutil"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	tarExportName = "all.tar"
+	// Number of secrets decrypted ahead of the one being archived
+	tarConcurrency = 4
+)
+
+func getTarExportDirEnt(id fuseops.InodeID, rootNode pass.Node, inodes map[fuseops.InodeID]inodeInfo) fuseutil.Dirent {
+	dirEnt := getControlFileDirEnt(id, tarExportName, inodes)
+	info := inodes[id]
+	for _, leaf := range pass.GetLeaves(rootNode) {
+		info.secrets = append(info.secrets, leaf.Secret)
+	}
+	inodes[id] = info
+	return dirEnt
+}
+
+// tarSecret is a decrypted secret for the tar export, or the error of decrypting it.
+type tarSecret struct {
+	name    string
+	content string
+	err     error
+}
+
+// tarExport serves reads of a tar archive of the decrypted contents of secrets while it's being written, like a
+// SecretStream does for a single secret. Only the secrets being decrypted ahead of the archive are kept in memory, and
+// reading from an offset before the current one restarts writing the archive.
+type tarExport struct {
+	fs      *passFS
+	secrets []string
+	reader  *io.PipeReader
+	cancel  context.CancelFunc
+	offset  int64
+	eof     bool
+	mutex   sync.Mutex
+	// Goroutines writing the archive and decrypting secrets for it
+	running sync.WaitGroup
+}
+
+func newTarExport(fs *passFS, secrets []string) *tarExport {
+	sorted := append([]string{}, secrets...)
+	sort.Strings(sorted)
+	return &tarExport{fs: fs, secrets: sorted}
+}
+
+// decrypt decrypts the secrets in the background, returning a channel with a channel per secret in the order of the
+// secrets which gets the secret once it's decrypted. At most tarConcurrency secrets are waiting for being archived.
+// Secrets which may not be decrypted are left out.
+func (e *tarExport) decrypt(ctx context.Context) <-chan chan tarSecret {
+	prefix := strings.Trim(e.fs.prefix, "/")
+	retries := e.fs.getOptions().StoreRetries
+	queue := make(chan chan tarSecret, tarConcurrency)
+	e.running.Add(1)
+	go func() {
+		defer e.running.Done()
+		defer close(queue)
+		for _, secret := range e.secrets {
+			if !e.fs.secretAllowed(secret) {
+				continue
+			}
+			result := make(chan tarSecret, 1)
+			select {
+			case queue <- result:
+			case <-ctx.Done():
+				return
+			}
+			e.running.Add(1)
+			go func(secret string) {
+				defer e.running.Done()
+				name := strings.TrimSuffix(strings.TrimPrefix(secret, prefix+"/"), pass.GetSecretSuffix())
+				var content string
+				err := e.fs.retryTransient(retries, secret, func() (err error) {
+					content, err = pass.GetSecret(ctx, secret)
+					return
+				})
+				result <- tarSecret{name: name, content: content, err: err}
+			}(secret)
+		}
+	}()
+	return queue
+}
+
+// write writes the archive to the pipe, closing it with the first error of decrypting a secret.
+func (e *tarExport) write(ctx context.Context, writer *io.PipeWriter) {
+	modTime := time.Now()
+	archive := tar.NewWriter(writer)
+	for result := range e.decrypt(ctx) {
+		secret := <-result
+		err := secret.err
+		if err == nil {
+			err = archive.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: secret.name, Mode: filePermission,
+				Size: int64(len(secret.content)), ModTime: modTime})
+		}
+		if err == nil {
+			_, err = io.WriteString(archive, secret.content)
+		}
+		if err != nil {
+			writer.CloseWithError(fmt.Errorf("error exporting %s: %w", tarExportName, err))
+			return
+		}
+	}
+	writer.CloseWithError(archive.Close())
+}
+
+func (e *tarExport) open() {
+	e.close()
+	ctx, cancel := context.WithCancel(e.fs.ctx)
+	reader, writer := io.Pipe()
+	e.running.Add(1)
+	go func() {
+		defer e.running.Done()
+		e.write(ctx, writer)
+	}()
+	e.reader = reader
+	e.cancel = cancel
+	e.offset = 0
+	e.eof = false
+}
+
+func (e *tarExport) close() {
+	if e.reader == nil {
+		return
+	}
+	e.reader.Close()
+	e.cancel()
+	e.running.Wait()
+	e.reader = nil
+}
+
+// ReadAt reads the archive at the given offset, returning io.EOF with its last bytes.
+func (e *tarExport) ReadAt(p []byte, offset int64) (n int, err error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if (e.reader == nil && !e.eof) || offset < e.offset {
+		e.open()
+	}
+	if e.eof {
+		return 0, io.EOF
+	}
+
+	if offset > e.offset {
+		skipped, err := io.CopyN(ioutil.Discard, e.reader, offset-e.offset)
+		e.offset += skipped
+		if err != nil {
+			return 0, e.finish(err)
+		}
+	}
+
+	n, err = io.ReadFull(e.reader, p)
+	e.offset += int64(n)
+	if err != nil {
+		return n, e.finish(err)
+	}
+	return n, nil
+}
+
+// finish stops writing the archive, returning io.EOF if it has been read completely.
+func (e *tarExport) finish(err error) error {
+	e.close()
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		e.eof = true
+		return io.EOF
+	}
+	return err
+}
+
+// Close stops writing the archive and waits for the secrets being decrypted for it, the next read starts it again.
+func (e *tarExport) Close() {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.close()
+	e.eof = false
+}
+
+// readTarExport reads the tar export of an open file handle, or of a new export if the handle isn't open.
+func (fs *passFS) readTarExport(inode inodeInfo, op *fuseops.ReadFileOp) error {
+	fs.mutex.RLock()
+	export, found := fs.tarExports[op.Handle]
+	fs.mutex.RUnlock()
+	if !found {
+		export = newTarExport(fs, inode.secrets)
+		defer export.Close()
+	}
+
+	var err error
+	op.BytesRead, err = export.ReadAt(op.Dst, op.Offset)
+	if err == io.EOF {
+		err = nil
+	}
+	return fs.secretError("", err)
+}
+
+// warnTarExport warns about reading the tar export exposing all secrets in plain text when it's enabled.
+func warnTarExport(old, options PassFsOptions) {
+	if options.TarExport && !old.TarExport {
+		log.Printf("WARNING: reading %s/%s writes the decrypted contents of all secrets as plain text, anything "+
+			"copying it, like backups, will have them unencrypted", controlDirName, tarExportName)
+	}
+}
@@ -0,0 +1,75 @@
+package fs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/femnad/passfuse/pkg/pass"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+	"io/ioutil"
+	"log"
+	"path"
+	"strings"
+	"text/template"
+)
+
+// errTemplate is wrapped by the errors of parsing and executing templates, which are reported as EIO.
+var errTemplate = errors.New("error rendering template")
+
+// addTemplates adds a file for each template in a directory, named after the template without the template suffix,
+// reading the fields of the secret with the same name. Templates with names of existing entries are left out.
+func (fs *passFS) addTemplates(node pass.Node, children []fuseutil.Dirent,
+	inodes map[fuseops.InodeID]inodeInfo) []fuseutil.Dirent {
+	for _, templatePath := range node.Templates {
+		name := fs.entryName(strings.TrimSuffix(path.Base(templatePath), pass.TemplateSuffix))
+		_, err := findChildInode(name, children)
+		if err == nil {
+			log.Printf("Not adding template %s, there is an entry named %s", templatePath, name)
+			continue
+		}
+		id := fs.allocateInode()
+		inodes[id] = inodeInfo{
+			attributes: fuseops.InodeAttributes{
+				Nlink: 1,
+				Mode:  filePermission,
+			},
+			secret:    strings.TrimSuffix(templatePath, pass.TemplateSuffix) + pass.GetSecretSuffix(),
+			inodeType: pass.Template,
+			template:  templatePath,
+		}
+		children = append(children, fuseutil.Dirent{
+			Offset: fuseops.DirOffset(len(children) + 1),
+			Inode:  id,
+			Name:   name,
+			Type:   fuseutil.DT_File,
+		})
+	}
+	return children
+}
+
+// renderTemplate executes a template file as a Go template with the password and the fields of its secret, e.g.
+// {{ .password }} and {{ .fields.username }}. Fields missing from the secret fail the rendering.
+func renderTemplate(ctx context.Context, storePath string, inode inodeInfo) ([]byte, error) {
+	text, err := ioutil.ReadFile(path.Join(storePath, inode.template))
+	if err != nil {
+		return nil, err
+	}
+	parsed, err := template.New(inode.template).Option("missingkey=error").Parse(string(text))
+	if err != nil {
+		return nil, fmt.Errorf("%w %s: %v", errTemplate, inode.template, err)
+	}
+	body, err := pass.GetSecret(ctx, inode.secret)
+	if err != nil {
+		return nil, err
+	}
+	secret := pass.ParseSecret(body)
+	data := map[string]interface{}{"password": secret.Password, "fields": secret.Fields}
+	var rendered bytes.Buffer
+	err = parsed.Execute(&rendered, data)
+	if err != nil {
+		return nil, fmt.Errorf("%w %s: %v", errTemplate, inode.template, err)
+	}
+	return rendered.Bytes(), nil
+}
@@ -0,0 +1,52 @@
+package fs
+
+import (
+	"context"
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"strconv"
+	"syscall"
+)
+
+// Extended attribute of directories with the number of secrets under them, recursively
+const secretCountXattr = "user.passfuse.count"
+
+// copyXattr copies an extended attribute value to the destination of an operation, or only sets the size of the
+// value if the destination is empty, as the kernel asks for the size first.
+func copyXattr(dst []byte, value []byte) (int, error) {
+	if len(dst) == 0 {
+		return len(value), nil
+	}
+	if len(dst) < len(value) {
+		return len(value), syscall.ERANGE
+	}
+	return copy(dst, value), nil
+}
+
+func (fs *passFS) GetXattr(
+	ctx context.Context,
+	op *fuseops.GetXattrOp) (err error) {
+	inode, err := fs.getInode(op.Inode)
+	if err != nil {
+		return err
+	}
+	if !inode.dir || op.Name != secretCountXattr {
+		return fuse.ENOATTR
+	}
+	op.BytesRead, err = copyXattr(op.Dst, []byte(strconv.Itoa(inode.secretCount)))
+	return
+}
+
+func (fs *passFS) ListXattr(
+	ctx context.Context,
+	op *fuseops.ListXattrOp) (err error) {
+	inode, err := fs.getInode(op.Inode)
+	if err != nil {
+		return err
+	}
+	if !inode.dir {
+		return
+	}
+	op.BytesRead, err = copyXattr(op.Dst, []byte(secretCountXattr+"\x00"))
+	return
+}
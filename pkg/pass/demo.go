@@ -0,0 +1,53 @@
+package pass
+
+import (
+	"context"
+	"os"
+	"sort"
+)
+
+// Synthetic secrets of the demo source, with fields for trying out field directories, filters and the views of fields
+var demoSecrets = map[string]string{
+	"email":           "correct-horse-battery-staple\nusername: alice@example.com\nurl: https://mail.example.com\n",
+	"social/mastodon": "tr0ub4dor&3\nusername: alice\nurl: https://mastodon.example.com\ntags: social\n",
+	"work/database":   "pg-hunter2\nusername: app\nhost: db.example.com\nport: 5432\nrotated: 2024-03-14\ntags: work\n",
+	"work/github":     "hunter2\nusername: alice\nurl: https://github.com\nrotated: 2024-01-02\ntags: work, dev\n",
+	"work/vpn":        "s3cr3t\n\nThe VPN asks for the password twice.\n",
+	"wifi":            "psk: guest: welcome\nssid: example-guest\n",
+}
+
+// MemorySource serves secrets kept in memory, keyed by name, without running any commands.
+type MemorySource struct {
+	Secrets map[string]string
+}
+
+// NewDemoSource creates a source serving a few synthetic secrets, for trying passfuse out without a password store
+// or GPG.
+func NewDemoSource() MemorySource {
+	return MemorySource{Secrets: demoSecrets}
+}
+
+func (s MemorySource) List() ([]string, error) {
+	var names []string
+	for name := range s.Secrets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (s MemorySource) Get(ctx context.Context, name string) ([]byte, error) {
+	content, found := s.Secrets[name]
+	if !found {
+		return nil, os.ErrNotExist
+	}
+	return []byte(content), nil
+}
+
+func (s MemorySource) FirstLine(ctx context.Context, name string) (string, error) {
+	content, err := s.Get(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	return getRawFirstLine(string(content)), nil
+}
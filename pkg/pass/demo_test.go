@@ -0,0 +1,19 @@
+package pass
+
+import (
+	"context"
+	"testing"
+)
+
+func TestDemoSourceFirstLine(t *testing.T) {
+	SetSource(NewDemoSource())
+	defer SetSource(nil)
+	SetStripFirstLineKey(true)
+	defer SetStripFirstLineKey(false)
+
+	// Only the key of the first line is stripped, the value keeps its colon.
+	line, err := GetSecretFirstLine(context.Background(), "wifi.gpg")
+	if err != nil || line != "guest: welcome" {
+		t.Errorf("Expected the value of the keyed first line, got %q and %v", line, err)
+	}
+}
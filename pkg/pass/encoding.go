@@ -0,0 +1,71 @@
+package pass
+
+import (
+	"fmt"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/ianaindex"
+	"golang.org/x/text/transform"
+	"io"
+)
+
+var (
+	// Encoding of secrets which are transcoded to UTF-8, nil for serving secrets as they are
+	inputEncoding encoding.Encoding
+	// IANA name of the input encoding, empty if there is none
+	inputEncodingName string
+)
+
+// SetInputEncoding sets the encoding of secrets by its IANA name, e.g. ISO-8859-1, so that they're transcoded to UTF-8
+// when reading them. An empty name serves secrets as they are.
+func SetInputEncoding(name string) error {
+	if name == "" {
+		inputEncoding = nil
+		inputEncodingName = ""
+		return nil
+	}
+	enc, err := ianaindex.IANA.Encoding(name)
+	if err != nil {
+		return fmt.Errorf("unknown input encoding %s: %s", name, err)
+	}
+	if enc == nil {
+		return fmt.Errorf("unsupported input encoding %s", name)
+	}
+	inputEncoding = enc
+	// Aliases of the same encoding, e.g. latin1 for ISO-8859-1, get the same name.
+	inputEncodingName, err = ianaindex.IANA.Name(enc)
+	if err != nil {
+		inputEncodingName = name
+	}
+	return nil
+}
+
+// GetInputEncoding returns the IANA name of the encoding secrets are transcoded from, empty if they aren't.
+func GetInputEncoding() string {
+	return inputEncodingName
+}
+
+// decodedOutput is the output of a command transcoded to UTF-8.
+type decodedOutput struct {
+	io.Reader
+	output io.ReadCloser
+}
+
+func (o decodedOutput) Close() error {
+	return o.output.Close()
+}
+
+// decodeOutput transcodes the output of a command from the input encoding, if there is one.
+func decodeOutput(output io.ReadCloser) io.ReadCloser {
+	if inputEncoding == nil {
+		return output
+	}
+	return decodedOutput{Reader: transform.NewReader(output, inputEncoding.NewDecoder()), output: output}
+}
+
+// decodeContent transcodes the content of a secret from the input encoding, if there is one.
+func decodeContent(content []byte) ([]byte, error) {
+	if inputEncoding == nil {
+		return content, nil
+	}
+	return inputEncoding.NewDecoder().Bytes(content)
+}
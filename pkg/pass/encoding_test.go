@@ -0,0 +1,51 @@
+package pass
+
+import (
+	"context"
+	"testing"
+)
+
+func TestInputEncoding(t *testing.T) {
+	err := SetInputEncoding("ISO-8859-1")
+	if err != nil {
+		t.Fatalf("Error setting input encoding: %s", err)
+	}
+	defer SetInputEncoding("")
+	started := 0
+	SetCommandRunner(countingRunner("caf\xe9\nusername: s\xf8ren\n", &started))
+	defer SetCommandRunner(runCommand)
+
+	stream := NewSecretStream(context.Background(), "foo.gpg", Contents)
+	defer stream.Close()
+	expected := "café\nusername: søren\n"
+	content := readStream(t, stream, 0, 64)
+	if content != expected {
+		t.Errorf("Expected %q, got %q", expected, content)
+	}
+
+	size, err := GetSecretSize(context.Background(), "foo.gpg")
+	if err != nil {
+		t.Fatalf("Error getting size: %s", err)
+	}
+	if size.ContentsSize != uint64(len(expected)) || size.FirstLineSize != uint64(len("café")) {
+		t.Errorf("Expected sizes of the transcoded content, got %+v", size)
+	}
+
+	secret, err := GetSecret(context.Background(), "foo.gpg")
+	if err != nil {
+		t.Fatalf("Error getting secret: %s", err)
+	}
+	if secret != expected {
+		t.Errorf("Expected %q, got %q", expected, secret)
+	}
+}
+
+func TestUnknownInputEncoding(t *testing.T) {
+	err := SetInputEncoding("no-such-encoding")
+	if err == nil {
+		t.Errorf("Expected an unknown encoding to be rejected")
+	}
+	if inputEncoding != nil {
+		t.Errorf("Expected the encoding to stay unset")
+	}
+}
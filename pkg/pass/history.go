@@ -0,0 +1,45 @@
+package pass
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GetSecretHistory returns the commit timestamps and subjects of the commits touching a secret's file in a git backed
+// password store, one commit per line. The secret is not decrypted.
+func GetSecretHistory(ctx context.Context, storePath, secretName string) (string, error) {
+	output, err := readCommandOutput(ctx, "git", "-C", GetStorePath(storePath), "log", "--format=%ct %s", "--",
+		secretName)
+	if err != nil {
+		return "", fmt.Errorf("error getting history of secret %s: %w", secretName, err)
+	}
+	return string(output), nil
+}
+
+// GetSecretMtime returns when a secret was last changed, which is the time of the last commit touching its file in a
+// git backed password store. Secrets which aren't committed, or stores which aren't git repositories, fall back to the
+// modification time of the file.
+func GetSecretMtime(ctx context.Context, storePath, secretName string) (time.Time, error) {
+	storePath = GetStorePath(storePath)
+	output, err := readCommandOutput(ctx, "git", "-C", storePath, "log", "-1", "--format=%ct", "--", secretName)
+	if ctx.Err() != nil {
+		return time.Time{}, ctx.Err()
+	}
+	if err == nil && len(strings.TrimSpace(string(output))) > 0 {
+		timestamp, err := strconv.ParseInt(strings.TrimSpace(string(output)), 10, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("error parsing commit time of secret %s: %s", secretName, err)
+		}
+		return time.Unix(timestamp, 0), nil
+	}
+	info, err := os.Stat(path.Join(storePath, secretName))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("error getting modification time of secret %s: %w", secretName, err)
+	}
+	return info.ModTime(), nil
+}
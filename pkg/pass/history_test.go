@@ -0,0 +1,60 @@
+package pass
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGetSecretHistory(t *testing.T) {
+	var command []string
+	SetCommandRunner(func(name string, args ...string) (io.ReadCloser, error) {
+		command = append([]string{name}, args...)
+		return ioutil.NopCloser(strings.NewReader("1600000000 Rotate work/github\n")), nil
+	})
+	defer SetCommandRunner(runCommand)
+
+	history, err := GetSecretHistory(context.Background(), "/store", "work/github.gpg")
+	if err != nil {
+		t.Fatalf("Error getting history: %s", err)
+	}
+	if history != "1600000000 Rotate work/github\n" {
+		t.Errorf("Unexpected history %q", history)
+	}
+	expected := "git -C /store log --format=%ct %s -- work/github.gpg"
+	if strings.Join(command, " ") != expected {
+		t.Errorf("Expected command %q, got %q", expected, command)
+	}
+}
+
+func TestGetSecretMtime(t *testing.T) {
+	storePath := makeStore(t, "work/github.gpg")
+	defer os.RemoveAll(storePath)
+	modified := time.Unix(1500000000, 0)
+	err := os.Chtimes(path.Join(storePath, "work/github.gpg"), modified, modified)
+	if err != nil {
+		t.Fatalf("Error setting modification time: %s", err)
+	}
+	defer SetCommandRunner(runCommand)
+
+	for output, expected := range map[string]time.Time{
+		"1600000000\n": time.Unix(1600000000, 0),
+		"":             modified,
+	} {
+		SetCommandRunner(func(name string, args ...string) (io.ReadCloser, error) {
+			return ioutil.NopCloser(strings.NewReader(output)), nil
+		})
+		mtime, err := GetSecretMtime(context.Background(), storePath, "work/github.gpg")
+		if err != nil {
+			t.Fatalf("Error getting modification time: %s", err)
+		}
+		if !mtime.Equal(expected) {
+			t.Errorf("Expected modification time %s for git output %q, got %s", expected, output, mtime)
+		}
+	}
+}
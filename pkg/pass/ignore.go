@@ -0,0 +1,111 @@
+package pass
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+const ignoreFile = ".passfuseignore"
+
+// ignoreRule is a pattern of an ignore file, relative to the directory containing the ignore file.
+type ignoreRule struct {
+	base     string
+	pattern  string
+	negate   bool
+	dirOnly  bool
+	anchored bool
+}
+
+// parseIgnoreRule parses a line of an ignore file, returning false for empty lines and comments.
+func parseIgnoreRule(base, line string) (ignoreRule, bool) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return ignoreRule{}, false
+	}
+	rule := ignoreRule{base: base}
+	if strings.HasPrefix(line, "!") {
+		rule.negate = true
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	// Like gitignore, patterns with a slash match paths relative to the ignore file instead of names at any depth.
+	rule.anchored = strings.Contains(line, "/")
+	rule.pattern = strings.TrimPrefix(line, "/")
+	return rule, rule.pattern != ""
+}
+
+// readIgnoreFile returns the rules of the ignore file in a directory of the store, if there is one.
+func readIgnoreFile(basePath, dir string) ([]ignoreRule, error) {
+	file, err := os.Open(path.Join(basePath, dir, ignoreFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("error reading ignore file in %s: %s", dir, err)
+	}
+	defer file.Close()
+
+	var rules []ignoreRule
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		rule, ok := parseIgnoreRule(dir, scanner.Text())
+		if ok {
+			rules = append(rules, rule)
+		}
+	}
+	if scanner.Err() != nil {
+		return nil, fmt.Errorf("error reading ignore file in %s: %s", dir, scanner.Err())
+	}
+	return rules, nil
+}
+
+// withIgnoreFile returns the rules extended by the rules of the ignore file in a directory, which take precedence.
+func withIgnoreFile(rules []ignoreRule, basePath, dir string) ([]ignoreRule, error) {
+	dirRules, err := readIgnoreFile(basePath, dir)
+	if err != nil || len(dirRules) == 0 {
+		return rules, err
+	}
+	extended := make([]ignoreRule, 0, len(rules)+len(dirRules))
+	extended = append(extended, rules...)
+	return append(extended, dirRules...), nil
+}
+
+func (r ignoreRule) matches(entryPath string, isDir bool) bool {
+	if r.dirOnly && !isDir {
+		return false
+	}
+	relative := entryPath
+	if r.base != "" {
+		relative = strings.TrimPrefix(entryPath, r.base+"/")
+	}
+	if !r.anchored {
+		relative = path.Base(relative)
+	}
+	candidates := []string{relative}
+	if !isDir && strings.HasSuffix(relative, secretSuffix) {
+		candidates = append(candidates, strings.TrimSuffix(relative, secretSuffix))
+	}
+	for _, candidate := range candidates {
+		matched, _ := path.Match(r.pattern, candidate)
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+// isIgnored returns whether the last rule matching an entry of the store excludes it.
+func isIgnored(rules []ignoreRule, entryPath string, isDir bool) bool {
+	ignored := false
+	for _, rule := range rules {
+		if rule.matches(entryPath, isDir) {
+			ignored = !rule.negate
+		}
+	}
+	return ignored
+}
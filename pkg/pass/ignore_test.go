@@ -0,0 +1,70 @@
+package pass
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func writeIgnoreFile(t *testing.T, storePath, dir, content string) {
+	t.Helper()
+	err := ioutil.WriteFile(path.Join(storePath, dir, ignoreFile), []byte(content), 0600)
+	if err != nil {
+		t.Fatalf("Error writing ignore file: %s", err)
+	}
+}
+
+func leafSecrets(root Node) string {
+	var secrets []string
+	for _, leaf := range GetLeaves(root) {
+		secrets = append(secrets, leaf.Secret)
+	}
+	sort.Strings(secrets)
+	return strings.Join(secrets, " ")
+}
+
+func TestRootIgnoreFile(t *testing.T) {
+	storePath := makeStore(t, "old/github.gpg", "work/old.gpg", "work/aws.gpg", "work/archive/ci.gpg",
+		"work/archive/keep.gpg", "personal/mail.gpg")
+	defer os.RemoveAll(storePath)
+	writeIgnoreFile(t, storePath, "", "# Retired secrets\n\nold\narchive/\n/personal/mail.gpg\n")
+
+	root, err := GetPassTree(storePath, "", ParseOptions{})
+	if err != nil {
+		t.Fatalf("Error parsing: %s", err)
+	}
+	// old matches the directory and the secret at any depth, /personal/mail.gpg only the one path.
+	expected := "work/aws.gpg"
+	if leafSecrets(root) != expected {
+		t.Errorf("Expected %q, got %q", expected, leafSecrets(root))
+	}
+
+	// Ignore files of parents apply when mounting a prefix too.
+	root, err = GetPassTree(storePath, "work", ParseOptions{})
+	if err != nil {
+		t.Fatalf("Error parsing: %s", err)
+	}
+	if leafSecrets(root) != expected {
+		t.Errorf("Expected %q for the prefix, got %q", expected, leafSecrets(root))
+	}
+}
+
+func TestNestedIgnoreFile(t *testing.T) {
+	storePath := makeStore(t, "work/aws.gpg", "work/tmp-ci.gpg", "work/tmp-keep.gpg", "work/ops/tmp-db.gpg",
+		"personal/tmp-mail.gpg")
+	defer os.RemoveAll(storePath)
+	writeIgnoreFile(t, storePath, "", "tmp-*\n")
+	writeIgnoreFile(t, storePath, "work", "# Still needed\n!tmp-keep\n")
+
+	root, err := GetPassTree(storePath, "", ParseOptions{})
+	if err != nil {
+		t.Fatalf("Error parsing: %s", err)
+	}
+	expected := "work/aws.gpg work/tmp-keep.gpg"
+	if leafSecrets(root) != expected {
+		t.Errorf("Expected %q, got %q", expected, leafSecrets(root))
+	}
+}
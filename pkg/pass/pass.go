@@ -2,74 +2,234 @@ package pass
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"log"
 	"os"
 	"os/exec"
 	"path"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const (
-	secretSuffix = ".gpg"
-	defaultPath  = "$HOME/.password-store"
+	DefaultSecretSuffix = ".gpg"
+	defaultPath         = "$HOME/.password-store"
+	DefaultShowCommand  = "pass show {name}"
+	showCommandNameSlot = "{name}"
 )
 
+// CommandRunner starts a command with the given arguments and returns a reader for its standard output. Closing the
+// reader returns the error of the command, or stops the command if its output hasn't been read completely.
+type CommandRunner func(name string, args ...string) (io.ReadCloser, error)
+
+var (
+	commandRunner CommandRunner = runCommand
+	showCommand                 = strings.Fields(DefaultShowCommand)
+	secretSuffix                = DefaultSecretSuffix
+	// Maximum size of a secret in bytes, 0 means unlimited
+	maxSecretSize int64
+	// Whether whitespace around the first line is removed
+	trimFirstLine bool
+	// Whether the key of a first line of the form "key: value" is removed
+	stripFirstLineKey bool
+	// Whether passwords span the lines up to the first blank line rather than only the first line
+	passwordUntilBlank bool
+	// Field whose value is the password rather than the first line if the secret has it, empty for the first line
+	passwordField string
+	// GPG home directory of commands, empty for the one in their inherited environment
+	gnupgHome string
+	// Time commands may take before they're stopped, 0 means unlimited
+	commandTimeout time.Duration
+)
+
+// Whitespace removed from first lines when trimming them
+const firstLineWhitespace = " \t\r\v\f"
+
+var ErrSecretTooLarge = errors.New("secret exceeds maximum secret size")
+
+// ErrAgentLocked is returned when decrypting needs a passphrase which can't be asked for, e.g. without a terminal or
+// a graphical pinentry.
+var ErrAgentLocked = errors.New("gpg-agent needs a passphrase but can't ask for it, unlock the key by decrypting a " +
+	"secret in a terminal and try again")
+
+// Messages GPG reports on stderr when it can't ask for a passphrase
+var agentLockedMessages = []string{
+	"No pinentry",
+	"Inappropriate ioctl for device",
+	"cannot open terminal",
+	"cannot open '/dev/tty'",
+}
+
+// ErrCardMissing is returned when decrypting needs a smartcard holding the key, e.g. a YubiKey, which isn't present.
+var ErrCardMissing = errors.New("the smartcard holding the decryption key isn't present, insert it and try again")
+
+// ErrStoreUnavailable is returned when the directory of the password store can't be found anymore, e.g. because it was
+// moved or a symlink to it was removed while mounted.
+var ErrStoreUnavailable = errors.New("the password store isn't available, check that it hasn't been moved or unmounted")
+
+// Messages GPG reports on stderr when the smartcard holding the key is removed
+var cardMissingMessages = []string{
+	"Card not present",
+	"Card removed",
+	"No such device",
+	"selecting card failed",
+}
+
+// Maximum number of bytes of stderr kept for reporting failed commands
+const maxStderrSize = 4096
+
 type NodeType int
 
 const (
 	Contents  NodeType = iota
 	FirstLine          = iota
+	History            = iota
+	Field              = iota
+	Raw                = iota
+	Framed             = iota
+	Toml               = iota
+	Ini                = iota
+	Age                = iota
+	QR                 = iota
+	Template           = iota
+	// Files of a real directory mounted along with the secrets, rather than files of secrets
+	Overlay = iota
 )
 
+// Suffix of template files, which are rendered with the fields of the secret of the same name
+const TemplateSuffix = ".tmpl"
+
+// Size of the big-endian length prefixing the content of framed files
+const FramePrefixSize = 4
+
 type SecretSize struct {
-	ContentsSize  uint64
-	FirstLineSize uint64
+	ContentsSize         uint64
+	FirstLineSize        uint64
+	TrimmedFirstLineSize uint64
+	// Whether the first line has the form "key: value", and the size of the value
+	FirstLineKeyed     bool
+	FirstLineValueSize uint64
+	// Whether the first line sizes are those of the password up to the first blank line
+	UntilBlank bool
+	// The password field the sizes were counted for, whether the secret has it and the size of its value
+	PasswordField      string
+	PasswordFieldFound bool
+	PasswordFieldSize  uint64
+	// The input encoding the secret was transcoded from for counting the sizes
+	InputEncoding string
+}
+
+// GetFirstLineSize returns the size of the first line, trimmed if first lines are trimmed, or of its value if keys are
+// stripped from first lines.
+func (s SecretSize) GetFirstLineSize() uint64 {
+	if s.PasswordFieldFound {
+		return s.PasswordFieldSize
+	}
+	if stripFirstLineKey && s.FirstLineKeyed {
+		return s.FirstLineValueSize
+	}
+	if trimFirstLine {
+		return s.TrimmedFirstLineSize
+	}
+	return s.FirstLineSize
 }
 
 type Node struct {
 	Children []Node
 	IsLeaf   bool
 	Secret   string
+	// Paths of the template files in a directory, if templates are parsed
+	Templates []string
+}
+
+type ParseOptions struct {
+	StrictGpg bool
+	// Collect template files rather than treating them as secrets or ignoring them
+	Templates bool
 }
 
 type Parser struct {
 	basePath string
+	options  ParseOptions
 }
 
+// GetNodes fills in the tree of secrets under the prefix, leaving out the entries excluded by ignore files in the
+// prefix directory or its parents.
 func (p Parser) GetNodes(root *Node, prefix string) error {
+	var rules []ignoreRule
+	if prefix != "" {
+		components := strings.Split(prefix, "/")
+		for i := range components {
+			var err error
+			rules, err = withIgnoreFile(rules, p.basePath, path.Join(components[:i]...))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if prefix != "" {
+		singleSecretPrefix := fmt.Sprintf("%s%s", path.Join(p.basePath, prefix), secretSuffix)
+		_, err := os.Stat(singleSecretPrefix)
+		if !os.IsNotExist(err) {
+			rootPrefix, _ := path.Split(prefix)
+			root.Secret = strings.TrimRight(rootPrefix, "/")
+			nodeSecret := fmt.Sprintf("%s%s", prefix, secretSuffix)
+			root.Children = []Node{{
+				Children: nil,
+				IsLeaf:   true,
+				Secret:   nodeSecret,
+			}}
+			root.IsLeaf = false
+			return nil
+		}
+	}
+	return p.getNodes(root, prefix, rules)
+}
+
+// getNodes fills in the tree of a node. Only a prefix naming a secret selects that secret, a directory with the name of
+// a secret next to it is read as a directory.
+func (p Parser) getNodes(root *Node, prefix string, rules []ignoreRule) error {
 	root.Secret = prefix
 	if root.IsLeaf {
 		return nil
 	}
 	nodePath := path.Join(p.basePath, prefix)
 
-	singleSecretPrefix := fmt.Sprintf("%s%s", nodePath, secretSuffix)
-	_, err := os.Stat(singleSecretPrefix)
-	if !os.IsNotExist(err) {
-		rootPrefix, _ := path.Split(prefix)
-		root.Secret = strings.TrimRight(rootPrefix, "/")
-		nodeSecret := fmt.Sprintf("%s%s", prefix, secretSuffix)
-		root.Children = []Node{{
-			Children: nil,
-			IsLeaf:   true,
-			Secret:   nodeSecret,
-		}}
-		root.IsLeaf = false
-		return nil
-	}
-
 	info, err := ioutil.ReadDir(nodePath)
 	if err != nil {
 		return fmt.Errorf("error reading dir %s: %s", nodePath, err)
 	}
+	rules, err = withIgnoreFile(rules, p.basePath, prefix)
+	if err != nil {
+		return err
+	}
 	var children []Node
 	for _, item := range info {
 		if strings.HasPrefix(item.Name(), ".") {
 			continue
 		}
+		itemPath := path.Join(prefix, item.Name())
+		if isIgnored(rules, itemPath, item.IsDir()) {
+			continue
+		}
+		if p.options.Templates && !item.IsDir() && strings.HasSuffix(item.Name(), TemplateSuffix) {
+			root.Templates = append(root.Templates, itemPath)
+			continue
+		}
+		if p.options.StrictGpg && !item.IsDir() && !strings.HasSuffix(item.Name(), secretSuffix) {
+			log.Printf("Ignoring non-secret file %s", itemPath)
+			continue
+		}
 		childNode := Node{IsLeaf: !item.IsDir()}
-		err = p.GetNodes(&childNode, path.Join(prefix, item.Name()))
+		err = p.getNodes(&childNode, itemPath, rules)
 		if err != nil {
 			return err
 		}
@@ -79,65 +239,673 @@ func (p Parser) GetNodes(root *Node, prefix string) error {
 	return nil
 }
 
-func GetPassTree(basePath, prefix string) (Node, error) {
+// GetLeaves returns the secrets under a node, in the order they appear in the tree.
+func GetLeaves(node Node) []Node {
+	if node.IsLeaf {
+		return []Node{node}
+	}
+	var leaves []Node
+	for _, child := range node.Children {
+		leaves = append(leaves, GetLeaves(child)...)
+	}
+	return leaves
+}
+
+// GetStorePath returns the password store path to use, falling back to the default store path of pass.
+func GetStorePath(basePath string) string {
 	if basePath == "" {
-		basePath = os.ExpandEnv(defaultPath)
+		return os.ExpandEnv(defaultPath)
+	}
+	return basePath
+}
+
+// IsLocalStore returns whether secrets are read from a password store in a local directory, rather than from a remote
+// store or another source.
+func IsLocalStore() bool {
+	return remote == nil && source == nil
+}
+
+// normalizePrefix removes leading and trailing slashes from a prefix, so that e.g. work, /work and work/ all select
+// the same secrets.
+func normalizePrefix(prefix string) string {
+	return strings.Trim(path.Clean("/"+prefix), "/")
+}
+
+// checkStorePath returns an error if the password store path isn't an existing directory.
+func checkStorePath(basePath string) error {
+	info, err := os.Stat(basePath)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("password store %s doesn't exist, check the password store path: %w", basePath, err)
+	} else if err != nil {
+		return fmt.Errorf("error checking password store %s: %w", basePath, err)
 	}
-	parser := Parser{basePath: basePath}
+	if !info.IsDir() {
+		return fmt.Errorf("password store %s is not a directory, check the password store path", basePath)
+	}
+	return nil
+}
+
+func GetPassTree(basePath, prefix string, options ParseOptions) (Node, error) {
+	basePath = GetStorePath(basePath)
+	prefix = normalizePrefix(prefix)
+	if remote != nil {
+		return getRemotePassTree(prefix)
+	}
+	if source != nil {
+		return getSourcePassTree(prefix)
+	}
+	err := checkStorePath(basePath)
+	if err != nil {
+		return Node{}, err
+	}
+	parser := Parser{basePath: basePath, options: options}
 	root := Node{IsLeaf: false}
-	err := parser.GetNodes(&root, prefix)
+	err = parser.GetNodes(&root, prefix)
 	if err != nil {
 		return Node{}, err
 	}
 	return root, nil
 }
 
-func getSecretContent(secretName string) ([]byte, error) {
+// GetSecretTree returns a tree with only the given secret at its root, without reading the rest of the store. The
+// secret has to exist in a local store, it isn't checked for other stores.
+func GetSecretTree(basePath, secret string) (Node, error) {
+	secret = normalizePrefix(strings.TrimSuffix(secret, secretSuffix))
+	if secret == "" {
+		return Node{}, fmt.Errorf("secret name cannot be empty")
+	}
+	if remote == nil && source == nil {
+		_, err := os.Stat(path.Join(GetStorePath(basePath), secret+secretSuffix))
+		if err != nil {
+			return Node{}, fmt.Errorf("error finding secret %s: %w", secret, err)
+		}
+	}
+	rootPrefix, _ := path.Split(secret)
+	return Node{
+		Secret:   strings.TrimRight(rootPrefix, "/"),
+		Children: []Node{{IsLeaf: true, Secret: secret + secretSuffix}},
+	}, nil
+}
+
+// commandOutput is the standard output of a running command.
+type commandOutput struct {
+	io.Reader
+	cmd    *exec.Cmd
+	stderr *limitedBuffer
+	// Set to 1 once the output has been read completely
+	done int32
+}
+
+func (o *commandOutput) Read(p []byte) (int, error) {
+	n, err := o.Reader.Read(p)
+	if err == io.EOF {
+		atomic.StoreInt32(&o.done, 1)
+	}
+	return n, err
+}
+
+// Close waits for the command if its output has been read completely, otherwise the command is killed.
+func (o *commandOutput) Close() error {
+	if atomic.LoadInt32(&o.done) == 0 {
+		o.cmd.Process.Kill()
+		o.cmd.Wait()
+		return nil
+	}
+	err := o.cmd.Wait()
+	if err != nil {
+		return classifyCommandError(err, o.stderr.String())
+	}
+	return nil
+}
+
+// limitedBuffer keeps the first bytes written to it, discarding the rest.
+type limitedBuffer struct {
+	bytes.Buffer
+	limit int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	remaining := b.limit - b.Len()
+	if remaining > len(p) {
+		remaining = len(p)
+	}
+	if remaining > 0 {
+		b.Buffer.Write(p[:remaining])
+	}
+	return len(p), nil
+}
+
+// classifyCommandError adds the stderr of a failed command to its error, recognizing failures due to GPG being unable
+// to ask for a passphrase or the smartcard holding the key not being present.
+func classifyCommandError(err error, stderr string) error {
+	stderr = strings.TrimSpace(stderr)
+	for _, message := range agentLockedMessages {
+		if strings.Contains(stderr, message) {
+			return fmt.Errorf("%w: %s", ErrAgentLocked, stderr)
+		}
+	}
+	for _, message := range cardMissingMessages {
+		if strings.Contains(stderr, message) {
+			return fmt.Errorf("%w: %s", ErrCardMissing, stderr)
+		}
+	}
+	if stderr == "" {
+		return err
+	}
+	return fmt.Errorf("%s: %s", err, stderr)
+}
+
+func runCommand(name string, args ...string) (io.ReadCloser, error) {
+	cmd := exec.Command(name, args...)
+	if gnupgHome != "" {
+		cmd.Env = append(os.Environ(), "GNUPGHOME="+gnupgHome)
+	}
+	stderr := &limitedBuffer{limit: maxStderrSize}
+	cmd.Stderr = stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	err = cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+	return &commandOutput{Reader: stdout, cmd: cmd, stderr: stderr}, nil
+}
+
+// cancelableOutput closes the output of a command once its context is done, which stops the command. Reads and
+// closing then fail with the error of the context.
+type cancelableOutput struct {
+	io.ReadCloser
+	ctx       context.Context
+	closed    chan struct{}
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// withContext stops a command when the context is done, unless its output has been closed before.
+func withContext(ctx context.Context, output io.ReadCloser) io.ReadCloser {
+	if ctx.Done() == nil {
+		return output
+	}
+	o := &cancelableOutput{ReadCloser: output, ctx: ctx, closed: make(chan struct{})}
+	go func() {
+		select {
+		case <-ctx.Done():
+			o.close()
+		case <-o.closed:
+		}
+	}()
+	return o
+}
+
+func (o *cancelableOutput) Read(p []byte) (int, error) {
+	n, err := o.ReadCloser.Read(p)
+	if err != nil && o.ctx.Err() != nil {
+		return n, o.ctx.Err()
+	}
+	return n, err
+}
+
+func (o *cancelableOutput) close() error {
+	o.closeOnce.Do(func() {
+		close(o.closed)
+		o.closeErr = o.ReadCloser.Close()
+	})
+	return o.closeErr
+}
+
+func (o *cancelableOutput) Close() error {
+	err := o.close()
+	if o.ctx.Err() != nil {
+		return o.ctx.Err()
+	}
+	return err
+}
+
+// timedOutput releases the timeout of a command once its output is closed.
+type timedOutput struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (o timedOutput) Close() error {
+	defer o.cancel()
+	return o.ReadCloser.Close()
+}
+
+// startCommand starts a command which is stopped when the context is done or the command timeout passes, in which
+// case reading its output fails with context.DeadlineExceeded.
+func startCommand(ctx context.Context, name string, args ...string) (io.ReadCloser, error) {
+	if commandTimeout <= 0 {
+		return startSessionCommand(ctx, name, args...)
+	}
+	ctx, cancel := context.WithTimeout(ctx, commandTimeout)
+	output, err := startSessionCommand(ctx, name, args...)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return timedOutput{ReadCloser: output, cancel: cancel}, nil
+}
+
+// limitSecret limits reading a secret to one byte beyond the maximum secret size, which is enough to tell apart
+// output of exactly the maximum size from larger output without reading all of the latter.
+func limitSecret(reader io.Reader) io.Reader {
+	if maxSecretSize > 0 {
+		return io.LimitReader(reader, maxSecretSize+1)
+	}
+	return reader
+}
+
+func exceedsMaxSecretSize(size int64) bool {
+	return maxSecretSize > 0 && size > maxSecretSize
+}
+
+// readCommand runs a command and returns its output, stopping the command if the output exceeds the maximum secret
+// size. The command is stopped as well if the context is done before it finishes.
+func readCommand(ctx context.Context, name string, args ...string) ([]byte, error) {
+	output, err := startCommand(ctx, name, args...)
+	if err != nil {
+		return []byte{}, err
+	}
+	content, err := ioutil.ReadAll(limitSecret(output))
+	if err == nil && exceedsMaxSecretSize(int64(len(content))) {
+		output.Close()
+		return []byte{}, ErrSecretTooLarge
+	}
+	closeErr := output.Close()
+	if err != nil {
+		return []byte{}, err
+	}
+	if closeErr != nil {
+		return []byte{}, closeErr
+	}
+	return content, nil
+}
+
+// readCommandOutput runs a command whose output isn't a secret, e.g. a listing of the store or its history, and returns
+// all of its output regardless of the maximum secret size. The command is stopped if the context is done before it
+// finishes.
+func readCommandOutput(ctx context.Context, name string, args ...string) ([]byte, error) {
+	output, err := startCommand(ctx, name, args...)
+	if err != nil {
+		return []byte{}, err
+	}
+	content, err := ioutil.ReadAll(output)
+	closeErr := output.Close()
+	if err != nil {
+		return []byte{}, err
+	}
+	if closeErr != nil {
+		return []byte{}, closeErr
+	}
+	return content, nil
+}
+
+// SetMaxSecretSize sets the maximum size of a secret in bytes, secrets exceeding it fail with ErrSecretTooLarge. A
+// maximum size of 0 allows secrets of any size.
+func SetMaxSecretSize(size int64) {
+	maxSecretSize = size
+}
+
+// SetCommandTimeout sets how long the commands showing secrets or their history may run before they're stopped, e.g.
+// when reading a store on a network filesystem hangs. A timeout of 0 lets commands run until they finish.
+func SetCommandTimeout(timeout time.Duration) {
+	commandTimeout = timeout
+}
+
+// SetStripFirstLineKey sets whether first line files of secrets whose first line has the form "key: value", e.g.
+// "password: hunter2", only have the value.
+func SetStripFirstLineKey(strip bool) {
+	stripFirstLineKey = strip
+}
+
+// SetPasswordUntilBlank sets whether the password of secrets spans the lines up to the first blank line, with the
+// fields following the blank line, for stores keeping multi-line passwords or keys. First line files then have all
+// lines of the password.
+func SetPasswordUntilBlank(untilBlank bool) {
+	passwordUntilBlank = untilBlank
+}
+
+// SetPasswordField sets the field whose value first line files have instead of the first line, for stores keeping the
+// password in a field like "password: hunter2" anywhere in the secret. Secrets without the field still have their first
+// line. An empty field uses the first line of all secrets.
+func SetPasswordField(field string) {
+	passwordField = strings.ToLower(field)
+}
+
+// GetPasswordField returns the field whose value is the password, empty if it's the first line.
+func GetPasswordField() string {
+	return passwordField
+}
+
+// GetPasswordUntilBlank returns whether the password of secrets spans the lines up to the first blank line.
+func GetPasswordUntilBlank() bool {
+	return passwordUntilBlank
+}
+
+// SetTrimFirstLine sets whether whitespace around the first line of secrets is removed for first line files, e.g.
+// trailing spaces which were accidentally saved with a password.
+func SetTrimFirstLine(trim bool) {
+	trimFirstLine = trim
+}
+
+// SetGnupgHome sets the GPG home directory of the commands showing secrets, for decrypting with a keyring other than
+// the one of the environment passfuse runs in. An empty directory keeps the inherited GNUPGHOME.
+func SetGnupgHome(dir string) error {
+	if dir != "" {
+		info, err := os.Stat(dir)
+		if err != nil {
+			return fmt.Errorf("error checking GPG home directory: %s", err)
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("GPG home %s is not a directory", dir)
+		}
+	}
+	gnupgHome = dir
+	return nil
+}
+
+// GetGnupgHome returns the GPG home directory of commands, empty if it's inherited.
+func GetGnupgHome() string {
+	return gnupgHome
+}
+
+// SetCommandRunner replaces the function used for running commands, mainly for testing without a password store.
+func SetCommandRunner(runner CommandRunner) {
+	commandRunner = runner
+}
+
+// SetSecretSuffix sets the suffix of secret files in the store, e.g. .age for stores using age instead of GPG.
+func SetSecretSuffix(suffix string) error {
+	if suffix == "" || strings.Contains(suffix, "/") {
+		return fmt.Errorf("invalid secret suffix %q", suffix)
+	}
+	secretSuffix = suffix
+	return nil
+}
+
+// GetSecretSuffix returns the suffix of secret files in the store.
+func GetSecretSuffix() string {
+	return secretSuffix
+}
+
+// SetShowCommand sets the command template used for showing secrets. The template is split into arguments on
+// whitespace without involving a shell and each occurrence of {name} is replaced by the secret name.
+func SetShowCommand(template string) error {
+	fields := strings.Fields(template)
+	if len(fields) == 0 {
+		return fmt.Errorf("show command template is empty")
+	}
+	if !strings.Contains(template, showCommandNameSlot) {
+		return fmt.Errorf("show command template %q doesn't contain %s", template, showCommandNameSlot)
+	}
+	showCommand = fields
+	return nil
+}
+
+func getShowCommand(secretName string) (string, []string) {
+	var args []string
+	for _, field := range showCommand[1:] {
+		args = append(args, strings.Replace(field, showCommandNameSlot, secretName, -1))
+	}
+	if remote != nil {
+		return getRemoteCommand(showCommand[0], args)
+	}
+	return showCommand[0], args
+}
+
+func getSecretContent(ctx context.Context, secretName string) ([]byte, error) {
+	if snapshotWindow > 0 {
+		name := strings.TrimSuffix(secretName, secretSuffix)
+		return getSnapshotContent(name, func() ([]byte, error) {
+			return getDecryptedContent(ctx, name)
+		})
+	}
+	return getDecryptedContent(ctx, secretName)
+}
+
+func getDecryptedContent(ctx context.Context, secretName string) ([]byte, error) {
+	if source != nil {
+		return getSourceContent(ctx, strings.TrimSuffix(secretName, secretSuffix))
+	}
+	return showSecretContent(ctx, secretName)
+}
+
+// showSecretContent runs the show command for a secret and returns its output.
+func showSecretContent(ctx context.Context, secretName string) ([]byte, error) {
 	secretName = strings.TrimSuffix(secretName, secretSuffix)
-	cmd := exec.Command("pass", secretName)
-	stdout := bytes.Buffer{}
-	cmd.Stdout = &stdout
-	err := cmd.Run()
+	name, args := getShowCommand(secretName)
+	output, err := readCommand(ctx, name, args...)
+	if err != nil {
+		return []byte{}, fmt.Errorf("error getting secret %s: %w", secretName, err)
+	}
+	return output, nil
+}
+
+// openSecret starts showing a secret, returning a reader for its content. Secrets are read from their snapshots as a
+// whole rather than streamed if snapshots are enabled.
+func openSecret(ctx context.Context, secretName string) (io.ReadCloser, error) {
+	secretName = strings.TrimSuffix(secretName, secretSuffix)
+	if snapshotWindow > 0 {
+		content, err := getSecretContent(ctx, secretName)
+		if err != nil {
+			return nil, err
+		}
+		return decodeOutput(ioutil.NopCloser(bytes.NewReader(content))), nil
+	}
+	if source != nil {
+		output, err := openSourceSecret(ctx, secretName)
+		if err != nil {
+			return nil, err
+		}
+		return decodeOutput(output), nil
+	}
+	name, args := getShowCommand(secretName)
+	output, err := startCommand(ctx, name, args...)
 	if err != nil {
-		return []byte{}, fmt.Errorf("error getting secret %s: %s", secretName, err)
+		return nil, fmt.Errorf("error getting secret %s: %w", secretName, err)
 	}
-	output, err := ioutil.ReadAll(&stdout)
-	return output, err
+	return decodeOutput(output), nil
 }
 
-func GetSecret(secretName string) (string, error) {
-	output, err := getSecretContent(secretName)
+// GetSecret returns the decrypted content of a secret, stopping the show command if the context is done first.
+func GetSecret(ctx context.Context, secretName string) (string, error) {
+	output, err := getSecretContent(ctx, secretName)
+	if err == nil {
+		output, err = decodeContent(output)
+	}
 	if err != nil {
-		return "", fmt.Errorf("error reading secret %s: %s", secretName, err)
+		return "", fmt.Errorf("error reading secret %s: %w", secretName, err)
 	}
 	return string(output), nil
 }
 
+// GetSecretDigest returns the hex encoded SHA-256 digest of a secret's decrypted content.
+func GetSecretDigest(ctx context.Context, secretName string) (string, error) {
+	output, err := getSecretContent(ctx, secretName)
+	if err != nil {
+		return "", fmt.Errorf("error getting digest of secret %s: %w", secretName, err)
+	}
+	sum := sha256.Sum256(output)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// GetFirstLine returns the first line of a secret, or its lines up to the first blank line if passwords end at blank
+// lines, trimmed if first lines are trimmed.
 func GetFirstLine(secretBody string) (string, error) {
 	lines := strings.Split(secretBody, "\n")
 	if len(lines) == 0 {
 		return "", fmt.Errorf("couldn't find any lines in secret body")
 	}
-	return lines[0], nil
+	value, found := findPasswordField(lines)
+	if found {
+		return value, nil
+	}
+	password, _ := splitPassword(lines)
+	return formatFirstLine(password), nil
 }
 
-func GetSecretSize(secretName string) (secretSize SecretSize, err error) {
-	secretBody, err := GetSecret(secretName)
-	if err != nil {
-		return secretSize, fmt.Errorf("error getting secret body for %s: %s", secretName, err)
+// formatFirstLine returns a first line as it's served by first line files, with just the value of keyed lines if keys
+// are stripped, or trimmed if first lines are trimmed.
+func formatFirstLine(line string) string {
+	if stripFirstLineKey {
+		value, keyed := getKeyedValue(line)
+		if keyed {
+			return value
+		}
+	}
+	if trimFirstLine {
+		return strings.Trim(line, firstLineWhitespace)
+	}
+	return line
+}
+
+// sizeCounter counts the bytes written to it and the bytes before the first newline, or before the first blank line if
+// passwords end at blank lines, with and without the whitespace around them.
+type sizeCounter struct {
+	size             SecretSize
+	firstLineCounted bool
+	// Whitespace at the start of the first line, and at its end so far
+	leadingSpace  uint64
+	trailingSpace uint64
+	nonSpaceSeen  bool
+	// The first line so far, for telling whether it's keyed
+	firstLine bytes.Buffer
+	// The current line of the password until it ends, and the number of lines of the password before it
+	passwordLine  []byte
+	passwordLines int
+	// The current line while looking for the password field
+	fieldLine []byte
+}
+
+func (c *sizeCounter) countFirstLine(line []byte) {
+	c.firstLine.Write(line)
+	c.size.FirstLineSize += uint64(len(line))
+	for _, b := range line {
+		if strings.IndexByte(firstLineWhitespace, b) < 0 {
+			c.nonSpaceSeen = true
+			c.trailingSpace = 0
+		} else if c.nonSpaceSeen {
+			c.trailingSpace++
+		} else {
+			c.leadingSpace++
+		}
+	}
+	c.size.TrimmedFirstLineSize = c.size.FirstLineSize - c.leadingSpace - c.trailingSpace
+}
+
+// countPasswordLines counts the lines of the password up to the first blank line, which may not be blank before it
+// ends.
+func (c *sizeCounter) countPasswordLines(p []byte) {
+	for !c.firstLineCounted && len(p) > 0 {
+		newline := bytes.IndexByte(p, '\n')
+		if newline < 0 {
+			c.passwordLine = append(c.passwordLine, p...)
+			return
+		}
+		c.passwordLine = append(c.passwordLine, p[:newline]...)
+		p = p[newline+1:]
+		c.endPasswordLine()
+	}
+}
+
+// endPasswordLine counts the current password line with the newline before it, or stops counting at a blank line.
+func (c *sizeCounter) endPasswordLine() {
+	if isBlank(string(c.passwordLine)) {
+		c.firstLineCounted = true
+		return
+	}
+	if c.passwordLines > 0 {
+		c.countFirstLine([]byte{'\n'})
+	}
+	c.countFirstLine(c.passwordLine)
+	c.passwordLines++
+	c.passwordLine = c.passwordLine[:0]
+}
+
+// countPasswordField looks for the password field in the lines, counting the size of its first value.
+func (c *sizeCounter) countPasswordField(p []byte) {
+	for !c.size.PasswordFieldFound && len(p) > 0 {
+		newline := bytes.IndexByte(p, '\n')
+		if newline < 0 {
+			c.fieldLine = append(c.fieldLine, p...)
+			return
+		}
+		c.fieldLine = append(c.fieldLine, p[:newline]...)
+		p = p[newline+1:]
+		c.endFieldLine()
+	}
+}
+
+func (c *sizeCounter) endFieldLine() {
+	value, found := findPasswordField([]string{string(c.fieldLine)})
+	if found {
+		c.size.PasswordFieldFound = true
+		c.size.PasswordFieldSize = uint64(len(value))
+	}
+	c.fieldLine = c.fieldLine[:0]
+}
+
+// finish counts the last line of the password if the content ends before a blank line, and checks the last line for
+// the password field.
+func (c *sizeCounter) finish() {
+	if passwordUntilBlank && !c.firstLineCounted && len(c.passwordLine) > 0 {
+		c.endPasswordLine()
+	}
+	if passwordField != "" && !c.size.PasswordFieldFound && len(c.fieldLine) > 0 {
+		c.endFieldLine()
 	}
-	contentsSize := len(secretBody)
+	c.size.UntilBlank = passwordUntilBlank
+	c.size.PasswordField = passwordField
+	c.size.InputEncoding = inputEncodingName
+}
 
-	firstLine, err := GetFirstLine(secretBody)
+func (c *sizeCounter) Write(p []byte) (int, error) {
+	if passwordField != "" {
+		c.countPasswordField(p)
+	}
+	if passwordUntilBlank {
+		c.countPasswordLines(p)
+	} else if !c.firstLineCounted {
+		newline := bytes.IndexByte(p, '\n')
+		if newline >= 0 {
+			c.countFirstLine(p[:newline])
+			c.firstLineCounted = true
+		} else {
+			c.countFirstLine(p)
+		}
+	}
+	c.size.ContentsSize += uint64(len(p))
+	return len(p), nil
+}
+
+// GetSecretSize determines the sizes of a secret's files by counting its content as it's being decrypted, without
+// keeping the content in memory.
+func GetSecretSize(ctx context.Context, secretName string) (secretSize SecretSize, err error) {
+	output, err := openSecret(ctx, secretName)
 	if err != nil {
-		return secretSize, fmt.Errorf("error determining first line for secret %s: %s", secretName, err)
+		return secretSize, fmt.Errorf("error getting secret body for %s: %w", secretName, err)
 	}
-	firstLineSize := len(firstLine)
 
-	secretSize = SecretSize{
-		ContentsSize:  uint64(contentsSize),
-		FirstLineSize: uint64(firstLineSize),
+	counter := sizeCounter{}
+	_, err = io.Copy(&counter, limitSecret(output))
+	if err == nil && exceedsMaxSecretSize(int64(counter.size.ContentsSize)) {
+		output.Close()
+		err = ErrSecretTooLarge
+	}
+	closeErr := output.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return secretSize, fmt.Errorf("error getting secret body for %s: %w", secretName, err)
 	}
+	counter.finish()
+	value, keyed := getKeyedValue(counter.firstLine.String())
+	counter.size.FirstLineKeyed = keyed
+	counter.size.FirstLineValueSize = uint64(len(value))
 
-	return
+	return counter.size, nil
 }
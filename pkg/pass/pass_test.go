@@ -1,13 +1,292 @@
 package pass
 
 import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
+func makeStore(t *testing.T, files ...string) string {
+	t.Helper()
+	storePath, err := ioutil.TempDir("", "passfuse-test")
+	if err != nil {
+		t.Fatalf("Error creating store: %s", err)
+	}
+	for _, file := range files {
+		filePath := path.Join(storePath, file)
+		err = os.MkdirAll(path.Dir(filePath), 0700)
+		if err != nil {
+			t.Fatalf("Error creating directory for %s: %s", file, err)
+		}
+		err = ioutil.WriteFile(filePath, []byte{}, 0600)
+		if err != nil {
+			t.Fatalf("Error creating file %s: %s", file, err)
+		}
+	}
+	return storePath
+}
+
+func childSecrets(node Node) []string {
+	var secrets []string
+	for _, child := range node.Children {
+		secrets = append(secrets, child.Secret)
+	}
+	return secrets
+}
+
 func TestParsing(t *testing.T) {
-	_, err := GetPassTree("")
+	storePath := makeStore(t, "foo.gpg", "bar/baz.gpg")
+	defer os.RemoveAll(storePath)
+	_, err := GetPassTree(storePath, "", ParseOptions{})
 	if err != nil {
 		t.Errorf("Error not nil: %s", err)
 	}
 }
 
+func TestStrictGpg(t *testing.T) {
+	storePath := makeStore(t, "mixed/notes.txt", "mixed/pw.gpg")
+	defer os.RemoveAll(storePath)
+
+	root, err := GetPassTree(storePath, "mixed", ParseOptions{StrictGpg: true})
+	if err != nil {
+		t.Fatalf("Error not nil: %s", err)
+	}
+	secrets := childSecrets(root)
+	if len(secrets) != 1 || secrets[0] != "mixed/pw.gpg" {
+		t.Errorf("Expected only mixed/pw.gpg, got %v", secrets)
+	}
+
+	root, err = GetPassTree(storePath, "mixed", ParseOptions{StrictGpg: false})
+	if err != nil {
+		t.Fatalf("Error not nil: %s", err)
+	}
+	secrets = childSecrets(root)
+	if len(secrets) != 2 {
+		t.Errorf("Expected both files without strict mode, got %v", secrets)
+	}
+}
+
+func TestTemplateFiles(t *testing.T) {
+	storePath := makeStore(t, "app/config.tmpl", "app/config.gpg")
+	defer os.RemoveAll(storePath)
+
+	root, err := GetPassTree(storePath, "app", ParseOptions{StrictGpg: true, Templates: true})
+	if err != nil {
+		t.Fatalf("Error not nil: %s", err)
+	}
+	secrets := childSecrets(root)
+	if len(secrets) != 1 || secrets[0] != "app/config.gpg" {
+		t.Errorf("Expected only app/config.gpg, got %v", secrets)
+	}
+	if len(root.Templates) != 1 || root.Templates[0] != "app/config.tmpl" {
+		t.Errorf("Expected the template app/config.tmpl, got %v", root.Templates)
+	}
+}
+
+func TestShowCommandTemplate(t *testing.T) {
+	defer SetShowCommand(DefaultShowCommand)
+	var command []string
+	SetCommandRunner(func(name string, args ...string) (io.ReadCloser, error) {
+		command = append([]string{name}, args...)
+		return ioutil.NopCloser(strings.NewReader("hunter2\n")), nil
+	})
+	defer SetCommandRunner(runCommand)
+
+	tests := []struct {
+		template string
+		expected []string
+	}{
+		{template: "pass show {name}", expected: []string{"pass", "show", "work/github"}},
+		{template: "gopass  show -o {name}", expected: []string{"gopass", "show", "-o", "work/github"}},
+		{template: "wrapper --secret={name}", expected: []string{"wrapper", "--secret=work/github"}},
+	}
+	for _, test := range tests {
+		err := SetShowCommand(test.template)
+		if err != nil {
+			t.Fatalf("Error setting template %q: %s", test.template, err)
+		}
+		_, err = GetSecret(context.Background(), "work/github.gpg")
+		if err != nil {
+			t.Fatalf("Error getting secret: %s", err)
+		}
+		if strings.Join(command, " ") != strings.Join(test.expected, " ") || len(command) != len(test.expected) {
+			t.Errorf("Expected command %q for template %q, got %q", test.expected, test.template, command)
+		}
+	}
+}
+
+func TestShowCommandTemplateValidation(t *testing.T) {
+	defer SetShowCommand(DefaultShowCommand)
+	for _, template := range []string{"", "  ", "pass show"} {
+		err := SetShowCommand(template)
+		if err == nil {
+			t.Errorf("Expected template %q to be rejected", template)
+		}
+	}
+}
+
+func TestMaxSecretSizeStopsCommand(t *testing.T) {
+	SetMaxSecretSize(16)
+	defer SetMaxSecretSize(0)
+
+	// yes never stops writing, so this only finishes if the output limit stops it.
+	_, err := readCommand(context.Background(), "yes")
+	if err != ErrSecretTooLarge {
+		t.Errorf("Expected ErrSecretTooLarge, got %v", err)
+	}
+
+	output, err := readCommand(context.Background(), "echo", "hunter2")
+	if err != nil {
+		t.Fatalf("Error running command under the limit: %s", err)
+	}
+	if string(output) != "hunter2\n" {
+		t.Errorf("Unexpected output %q", output)
+	}
+}
+
+func TestPrefixTrailingSlash(t *testing.T) {
+	storePath := makeStore(t, "work/github.gpg", "work/ops/aws.gpg", "personal/mail.gpg")
+	defer os.RemoveAll(storePath)
+
+	for _, prefixes := range [][]string{{"work", "work/", "/work"}, {"work/github", "work/github/"}, {"", "/"}} {
+		expected, err := GetPassTree(storePath, prefixes[0], ParseOptions{})
+		if err != nil {
+			t.Fatalf("Error parsing with prefix %s: %s", prefixes[0], err)
+		}
+		for _, prefix := range prefixes[1:] {
+			root, err := GetPassTree(storePath, prefix, ParseOptions{})
+			if err != nil {
+				t.Fatalf("Error parsing with prefix %s: %s", prefix, err)
+			}
+			if !reflect.DeepEqual(root, expected) {
+				t.Errorf("Expected prefix %q to yield %v like %q, got %v", prefix, expected, prefixes[0], root)
+			}
+		}
+	}
+}
+
+func TestDirectoryNamedLikeSecret(t *testing.T) {
+	storePath := makeStore(t, "work/github.gpg", "work/github/token.gpg")
+	defer os.RemoveAll(storePath)
+
+	root, err := GetPassTree(storePath, "", ParseOptions{})
+	if err != nil {
+		t.Fatalf("Error parsing store: %s", err)
+	}
+	var secrets []string
+	for _, leaf := range GetLeaves(root) {
+		secrets = append(secrets, leaf.Secret)
+	}
+	expected := []string{"work/github/token.gpg", "work/github.gpg"}
+	if !reflect.DeepEqual(secrets, expected) {
+		t.Errorf("Expected secrets %v for a directory next to a secret with its name, got %v", expected, secrets)
+	}
+}
+
+func TestCanceledCommandStops(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		cancel()
+	}()
+
+	// sleep doesn't write any output, so this only finishes early if cancelling stops it.
+	start := time.Now()
+	_, err := readCommand(ctx, "sleep", "10")
+	if err != context.Canceled {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("Expected the command to be stopped when cancelled")
+	}
+}
+
+func TestCommandTimeout(t *testing.T) {
+	SetCommandTimeout(100 * time.Millisecond)
+	defer SetCommandTimeout(0)
+
+	start := time.Now()
+	_, err := readCommand(context.Background(), "sleep", "10")
+	if err != context.DeadlineExceeded {
+		t.Errorf("Expected context.DeadlineExceeded, got %v", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("Expected the command to be stopped when timing out")
+	}
+
+	output, err := readCommand(context.Background(), "echo", "hunter2")
+	if err != nil || string(output) != "hunter2\n" {
+		t.Errorf("Expected a command finishing in time to succeed, got %q and %v", output, err)
+	}
+}
+
+func TestCommandStderr(t *testing.T) {
+	_, err := readCommand(context.Background(), "sh", "-c", "echo 'gpg: decryption failed: No pinentry' >&2; exit 2")
+	if !errors.Is(err, ErrAgentLocked) {
+		t.Errorf("Expected ErrAgentLocked, got %v", err)
+	}
+
+	_, err = readCommand(context.Background(), "sh", "-c",
+		"echo 'gpg: public key decryption failed: Card not present' >&2; exit 2")
+	if !errors.Is(err, ErrCardMissing) || !strings.Contains(err.Error(), "Card not present") {
+		t.Errorf("Expected ErrCardMissing including stderr, got %v", err)
+	}
+
+	_, err = readCommand(context.Background(), "sh", "-c", "echo 'gpg: decryption failed: No secret key' >&2; exit 2")
+	if err == nil || errors.Is(err, ErrAgentLocked) || !strings.Contains(err.Error(), "No secret key") {
+		t.Errorf("Expected an error including stderr, got %v", err)
+	}
+}
+
+func TestGnupgHome(t *testing.T) {
+	gnupgHome, err := ioutil.TempDir("", "passfuse-gnupg")
+	if err != nil {
+		t.Fatalf("Error creating GPG home: %s", err)
+	}
+	defer os.RemoveAll(gnupgHome)
+	err = SetGnupgHome(gnupgHome)
+	if err != nil {
+		t.Fatalf("Error setting GPG home: %s", err)
+	}
+	defer SetGnupgHome("")
+
+	output, err := readCommand(context.Background(), "sh", "-c", `printf %s "$GNUPGHOME"`)
+	if err != nil {
+		t.Fatalf("Error running command: %s", err)
+	}
+	if string(output) != gnupgHome {
+		t.Errorf("Expected GNUPGHOME to be %s, got %s", gnupgHome, output)
+	}
+
+	err = SetGnupgHome(path.Join(gnupgHome, "missing"))
+	if err == nil {
+		t.Errorf("Expected a missing GPG home to be rejected")
+	}
+}
+
+func TestStorePathNotDirectory(t *testing.T) {
+	storePath := makeStore(t, "store")
+	defer os.RemoveAll(storePath)
+	err := os.Symlink(path.Join(storePath, "missing"), path.Join(storePath, "dangling"))
+	if err != nil {
+		t.Fatalf("Error creating symlink: %s", err)
+	}
+
+	for name, expected := range map[string]string{
+		"store":    "is not a directory",
+		"missing":  "doesn't exist",
+		"dangling": "doesn't exist",
+	} {
+		_, err := GetPassTree(path.Join(storePath, name), "", ParseOptions{})
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected an error containing %q for store %s, got %v", expected, name, err)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package pass
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+)
+
+const gpgIdFile = ".gpg-id"
+
+// GetEffectiveRecipients returns the content of the .gpg-id file which applies to a secret, the one in the nearest
+// directory from the secret's up to the root of the store, like pass uses for encrypting the secret.
+func GetEffectiveRecipients(storePath, secretName string) (string, error) {
+	return getRecipients(storePath, path.Dir(path.Clean("/"+secretName)), "secret "+secretName)
+}
+
+// GetDirRecipients returns the content of the .gpg-id file which applies to the secrets of a directory relative to the
+// store root, the one in the directory or its nearest parent.
+func GetDirRecipients(storePath, dir string) (string, error) {
+	return getRecipients(storePath, path.Clean("/"+dir), "directory "+dir)
+}
+
+// getRecipients returns the content of the nearest .gpg-id file from a directory up to the root of the store, with
+// errors naming what the recipients are for.
+func getRecipients(storePath, dir, subject string) (string, error) {
+	storePath = GetStorePath(storePath)
+	for {
+		content, err := ioutil.ReadFile(path.Join(storePath, dir, gpgIdFile))
+		if err == nil {
+			return string(content), nil
+		}
+		if !os.IsNotExist(err) {
+			return "", fmt.Errorf("error reading recipients of %s: %w", subject, err)
+		}
+		if dir == "/" {
+			return "", fmt.Errorf("no %s file applies to %s: %w", gpgIdFile, subject, os.ErrNotExist)
+		}
+		dir = path.Dir(dir)
+	}
+}
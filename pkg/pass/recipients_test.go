@@ -0,0 +1,63 @@
+package pass
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestGetEffectiveRecipients(t *testing.T) {
+	storePath := makeStore(t, "work/ops/ci/deploy.gpg", "work/team/wiki.gpg", "work/github.gpg")
+	defer os.RemoveAll(storePath)
+	for dir, recipients := range map[string]string{"": "me@example.com\n", "work/team": "team@example.com\n"} {
+		err := ioutil.WriteFile(path.Join(storePath, dir, gpgIdFile), []byte(recipients), 0600)
+		if err != nil {
+			t.Fatalf("Error writing %s: %s", gpgIdFile, err)
+		}
+	}
+
+	for secret, expected := range map[string]string{
+		"work/ops/ci/deploy.gpg": "me@example.com\n",
+		"work/github.gpg":        "me@example.com\n",
+		"work/team/wiki.gpg":     "team@example.com\n",
+	} {
+		recipients, err := GetEffectiveRecipients(storePath, secret)
+		if err != nil {
+			t.Fatalf("Error getting recipients of %s: %s", secret, err)
+		}
+		if recipients != expected {
+			t.Errorf("Expected recipients %q for %s, got %q", expected, secret, recipients)
+		}
+	}
+}
+
+func TestNoEffectiveRecipients(t *testing.T) {
+	storePath := makeStore(t, "work/github.gpg")
+	defer os.RemoveAll(storePath)
+
+	_, err := GetEffectiveRecipients(storePath, "work/github.gpg")
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected a not exist error without a %s, got %v", gpgIdFile, err)
+	}
+}
+
+func TestGetDirRecipients(t *testing.T) {
+	storePath := makeStore(t, "work/ops/deploy.gpg")
+	defer os.RemoveAll(storePath)
+	err := ioutil.WriteFile(path.Join(storePath, gpgIdFile), []byte("me@example.com\n"), 0600)
+	if err != nil {
+		t.Fatalf("Error writing %s: %s", gpgIdFile, err)
+	}
+
+	for _, dir := range []string{"", "work/ops"} {
+		recipients, err := GetDirRecipients(storePath, dir)
+		if err != nil {
+			t.Fatalf("Error getting recipients of %q: %s", dir, err)
+		}
+		if recipients != "me@example.com\n" {
+			t.Errorf("Expected the top-level recipients for %q, got %q", dir, recipients)
+		}
+	}
+}
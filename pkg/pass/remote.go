@@ -0,0 +1,139 @@
+package pass
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Remote is a password store on a remote host, accessed over SSH. Remote stores are experimental.
+type Remote struct {
+	// Destination for ssh, e.g. user@host
+	Host string
+	// Path of the password store on the remote host
+	Path string
+}
+
+var (
+	remote         *Remote
+	remoteSessions chan struct{}
+)
+
+// ParseRemote parses a remote store given as [user@]host:path.
+func ParseRemote(spec string) (Remote, error) {
+	separator := strings.Index(spec, ":")
+	if separator <= 0 || separator == len(spec)-1 {
+		return Remote{}, fmt.Errorf("remote store %q is not in the form [user@]host:path", spec)
+	}
+	return Remote{Host: spec[:separator], Path: strings.TrimRight(spec[separator+1:], "/")}, nil
+}
+
+// SetRemote makes the tree to be built from and secrets to be shown on a remote store, running at most the given
+// number of SSH sessions concurrently. Authentication relies on the existing SSH agent and configuration.
+func SetRemote(store Remote, sessions int) {
+	remote = &store
+	remoteSessions = make(chan struct{}, sessions)
+}
+
+// shellQuote quotes an argument for the remote shell which ssh passes the command to.
+func shellQuote(arg string) string {
+	return "'" + strings.Replace(arg, "'", `'\''`, -1) + "'"
+}
+
+// quoteRemotePath quotes a path on the remote host, leaving a leading ~ unquoted so that the remote shell expands it to
+// the home directory, e.g. for host:~/.password-store.
+func quoteRemotePath(remotePath string) string {
+	if remotePath == "~" {
+		return remotePath
+	}
+	if strings.HasPrefix(remotePath, "~/") {
+		return "~/" + shellQuote(remotePath[2:])
+	}
+	return shellQuote(remotePath)
+}
+
+// getRemoteCommand wraps a command to run it on the remote host, in the remote password store.
+func getRemoteCommand(name string, args []string) (string, []string) {
+	quoted := []string{"PASSWORD_STORE_DIR=" + quoteRemotePath(remote.Path), shellQuote(name)}
+	for _, arg := range args {
+		quoted = append(quoted, shellQuote(arg))
+	}
+	return "ssh", []string{remote.Host, "--", strings.Join(quoted, " ")}
+}
+
+// remoteSession holds a remote session slot until the output of the command is closed.
+type remoteSession struct {
+	io.ReadCloser
+}
+
+func (s remoteSession) Close() error {
+	defer func() { <-remoteSessions }()
+	return s.ReadCloser.Close()
+}
+
+// startSessionCommand starts a command, waiting for a free session slot when using a remote store. The command is
+// stopped when the context is done.
+func startSessionCommand(ctx context.Context, name string, args ...string) (io.ReadCloser, error) {
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if remote == nil {
+		output, err := commandRunner(name, args...)
+		if err != nil {
+			return nil, err
+		}
+		return withContext(ctx, output), nil
+	}
+	select {
+	case remoteSessions <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	output, err := commandRunner(name, args...)
+	if err != nil {
+		<-remoteSessions
+		return nil, err
+	}
+	return withContext(ctx, remoteSession{output}), nil
+}
+
+// listRemoteSecrets lists the secrets of the remote store, relative to the store path. The listing is run in the
+// store, so that the paths it has are relative to it, however the remote shell expands the store path.
+func listRemoteSecrets() ([]string, error) {
+	listCommand := fmt.Sprintf("cd %s && find . -type f -name %s", quoteRemotePath(remote.Path),
+		shellQuote("*"+secretSuffix))
+	output, err := readCommandOutput(context.Background(), "ssh", remote.Host, "--", listCommand)
+	if err != nil {
+		return nil, fmt.Errorf("error listing secrets on %s: %w", remote.Host, err)
+	}
+
+	var secrets []string
+	for _, line := range strings.Split(string(output), "\n") {
+		secret := strings.TrimPrefix(line, "./")
+		if secret == "" || secret == line {
+			continue
+		}
+		hidden := false
+		for _, component := range strings.Split(secret, "/") {
+			if strings.HasPrefix(component, ".") {
+				hidden = true
+			}
+		}
+		if !hidden {
+			secrets = append(secrets, secret)
+		}
+	}
+	sort.Strings(secrets)
+	return secrets, nil
+}
+
+// getRemotePassTree builds the tree of secrets under the prefix from a listing of the remote store.
+func getRemotePassTree(prefix string) (Node, error) {
+	secrets, err := listRemoteSecrets()
+	if err != nil {
+		return Node{}, err
+	}
+	return getListedPassTree(prefix, secrets), nil
+}
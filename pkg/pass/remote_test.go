@@ -0,0 +1,105 @@
+package pass
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRemote(t *testing.T) {
+	store, err := ParseRemote("user@host:/home/user/.password-store/")
+	if err != nil {
+		t.Fatalf("Error parsing remote: %s", err)
+	}
+	if store.Host != "user@host" || store.Path != "/home/user/.password-store" {
+		t.Errorf("Unexpected remote %v", store)
+	}
+	for _, spec := range []string{"host", ":path", "host:"} {
+		_, err = ParseRemote(spec)
+		if err == nil {
+			t.Errorf("Expected remote %q to be rejected", spec)
+		}
+	}
+
+	SetRemote(store, 2)
+	defer func() { remote = nil }()
+	var commands [][]string
+	listing := "./work/github.gpg\n./work/ops/aws.gpg\n./.git/x.gpg\n./mail.gpg\n"
+	SetCommandRunner(func(name string, args ...string) (io.ReadCloser, error) {
+		commands = append(commands, append([]string{name}, args...))
+		if strings.Contains(args[len(args)-1], "find") {
+			return ioutil.NopCloser(strings.NewReader(listing)), nil
+		}
+		return ioutil.NopCloser(strings.NewReader("hunter2\n")), nil
+	})
+	defer SetCommandRunner(runCommand)
+
+	root, err := GetPassTree("", "work", ParseOptions{})
+	if err != nil {
+		t.Fatalf("Error building remote tree: %s", err)
+	}
+	expected := Node{Secret: "work", Children: []Node{
+		{IsLeaf: true, Secret: "work/github.gpg"},
+		{Secret: "work/ops", Children: []Node{{IsLeaf: true, Secret: "work/ops/aws.gpg"}}},
+	}}
+	if !reflect.DeepEqual(root, expected) {
+		t.Errorf("Expected tree %v, got %v", expected, root)
+	}
+
+	_, err = GetSecret(context.Background(), "work/it's.gpg")
+	if err != nil {
+		t.Fatalf("Error getting remote secret: %s", err)
+	}
+	showCommand := commands[len(commands)-1]
+	expectedCommand := []string{"ssh", "user@host", "--",
+		`PASSWORD_STORE_DIR='/home/user/.password-store' 'pass' 'show' 'work/it'\''s'`}
+	if !reflect.DeepEqual(showCommand, expectedCommand) {
+		t.Errorf("Expected show command %q, got %q", expectedCommand, showCommand)
+	}
+	if len(remoteSessions) != 0 {
+		t.Errorf("Expected sessions to be released, %d still held", len(remoteSessions))
+	}
+}
+
+func TestRemoteHomePath(t *testing.T) {
+	store, err := ParseRemote("host:~/.password-store")
+	if err != nil {
+		t.Fatalf("Error parsing remote: %s", err)
+	}
+	SetRemote(store, 1)
+	defer func() { remote = nil }()
+	SetMaxSecretSize(16)
+	defer SetMaxSecretSize(0)
+	var commands []string
+	// The listing is larger than the maximum secret size, which only applies to secrets.
+	listing := "./work/github.gpg\n./work/gitlab.gpg\n./mail.gpg\n"
+	SetCommandRunner(func(name string, args ...string) (io.ReadCloser, error) {
+		commands = append(commands, args[len(args)-1])
+		if strings.Contains(args[len(args)-1], "find") {
+			return ioutil.NopCloser(strings.NewReader(listing)), nil
+		}
+		return ioutil.NopCloser(strings.NewReader("hunter2\n")), nil
+	})
+	defer SetCommandRunner(runCommand)
+
+	secrets, err := listRemoteSecrets()
+	if err != nil {
+		t.Fatalf("Error listing remote secrets: %s", err)
+	}
+	expected := []string{"mail.gpg", "work/github.gpg", "work/gitlab.gpg"}
+	if !reflect.DeepEqual(secrets, expected) {
+		t.Errorf("Expected secrets %v, got %v", expected, secrets)
+	}
+	_, err = GetSecret(context.Background(), "mail.gpg")
+	if err != nil {
+		t.Fatalf("Error getting remote secret: %s", err)
+	}
+	expectedCommands := []string{`cd ~/'.password-store' && find . -type f -name '*.gpg'`,
+		`PASSWORD_STORE_DIR=~/'.password-store' 'pass' 'show' 'mail'`}
+	if !reflect.DeepEqual(commands, expectedCommands) {
+		t.Errorf("Expected commands %q, got %q", expectedCommands, commands)
+	}
+}
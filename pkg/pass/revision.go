@@ -0,0 +1,84 @@
+package pass
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// RevisionSource reads the secrets of a git backed password store as they were at a revision, e.g. a commit, for
+// looking at the store as it was without checking the revision out. Secrets are listed from the git tree of the
+// revision and decrypted with gpg from the blobs of the revision, so other encryption tools aren't supported.
+type RevisionSource struct {
+	Path     string
+	Revision string
+}
+
+func (s RevisionSource) storePath() string {
+	return GetStorePath(s.Path)
+}
+
+// List returns the names of the secrets in the tree of the revision, leaving out dotfiles and files in dot
+// directories like the store does.
+func (s RevisionSource) List() ([]string, error) {
+	output, err := readCommandOutput(context.Background(), "git", "-C", s.storePath(), "ls-tree", "-r", "--name-only",
+		"-z", s.Revision)
+	if err != nil {
+		return nil, fmt.Errorf("error listing secrets at revision %s, check that the store is a git repository "+
+			"with that revision: %w", s.Revision, err)
+	}
+	var names []string
+	for _, file := range strings.Split(string(output), "\x00") {
+		if !strings.HasSuffix(file, secretSuffix) || isDotPath(file) {
+			continue
+		}
+		names = append(names, strings.TrimSuffix(file, secretSuffix))
+	}
+	return names, nil
+}
+
+func isDotPath(file string) bool {
+	for _, component := range strings.Split(file, "/") {
+		if strings.HasPrefix(component, ".") {
+			return true
+		}
+	}
+	return false
+}
+
+// Get decrypts the blob of a secret at the revision. The encrypted blob is written to a temporary file for gpg, as
+// commands don't get any input. Only the decrypted content is limited to the maximum secret size, and it's returned as
+// gpg outputs it, which is transcoded from the input encoding like the output of the show command.
+func (s RevisionSource) Get(ctx context.Context, name string) ([]byte, error) {
+	blob, err := readCommandOutput(ctx, "git", "-C", s.storePath(), "show", s.Revision+":"+name+secretSuffix)
+	if err != nil {
+		return nil, err
+	}
+	file, err := ioutil.TempFile("", "passfuse-revision-*"+secretSuffix)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(file.Name())
+	_, err = file.Write(blob)
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return readCommand(ctx, "gpg", "--quiet", "--decrypt", file.Name())
+}
+
+func (s RevisionSource) FirstLine(ctx context.Context, name string) (string, error) {
+	content, err := s.Get(ctx, name)
+	if err == nil {
+		content, err = decodeContent(content)
+	}
+	if err != nil {
+		return "", err
+	}
+	return getRawFirstLine(string(content)), nil
+}
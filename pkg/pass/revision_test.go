@@ -0,0 +1,108 @@
+package pass
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRevisionSource(t *testing.T) {
+	var commands []string
+	SetCommandRunner(func(name string, args ...string) (io.ReadCloser, error) {
+		commands = append(commands, name+" "+strings.Join(args, " "))
+		switch {
+		case name == "git" && args[2] == "ls-tree":
+			return ioutil.NopCloser(strings.NewReader(
+				".gpg-id\x00work/github.gpg\x00work/notes.txt\x00.extensions/x.gpg\x00mail.gpg\x00")), nil
+		case name == "git" && args[2] == "show" && args[3] == "1a2b3c4:work/github.gpg":
+			return ioutil.NopCloser(strings.NewReader("encrypted")), nil
+		case name == "gpg":
+			blob, err := ioutil.ReadFile(args[len(args)-1])
+			if err != nil || string(blob) != "encrypted" {
+				t.Errorf("Expected gpg to decrypt the blob of the revision, got %q and %v", blob, err)
+			}
+			return ioutil.NopCloser(strings.NewReader("hunter2\nusername: foo\n")), nil
+		}
+		return nil, os.ErrNotExist
+	})
+	defer SetCommandRunner(runCommand)
+
+	source := RevisionSource{Path: "/store", Revision: "1a2b3c4"}
+	names, err := source.List()
+	if err != nil {
+		t.Fatalf("Error listing secrets: %s", err)
+	}
+	if !reflect.DeepEqual(names, []string{"work/github", "mail"}) {
+		t.Errorf("Expected the secrets of the revision, got %v", names)
+	}
+
+	content, err := source.Get(context.Background(), "work/github")
+	if err != nil || string(content) != "hunter2\nusername: foo\n" {
+		t.Errorf("Expected the decrypted secret of the revision, got %q and %v", content, err)
+	}
+	line, err := source.FirstLine(context.Background(), "work/github")
+	if err != nil || line != "hunter2" {
+		t.Errorf("Expected the first line of the secret, got %q and %v", line, err)
+	}
+	if commands[0] != "git -C /store ls-tree -r --name-only -z 1a2b3c4" ||
+		commands[1] != "git -C /store show 1a2b3c4:work/github.gpg" {
+		t.Errorf("Expected git commands for the revision, got %v", commands)
+	}
+
+	_, err = source.Get(context.Background(), "mail")
+	if err == nil {
+		t.Errorf("Expected getting a secret missing from the revision to fail")
+	}
+}
+
+func TestRevisionSourceTranscodesOnce(t *testing.T) {
+	SetCommandRunner(func(name string, args ...string) (io.ReadCloser, error) {
+		if name == "gpg" {
+			return ioutil.NopCloser(strings.NewReader("caf\xe9\n")), nil
+		}
+		// The encrypted blob is larger than the maximum secret size, which only applies to what it decrypts to.
+		return ioutil.NopCloser(strings.NewReader("encrypted blob")), nil
+	})
+	defer SetCommandRunner(runCommand)
+	err := SetInputEncoding("ISO-8859-1")
+	if err != nil {
+		t.Fatalf("Error setting input encoding: %s", err)
+	}
+	defer SetInputEncoding("")
+	SetMaxSecretSize(8)
+	defer SetMaxSecretSize(0)
+	SetSource(RevisionSource{Path: "/store", Revision: "1a2b3c4"})
+	defer SetSource(nil)
+
+	secret, err := GetSecret(context.Background(), "work/github.gpg")
+	if err != nil || secret != "café\n" {
+		t.Errorf("Expected the secret transcoded once, got %q and %v", secret, err)
+	}
+	line, err := GetSecretFirstLine(context.Background(), "work/github.gpg")
+	if err != nil || line != "café" {
+		t.Errorf("Expected the first line transcoded once, got %q and %v", line, err)
+	}
+}
+
+func TestRevisionSourceFirstLineFormattedOnce(t *testing.T) {
+	SetCommandRunner(func(name string, args ...string) (io.ReadCloser, error) {
+		if name == "gpg" {
+			return ioutil.NopCloser(strings.NewReader("psk: guest: welcome\n")), nil
+		}
+		return ioutil.NopCloser(strings.NewReader("encrypted")), nil
+	})
+	defer SetCommandRunner(runCommand)
+	SetStripFirstLineKey(true)
+	defer SetStripFirstLineKey(false)
+	SetSource(RevisionSource{Path: "/store", Revision: "1a2b3c4"})
+	defer SetSource(nil)
+
+	line, err := GetSecretFirstLine(context.Background(), "wifi.gpg")
+	if err != nil || line != "guest: welcome" {
+		t.Errorf("Expected only the key of the first line to be stripped, got %q and %v", line, err)
+	}
+}
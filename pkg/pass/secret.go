@@ -0,0 +1,123 @@
+package pass
+
+import (
+	"strings"
+)
+
+const PasswordField = "password"
+
+// Secret is a secret body split into the password on its first line, or the lines up to the first blank line if
+// passwords end at blank lines, and the fields on the following lines.
+type Secret struct {
+	Password string
+	// Fields in the order they appear in the secret, keyed by lowercased field name
+	Fields     map[string]string
+	FieldNames []string
+}
+
+// ParseSecret parses a secret body following the pass convention of having the password on the first line and
+// optional "key: value" fields on the following lines. Lines which aren't fields are ignored, as are fields with names
+// containing slashes as they can't be used as file names. When a field occurs more than once its first value is used.
+// If passwords end at blank lines, the password spans the lines up to the first blank line and the fields follow it.
+func ParseSecret(body string) Secret {
+	password, rest := splitPassword(strings.Split(body, "\n"))
+	secret := Secret{Password: password, Fields: make(map[string]string)}
+	for _, line := range rest {
+		name, value, ok := parseFieldLine(line)
+		if !ok || name == PasswordField {
+			continue
+		}
+		if _, exists := secret.Fields[name]; exists {
+			continue
+		}
+		secret.Fields[name] = value
+		secret.FieldNames = append(secret.FieldNames, name)
+	}
+	return secret
+}
+
+// splitPassword splits the lines of a secret into the password and the lines following it. The password is the first
+// line, or the lines up to the first blank line if passwords end at blank lines, which is all of them if there is no
+// blank line.
+func splitPassword(lines []string) (string, []string) {
+	if !passwordUntilBlank {
+		return lines[0], lines[1:]
+	}
+	for i, line := range lines {
+		if isBlank(line) {
+			return strings.Join(lines[:i], "\n"), lines[i+1:]
+		}
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// findPasswordField returns the first value of the password field in the lines, if a password field is set and the
+// lines have it.
+func findPasswordField(lines []string) (string, bool) {
+	if passwordField == "" {
+		return "", false
+	}
+	for _, line := range lines {
+		name, value, ok := parseFieldLine(line)
+		if ok && name == passwordField {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+func isBlank(line string) bool {
+	return strings.TrimSpace(line) == ""
+}
+
+// parseFieldLine splits a "key: value" line into the lowercased field name and the value without the whitespace around
+// it, returning false for lines which aren't fields. Names which can't be file names, like "..", aren't fields.
+func parseFieldLine(line string) (name, value string, ok bool) {
+	separator := strings.Index(line, ":")
+	if separator < 0 {
+		return "", "", false
+	}
+	name = strings.ToLower(strings.TrimSpace(line[:separator]))
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return "", "", false
+	}
+	return name, strings.TrimSpace(line[separator+1:]), true
+}
+
+// getKeyedValue returns the value of a first line of the form "key: value", and whether the line has that form. Unlike
+// fields on the following lines, the separator has to be followed by whitespace or end the line, so that passwords
+// containing a colon aren't mistaken for fields. Passwords spanning several lines are never keyed.
+func getKeyedValue(line string) (string, bool) {
+	if strings.Contains(line, "\n") {
+		return "", false
+	}
+	_, value, ok := parseFieldLine(line)
+	separator := strings.Index(line, ":")
+	if !ok || (separator+1 < len(line) && line[separator+1] != ' ' && line[separator+1] != '\t') {
+		return "", false
+	}
+	return value, true
+}
+
+// GetField returns the value of a field, where the password field is the first line of the secret.
+func (s Secret) GetField(name string) (string, bool) {
+	if name == PasswordField {
+		return s.Password, true
+	}
+	value, found := s.Fields[name]
+	return value, found
+}
+
+// GetNonEmptyFields returns the names of the fields with non-empty values, starting with the password.
+func (s Secret) GetNonEmptyFields() []string {
+	var names []string
+	if s.Password != "" {
+		names = append(names, PasswordField)
+	}
+	for _, name := range s.FieldNames {
+		if s.Fields[name] != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
@@ -0,0 +1,45 @@
+package pass
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSecret(t *testing.T) {
+	secret := ParseSecret("hunter2\nUsername: foo\nurl: https://example.com:8443/login\nnotes\nempty:\nusername: bar\n" +
+		"a/b: c\n.: d\n..: e\n : f\n")
+
+	if secret.Password != "hunter2" {
+		t.Errorf("Unexpected password %q", secret.Password)
+	}
+	expected := map[string]string{"username": "foo", "url": "https://example.com:8443/login", "empty": ""}
+	if !reflect.DeepEqual(secret.Fields, expected) {
+		t.Errorf("Expected fields %v, got %v", expected, secret.Fields)
+	}
+	names := secret.GetNonEmptyFields()
+	if !reflect.DeepEqual(names, []string{"password", "username", "url"}) {
+		t.Errorf("Unexpected non-empty fields %v", names)
+	}
+	value, found := secret.GetField("password")
+	if !found || value != "hunter2" {
+		t.Errorf("Expected the password field to be the first line, got %q", value)
+	}
+}
+
+func TestParseSecretPasswordUntilBlank(t *testing.T) {
+	SetPasswordUntilBlank(true)
+	defer SetPasswordUntilBlank(false)
+
+	for body, expected := range map[string]Secret{
+		"hunter2\n\nusername: foo\n": {Password: "hunter2", Fields: map[string]string{"username": "foo"},
+			FieldNames: []string{"username"}},
+		"key line 1\nkey line 2\n\t\nusername: foo\nurl: example.com": {Password: "key line 1\nkey line 2",
+			Fields: map[string]string{"username": "foo", "url": "example.com"}, FieldNames: []string{"username", "url"}},
+		"hunter2\nusername: foo\n": {Password: "hunter2\nusername: foo", Fields: map[string]string{}},
+	} {
+		secret := ParseSecret(body)
+		if !reflect.DeepEqual(secret, expected) {
+			t.Errorf("Expected %+v for %q, got %+v", expected, body, secret)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package pass
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+// snapshot is what a secret decrypted to, and the version of its file in the store when it was decrypted. It's
+// forgotten by a timer once the window passes, so that secrets aren't kept decrypted in memory until the next read.
+type snapshot struct {
+	content []byte
+	version string
+	taken   time.Time
+	expiry  *time.Timer
+}
+
+var (
+	// Time reads of a secret are served from its last decryption, 0 disables snapshots
+	snapshotWindow time.Duration
+	// Store whose files the versions of snapshots are read from
+	snapshotStore string
+	// Snapshots of secrets keyed by name without the secret suffix
+	snapshotMutex sync.Mutex
+	snapshots     = make(map[string]*snapshot)
+)
+
+// SetSnapshotWindow sets how long reads of all files of a secret, e.g. its contents and its field files, are served
+// from the same decryption of the secret, so that tools reading several files of a secret get consistent content even
+// if the secret is edited in between. A snapshot ends early when the file of the secret in the store changes. A window
+// of 0 decrypts the secret for every read.
+func SetSnapshotWindow(storePath string, window time.Duration) {
+	snapshotStore = GetStorePath(storePath)
+	snapshotWindow = window
+}
+
+// GetSnapshotWindow returns how long reads of a secret are served from the same decryption, 0 if they aren't.
+func GetSnapshotWindow() time.Duration {
+	return snapshotWindow
+}
+
+// ClearSnapshots forgets the decrypted content of all snapshots.
+func ClearSnapshots() {
+	snapshotMutex.Lock()
+	defer snapshotMutex.Unlock()
+	for _, taken := range snapshots {
+		taken.expiry.Stop()
+	}
+	snapshots = make(map[string]*snapshot)
+}
+
+// forgetSnapshot forgets the snapshot of a secret, unless it has been replaced by another one. The mutex must be held.
+func forgetSnapshot(secretName string, taken *snapshot) {
+	if snapshots[secretName] == taken {
+		taken.expiry.Stop()
+		delete(snapshots, secretName)
+	}
+}
+
+// secretVersion identifies the version of the file of a secret by its modification time and size. Secrets of remote
+// stores and other sources don't have a version, their snapshots only end with the window.
+func secretVersion(secretName string) string {
+	if remote != nil || source != nil {
+		return ""
+	}
+	info, err := os.Stat(path.Join(snapshotStore, secretName+secretSuffix))
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%d-%d", info.ModTime().UnixNano(), info.Size())
+}
+
+// findSnapshot returns the snapshot of a secret if it's within the window and of the given version, forgetting it
+// otherwise. The mutex must be held.
+func findSnapshot(secretName, version string, now time.Time) (*snapshot, bool) {
+	taken, found := snapshots[secretName]
+	if !found {
+		return nil, false
+	}
+	if now.Sub(taken.taken) >= snapshotWindow || taken.version != version {
+		forgetSnapshot(secretName, taken)
+		return nil, false
+	}
+	return taken, true
+}
+
+// getSnapshotContent returns the content of a secret from its snapshot, and gets it otherwise, taking a new snapshot.
+// If reads decrypting the secret at the same time race, the first snapshot taken is served to all of them.
+func getSnapshotContent(secretName string, get func() ([]byte, error)) ([]byte, error) {
+	version := secretVersion(secretName)
+	snapshotMutex.Lock()
+	taken, found := findSnapshot(secretName, version, time.Now())
+	snapshotMutex.Unlock()
+	if found {
+		return taken.content, nil
+	}
+
+	content, err := get()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	snapshotMutex.Lock()
+	defer snapshotMutex.Unlock()
+	taken, found = findSnapshot(secretName, version, now)
+	if found {
+		return taken.content, nil
+	}
+	taken = &snapshot{content: content, version: version, taken: now}
+	taken.expiry = time.AfterFunc(snapshotWindow, func() {
+		snapshotMutex.Lock()
+		defer snapshotMutex.Unlock()
+		forgetSnapshot(secretName, taken)
+	})
+	snapshots[secretName] = taken
+	return content, nil
+}
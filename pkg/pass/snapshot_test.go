@@ -0,0 +1,96 @@
+package pass
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestSnapshotWindow(t *testing.T) {
+	storePath, err := ioutil.TempDir("", "passfuse-test")
+	if err != nil {
+		t.Fatalf("Error creating store: %s", err)
+	}
+	defer os.RemoveAll(storePath)
+	secretPath := path.Join(storePath, "foo.gpg")
+	err = ioutil.WriteFile(secretPath, []byte("v1"), 0600)
+	if err != nil {
+		t.Fatalf("Error creating secret: %s", err)
+	}
+	SetSnapshotWindow(storePath, time.Minute)
+	defer SetSnapshotWindow("", 0)
+	defer ClearSnapshots()
+	defer SetCommandRunner(runCommand)
+
+	started := 0
+	SetCommandRunner(countingRunner("hunter2\nusername: foo\n", &started))
+	body, err := GetSecret(context.Background(), "foo.gpg")
+	if err != nil || body != "hunter2\nusername: foo\n" {
+		t.Fatalf("Expected the secret, got %q, error %v", body, err)
+	}
+
+	// The secret is edited by decrypting to something else, but its file doesn't change.
+	SetCommandRunner(countingRunner("rotated\nusername: bar\n", &started))
+	stream := NewSecretStream(context.Background(), "foo.gpg", FirstLine)
+	defer stream.Close()
+	if line := readStream(t, stream, 0, 64); line != "hunter2" {
+		t.Errorf("Expected the first line of the snapshot, got %q", line)
+	}
+	size, err := GetSecretSize(context.Background(), "foo.gpg")
+	if err != nil || size.ContentsSize != uint64(len(body)) {
+		t.Errorf("Expected the size of the snapshot %d, got %d, error %v", len(body), size.ContentsSize, err)
+	}
+	if started != 1 {
+		t.Errorf("Expected reads within the window to decrypt the secret once, decrypted it %d times", started)
+	}
+
+	// Changing the file of the secret ends the snapshot.
+	err = ioutil.WriteFile(secretPath, []byte("v2 of the secret"), 0600)
+	if err != nil {
+		t.Fatalf("Error editing secret: %s", err)
+	}
+	body, err = GetSecret(context.Background(), "foo.gpg")
+	if err != nil || body != "rotated\nusername: bar\n" {
+		t.Errorf("Expected the edited secret, got %q, error %v", body, err)
+	}
+
+	// So does the window passing.
+	SetSnapshotWindow(storePath, time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	SetCommandRunner(countingRunner("rotated again\n", &started))
+	body, err = GetSecret(context.Background(), "foo.gpg")
+	if err != nil || body != "rotated again\n" {
+		t.Errorf("Expected the secret to be decrypted again after the window, got %q, error %v", body, err)
+	}
+}
+
+func TestSnapshotExpiry(t *testing.T) {
+	SetSnapshotWindow("", 10*time.Millisecond)
+	defer SetSnapshotWindow("", 0)
+	defer ClearSnapshots()
+	defer SetCommandRunner(runCommand)
+	started := 0
+	SetCommandRunner(countingRunner("hunter2\n", &started))
+
+	_, err := GetSecret(context.Background(), "foo.gpg")
+	if err != nil {
+		t.Fatalf("Error getting secret: %s", err)
+	}
+	// The snapshot is forgotten once the window passes, without another read.
+	deadline := time.Now().Add(time.Second)
+	for {
+		snapshotMutex.Lock()
+		remaining := len(snapshots)
+		snapshotMutex.Unlock()
+		if remaining == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the snapshot to be forgotten after the window")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,129 @@
+package pass
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+)
+
+// SecretSource is where secrets are read from, for serving secrets of password managers other than pass. Names are
+// relative to the root of the source and don't have the secret suffix, e.g. work/github.
+type SecretSource interface {
+	// List returns the names of all secrets.
+	List() ([]string, error)
+	// Get returns the content of a secret, which is transcoded from the input encoding if there is one.
+	Get(ctx context.Context, name string) ([]byte, error)
+	// FirstLine returns the first line of a secret as it is, which sources may be able to get without the whole secret.
+	// GetSecretFirstLine formats it like the first lines of the store.
+	FirstLine(ctx context.Context, name string) (string, error)
+}
+
+// Source of secrets other than the password store, nil for reading the password store with the show command. Like the
+// show command and the remote store, it's set once for the whole process rather than passed to every function reading
+// secrets.
+var source SecretSource
+
+// SetSource sets where secrets are read from. A nil source reads the password store with the show command, streaming
+// secrets rather than getting them as a whole. Features reading the files of the store, like history files, don't
+// work with other sources.
+func SetSource(secretSource SecretSource) {
+	source = secretSource
+}
+
+// getSourceContent gets a secret from the source, which fails if it exceeds the maximum secret size.
+func getSourceContent(ctx context.Context, secretName string) ([]byte, error) {
+	content, err := source.Get(ctx, secretName)
+	if err == nil && exceedsMaxSecretSize(int64(len(content))) {
+		err = ErrSecretTooLarge
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error getting secret %s: %w", secretName, err)
+	}
+	return content, nil
+}
+
+// openSourceSecret returns a reader for the content of a secret from the source.
+func openSourceSecret(ctx context.Context, secretName string) (io.ReadCloser, error) {
+	content, err := getSourceContent(ctx, secretName)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(content)), nil
+}
+
+// GetSecretFirstLine returns the first line of a secret, formatted like GetFirstLine does.
+func GetSecretFirstLine(ctx context.Context, secretName string) (string, error) {
+	if source == nil || passwordUntilBlank || passwordField != "" || snapshotWindow > 0 {
+		body, err := GetSecret(ctx, secretName)
+		if err != nil {
+			return "", err
+		}
+		return GetFirstLine(body)
+	}
+	secretName = strings.TrimSuffix(secretName, secretSuffix)
+	line, err := source.FirstLine(ctx, secretName)
+	if err != nil {
+		return "", fmt.Errorf("error reading secret %s: %w", secretName, err)
+	}
+	return formatFirstLine(line), nil
+}
+
+// getRawFirstLine returns the first line of a secret body without formatting it.
+func getRawFirstLine(secretBody string) string {
+	return strings.SplitN(secretBody, "\n", 2)[0]
+}
+
+// getSourcePassTree builds the tree of secrets under the prefix from the names listed by the source.
+func getSourcePassTree(prefix string) (Node, error) {
+	names, err := source.List()
+	if err != nil {
+		return Node{}, fmt.Errorf("error listing secrets: %w", err)
+	}
+	var secrets []string
+	for _, name := range names {
+		secrets = append(secrets, path.Clean(strings.TrimPrefix(name, "/"))+secretSuffix)
+	}
+	return getListedPassTree(prefix, secrets), nil
+}
+
+// addListedSecret adds a secret to the tree under root, creating the directories leading to it.
+func addListedSecret(root *Node, secret string) {
+	relative := strings.TrimPrefix(strings.TrimPrefix(secret, root.Secret), "/")
+	components := strings.Split(relative, "/")
+	node := root
+	for _, component := range components[:len(components)-1] {
+		dirSecret := path.Join(node.Secret, component)
+		var dir *Node
+		for i := range node.Children {
+			if node.Children[i].Secret == dirSecret && !node.Children[i].IsLeaf {
+				dir = &node.Children[i]
+			}
+		}
+		if dir == nil {
+			node.Children = append(node.Children, Node{Secret: dirSecret})
+			dir = &node.Children[len(node.Children)-1]
+		}
+		node = dir
+	}
+	node.Children = append(node.Children, Node{IsLeaf: true, Secret: secret})
+}
+
+// getListedPassTree builds the tree of secrets under the prefix from a listing of secrets with the secret suffix.
+func getListedPassTree(prefix string, secrets []string) Node {
+	root := Node{Secret: prefix}
+	for _, secret := range secrets {
+		if secret == prefix+secretSuffix {
+			// Like for local stores, a prefix naming a secret mounts only that secret.
+			rootPrefix, _ := path.Split(prefix)
+			return Node{Secret: strings.TrimRight(rootPrefix, "/"), Children: []Node{{IsLeaf: true, Secret: secret}}}
+		}
+		if prefix == "" || strings.HasPrefix(secret, prefix+"/") {
+			addListedSecret(&root, secret)
+		}
+	}
+	return root
+}
@@ -0,0 +1,76 @@
+package pass
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fakeSource serves secrets from memory, counting the secrets it gets.
+type fakeSource struct {
+	secrets map[string]string
+	gets    *int
+}
+
+func (s fakeSource) List() ([]string, error) {
+	var names []string
+	for name := range s.secrets {
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+func (s fakeSource) Get(ctx context.Context, name string) ([]byte, error) {
+	*s.gets++
+	content, found := s.secrets[name]
+	if !found {
+		return nil, os.ErrNotExist
+	}
+	return []byte(content), nil
+}
+
+func (s fakeSource) FirstLine(ctx context.Context, name string) (string, error) {
+	content, err := s.Get(ctx, name)
+	return strings.Split(string(content), "\n")[0], err
+}
+
+func TestSecretSource(t *testing.T) {
+	gets := 0
+	SetSource(fakeSource{secrets: map[string]string{"work/github": "hunter2\nuser: foo\n", "mail": "bar\n"},
+		gets: &gets})
+	defer SetSource(nil)
+	started := 0
+	SetCommandRunner(countingRunner("", &started))
+	defer SetCommandRunner(runCommand)
+
+	root, err := GetPassTree("/nonexistent", "work", ParseOptions{})
+	if err != nil {
+		t.Fatalf("Error getting tree: %s", err)
+	}
+	if !reflect.DeepEqual(childSecrets(root), []string{"work/github.gpg"}) {
+		t.Errorf("Expected the secrets under work, got %v", childSecrets(root))
+	}
+
+	body, err := GetSecret(context.Background(), "work/github.gpg")
+	if err != nil || body != "hunter2\nuser: foo\n" {
+		t.Errorf("Expected the secret from the source, got %q, error %v", body, err)
+	}
+	stream := NewSecretStream(context.Background(), "work/github.gpg", FirstLine)
+	defer stream.Close()
+	if content := readStream(t, stream, 0, 64); content != "hunter2" {
+		t.Errorf("Expected the first line from the source, got %q", content)
+	}
+	size, err := GetSecretSize(context.Background(), "work/github.gpg")
+	if err != nil || size.ContentsSize != uint64(len(body)) {
+		t.Errorf("Expected size %d, got %d, error %v", len(body), size.ContentsSize, err)
+	}
+	line, err := GetSecretFirstLine(context.Background(), "mail.gpg")
+	if err != nil || line != "bar" {
+		t.Errorf("Expected first line bar, got %q, error %v", line, err)
+	}
+	if gets != 4 || started != 0 {
+		t.Errorf("Expected secrets to be got from the source only, got %d, started %d commands", gets, started)
+	}
+}
@@ -0,0 +1,202 @@
+package pass
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"math"
+	"strings"
+	"sync"
+)
+
+// firstLineReader reads from a reader up to, but not including, the first newline.
+type firstLineReader struct {
+	reader io.Reader
+	done   bool
+}
+
+func (r *firstLineReader) Read(p []byte) (int, error) {
+	if r.done {
+		return 0, io.EOF
+	}
+	n, err := r.reader.Read(p)
+	newline := bytes.IndexByte(p[:n], '\n')
+	if newline >= 0 {
+		r.done = true
+		return newline, nil
+	}
+	return n, err
+}
+
+// readPassword reads the lines of a password up to the first blank line, without reading the rest of the secret.
+func readPassword(reader io.Reader) (string, error) {
+	lines := bufio.NewReader(reader)
+	var password []string
+	for {
+		line, err := lines.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if isBlank(line) {
+			break
+		}
+		password = append(password, line)
+		if err == io.EOF {
+			break
+		}
+	}
+	return strings.Join(password, "\n"), nil
+}
+
+// SecretStream serves reads of a secret from the output of the show command while it's still running. Content which
+// has been read is not kept, so sequential reads of a large secret don't need to hold all of it in memory. Reading
+// from an offset before the current one restarts showing the secret.
+type SecretStream struct {
+	ctx        context.Context
+	secretName string
+	nodeType   NodeType
+	output     io.ReadCloser
+	reader     io.Reader
+	offset     int64
+	eof        bool
+	mutex      sync.Mutex
+	// Number of bytes served before the content, for the length prefix of framed files
+	prefixSize int64
+}
+
+// NewSecretStream returns a stream for the content of a secret's file of the given type, the secret isn't shown until
+// the stream is read. The show command is stopped when the context is done.
+func NewSecretStream(ctx context.Context, secretName string, nodeType NodeType) *SecretStream {
+	return &SecretStream{ctx: ctx, secretName: secretName, nodeType: nodeType}
+}
+
+func (s *SecretStream) open() error {
+	s.close()
+	output, err := openSecret(s.ctx, s.secretName)
+	if err != nil {
+		return err
+	}
+	s.output = output
+	s.reader = output
+	if s.nodeType == FirstLine && passwordField != "" {
+		// The password field may be anywhere in the secret, so the secret is read before serving it.
+		body, err := ioutil.ReadAll(limitSecret(output))
+		if err != nil {
+			s.close()
+			return err
+		}
+		password, _ := GetFirstLine(string(body))
+		s.reader = strings.NewReader(password)
+	} else if s.nodeType == FirstLine && passwordUntilBlank {
+		// Whether a line ends the password is only known at the end of the line, so the password is read before
+		// serving it.
+		password, err := readPassword(limitSecret(output))
+		if err != nil {
+			s.close()
+			return err
+		}
+		s.reader = strings.NewReader(formatFirstLine(password))
+	} else if s.nodeType == FirstLine {
+		s.reader = &firstLineReader{reader: output}
+	}
+	if s.nodeType == FirstLine && passwordField == "" && !passwordUntilBlank && (trimFirstLine || stripFirstLineKey) {
+		// Trailing whitespace and the form of the line are only known at the end of the line, so the line is read
+		// before serving it.
+		line, err := ioutil.ReadAll(limitSecret(s.reader))
+		if err != nil {
+			s.close()
+			return err
+		}
+		s.reader = strings.NewReader(formatFirstLine(string(line)))
+	}
+	s.prefixSize = 0
+	if s.nodeType == Framed {
+		// The length of the content is only known at its end, so the content is read before serving it.
+		content, err := ioutil.ReadAll(limitSecret(s.reader))
+		if err == nil && (exceedsMaxSecretSize(int64(len(content))) || uint64(len(content)) > math.MaxUint32) {
+			err = ErrSecretTooLarge
+		}
+		if err != nil {
+			s.close()
+			return err
+		}
+		prefix := make([]byte, FramePrefixSize)
+		binary.BigEndian.PutUint32(prefix, uint32(len(content)))
+		s.reader = io.MultiReader(bytes.NewReader(prefix), bytes.NewReader(content))
+		s.prefixSize = FramePrefixSize
+	}
+	s.offset = 0
+	s.eof = false
+	return nil
+}
+
+func (s *SecretStream) close() error {
+	if s.output == nil {
+		return nil
+	}
+	err := s.output.Close()
+	s.output = nil
+	return err
+}
+
+// finish stops showing the secret once its content has been read, reporting a failure of the show command.
+func (s *SecretStream) finish() error {
+	s.eof = true
+	return s.close()
+}
+
+// ReadAt reads the secret's content at the given offset, returning io.EOF with the last bytes of the content.
+func (s *SecretStream) ReadAt(p []byte, offset int64) (n int, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if (s.output == nil && !s.eof) || offset < s.offset {
+		err = s.open()
+		if err != nil {
+			return 0, err
+		}
+	}
+	if s.eof {
+		return 0, io.EOF
+	}
+
+	if offset > s.offset {
+		skipped, err := io.CopyN(ioutil.Discard, s.reader, offset-s.offset)
+		s.offset += skipped
+		if err == io.EOF {
+			return 0, s.eofError()
+		} else if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err = io.ReadFull(s.reader, p)
+	s.offset += int64(n)
+	if exceedsMaxSecretSize(s.offset - s.prefixSize) {
+		s.close()
+		return 0, ErrSecretTooLarge
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return n, s.eofError()
+	}
+	return n, err
+}
+
+func (s *SecretStream) eofError() error {
+	err := s.finish()
+	if err != nil {
+		return err
+	}
+	return io.EOF
+}
+
+// Close stops showing the secret.
+func (s *SecretStream) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.close()
+}
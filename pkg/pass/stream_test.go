@@ -0,0 +1,264 @@
+package pass
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+type repeatReader byte
+
+func (r repeatReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = byte(r)
+	}
+	return len(p), nil
+}
+
+func countingRunner(body string, started *int) CommandRunner {
+	return func(name string, args ...string) (io.ReadCloser, error) {
+		*started++
+		return ioutil.NopCloser(strings.NewReader(body)), nil
+	}
+}
+
+func readStream(t *testing.T, stream *SecretStream, offset int64, size int) string {
+	t.Helper()
+	buf := make([]byte, size)
+	n, err := stream.ReadAt(buf, offset)
+	if err != nil && err != io.EOF {
+		t.Fatalf("Error reading stream at %d: %s", offset, err)
+	}
+	return string(buf[:n])
+}
+
+func TestSecretStreamSequentialReads(t *testing.T) {
+	started := 0
+	SetCommandRunner(countingRunner("hunter2\nusername: foo\n", &started))
+	defer SetCommandRunner(runCommand)
+
+	stream := NewSecretStream(context.Background(), "foo.gpg", Contents)
+	defer stream.Close()
+	chunks := []string{readStream(t, stream, 0, 4), readStream(t, stream, 4, 4), readStream(t, stream, 8, 64)}
+	if strings.Join(chunks, "") != "hunter2\nusername: foo\n" {
+		t.Errorf("Unexpected content %q", chunks)
+	}
+	if started != 1 {
+		t.Errorf("Expected sequential reads to show the secret once, shown %d times", started)
+	}
+
+	if readStream(t, stream, 0, 7) != "hunter2" {
+		t.Errorf("Unexpected content after reading from the start again")
+	}
+	if started != 2 {
+		t.Errorf("Expected reading backwards to show the secret again, shown %d times", started)
+	}
+}
+
+func TestSecretStreamFirstLine(t *testing.T) {
+	started := 0
+	SetCommandRunner(countingRunner("hunter2\nusername: foo\n", &started))
+	defer SetCommandRunner(runCommand)
+
+	stream := NewSecretStream(context.Background(), "foo.gpg", FirstLine)
+	defer stream.Close()
+	content := readStream(t, stream, 0, 64)
+	if content != "hunter2" {
+		t.Errorf("Unexpected first line %q", content)
+	}
+}
+
+func TestTrimFirstLine(t *testing.T) {
+	SetTrimFirstLine(true)
+	defer SetTrimFirstLine(false)
+	started := 0
+	defer SetCommandRunner(runCommand)
+
+	for body, expected := range map[string]string{
+		" \thunter2 \t\nusername: foo\n": "hunter2",
+		"hunter 2\t\n":                   "hunter 2",
+		"\t \n":                          "",
+		"  hunter2":                      "hunter2",
+	} {
+		SetCommandRunner(countingRunner(body, &started))
+		stream := NewSecretStream(context.Background(), "foo.gpg", FirstLine)
+		content := readStream(t, stream, 0, 64)
+		stream.Close()
+		if content != expected {
+			t.Errorf("Expected first line %q of %q, got %q", expected, body, content)
+		}
+
+		size, err := GetSecretSize(context.Background(), "foo.gpg")
+		if err != nil {
+			t.Fatalf("Error getting size: %s", err)
+		}
+		if size.GetFirstLineSize() != uint64(len(expected)) {
+			t.Errorf("Expected first line size %d for %q, got %d", len(expected), body, size.GetFirstLineSize())
+		}
+		firstLine, _ := GetFirstLine(body)
+		if firstLine != expected {
+			t.Errorf("Expected GetFirstLine to return %q for %q, got %q", expected, body, firstLine)
+		}
+	}
+}
+
+func TestStripFirstLineKey(t *testing.T) {
+	SetStripFirstLineKey(true)
+	defer SetStripFirstLineKey(false)
+	started := 0
+	defer SetCommandRunner(runCommand)
+
+	for body, expected := range map[string]string{
+		"password: hunter2\nusername: foo\n": "hunter2",
+		"Password:\thunter 2 \n":             "hunter 2",
+		"hunter2\nusername: foo\n":           "hunter2",
+		"hunter:2\n":                         "hunter:2",
+		"http://example.com\n":               "http://example.com",
+		"pin:":                               "",
+	} {
+		SetCommandRunner(countingRunner(body, &started))
+		stream := NewSecretStream(context.Background(), "foo.gpg", FirstLine)
+		content := readStream(t, stream, 0, 64)
+		stream.Close()
+		if content != expected {
+			t.Errorf("Expected first line %q of %q, got %q", expected, body, content)
+		}
+
+		size, err := GetSecretSize(context.Background(), "foo.gpg")
+		if err != nil {
+			t.Fatalf("Error getting size: %s", err)
+		}
+		if size.GetFirstLineSize() != uint64(len(expected)) {
+			t.Errorf("Expected first line size %d for %q, got %d", len(expected), body, size.GetFirstLineSize())
+		}
+		firstLine, _ := GetFirstLine(body)
+		if firstLine != expected {
+			t.Errorf("Expected GetFirstLine to return %q for %q, got %q", expected, body, firstLine)
+		}
+	}
+}
+
+func BenchmarkSecretStreamSequentialRead(b *testing.B) {
+	const secretSize = 8 << 20
+	SetCommandRunner(func(name string, args ...string) (io.ReadCloser, error) {
+		return ioutil.NopCloser(io.LimitReader(repeatReader('x'), secretSize)), nil
+	})
+	defer SetCommandRunner(runCommand)
+
+	buf := make([]byte, 4096)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		stream := NewSecretStream(context.Background(), "large.gpg", Contents)
+		var offset int64
+		for {
+			n, err := stream.ReadAt(buf, offset)
+			offset += int64(n)
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				b.Fatalf("Error reading stream: %s", err)
+			}
+		}
+		stream.Close()
+	}
+}
+
+func TestSecretStreamFramed(t *testing.T) {
+	started := 0
+	SetCommandRunner(countingRunner("hunter2\nusername: foo\n", &started))
+	defer SetCommandRunner(runCommand)
+
+	stream := NewSecretStream(context.Background(), "foo.gpg", Framed)
+	defer stream.Close()
+	chunks := []string{readStream(t, stream, 0, 2), readStream(t, stream, 2, 6), readStream(t, stream, 8, 64)}
+	expected := "\x00\x00\x00\x16hunter2\nusername: foo\n"
+	if strings.Join(chunks, "") != expected {
+		t.Errorf("Expected %q, got %q", expected, chunks)
+	}
+
+	SetMaxSecretSize(21)
+	defer SetMaxSecretSize(0)
+	_, err := NewSecretStream(context.Background(), "foo.gpg", Framed).ReadAt(make([]byte, 64), 0)
+	if err != ErrSecretTooLarge {
+		t.Errorf("Expected ErrSecretTooLarge, got %v", err)
+	}
+	SetMaxSecretSize(22)
+	if content := readStream(t, NewSecretStream(context.Background(), "foo.gpg", Framed), 0, 64); content != expected {
+		t.Errorf("Expected a secret of the maximum size to be framed, got %q", content)
+	}
+}
+
+func TestPasswordUntilBlank(t *testing.T) {
+	SetPasswordUntilBlank(true)
+	defer SetPasswordUntilBlank(false)
+	started := 0
+	defer SetCommandRunner(runCommand)
+
+	for body, expected := range map[string]string{
+		"hunter2\nusername: foo\n":                                      "hunter2\nusername: foo",
+		"hunter2\n\nusername: foo\n":                                    "hunter2",
+		"-----BEGIN KEY-----\nabc\n-----END KEY-----\n \nusername: foo": "-----BEGIN KEY-----\nabc\n-----END KEY-----",
+		"line 1\nline 2":                                                "line 1\nline 2",
+		"\nusername: foo\n":                                             "",
+		"":                                                              "",
+	} {
+		SetCommandRunner(countingRunner(body, &started))
+		stream := NewSecretStream(context.Background(), "foo.gpg", FirstLine)
+		content := readStream(t, stream, 0, 64)
+		stream.Close()
+		if content != expected {
+			t.Errorf("Expected password %q of %q, got %q", expected, body, content)
+		}
+
+		size, err := GetSecretSize(context.Background(), "foo.gpg")
+		if err != nil {
+			t.Fatalf("Error getting size: %s", err)
+		}
+		if size.GetFirstLineSize() != uint64(len(expected)) {
+			t.Errorf("Expected password size %d for %q, got %d", len(expected), body, size.GetFirstLineSize())
+		}
+		firstLine, _ := GetFirstLine(body)
+		if firstLine != expected {
+			t.Errorf("Expected GetFirstLine to return %q for %q, got %q", expected, body, firstLine)
+		}
+	}
+}
+
+func TestPasswordField(t *testing.T) {
+	SetPasswordField("Password")
+	defer SetPasswordField("")
+	started := 0
+	defer SetCommandRunner(runCommand)
+
+	for body, expected := range map[string]string{
+		"https://example.com\nusername: foo\npassword: hunter2\n": "hunter2",
+		"username: foo\nPassword:  hunter2  ":                     "hunter2",
+		"password: hunter2\npassword: other\n":                    "hunter2",
+		"hunter2\nusername: foo\n":                                "hunter2",
+		"hunter2":                                                 "hunter2",
+		"":                                                        "",
+	} {
+		SetCommandRunner(countingRunner(body, &started))
+		stream := NewSecretStream(context.Background(), "foo.gpg", FirstLine)
+		content := readStream(t, stream, 0, 64)
+		stream.Close()
+		if content != expected {
+			t.Errorf("Expected password %q of %q, got %q", expected, body, content)
+		}
+
+		size, err := GetSecretSize(context.Background(), "foo.gpg")
+		if err != nil {
+			t.Fatalf("Error getting size: %s", err)
+		}
+		if size.GetFirstLineSize() != uint64(len(expected)) {
+			t.Errorf("Expected password size %d for %q, got %d", len(expected), body, size.GetFirstLineSize())
+		}
+		firstLine, _ := GetFirstLine(body)
+		if firstLine != expected {
+			t.Errorf("Expected GetFirstLine to return %q for %q, got %q", expected, body, firstLine)
+		}
+	}
+}
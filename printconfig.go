@@ -0,0 +1,36 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/femnad/passfuse/pkg/pass"
+	"io"
+)
+
+// effectiveConfig is the configuration passfuse uses after merging defaults, the config file and the command line.
+type effectiveConfig struct {
+	Args              args     `json:"args"`
+	MountPath         string   `json:"mount_path"`
+	PasswordStorePath string   `json:"password_store_path"`
+	FileTypes         []string `json:"file_types"`
+}
+
+// printConfig writes the effective configuration as JSON, with the mount path and the store path resolved.
+func printConfig(args args, w io.Writer) error {
+	mountPath, err := resolveMountPath(args.MountPath)
+	if err != nil {
+		return fmt.Errorf("error resolving mount path: %s", err)
+	}
+	config := effectiveConfig{
+		Args:              args,
+		MountPath:         mountPath,
+		PasswordStorePath: pass.GetStorePath(args.PasswordStorePath),
+		FileTypes:         getOptions(args).FileTypeNames(),
+	}
+	output, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, string(output))
+	return err
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPrintConfig(t *testing.T) {
+	parsed, _, err := parseArgs([]string{"--firstlinefiles", "--has-field", "url", "--mountpath", "mnt"})
+	if err != nil {
+		t.Fatalf("Error parsing arguments: %s", err)
+	}
+
+	output := bytes.Buffer{}
+	err = printConfig(parsed, &output)
+	if err != nil {
+		t.Fatalf("Error printing config: %s", err)
+	}
+	var config effectiveConfig
+	err = json.Unmarshal(output.Bytes(), &config)
+	if err != nil {
+		t.Fatalf("Error parsing printed config %q: %s", output.String(), err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("Error getting working directory: %s", err)
+	}
+	if config.MountPath != filepath.Join(wd, "mnt") {
+		t.Errorf("Expected the resolved mount path, got %s", config.MountPath)
+	}
+	if config.PasswordStorePath != os.ExpandEnv("$HOME/.password-store") {
+		t.Errorf("Expected the default store path, got %s", config.PasswordStorePath)
+	}
+	if strings.Join(config.FileTypes, ",") != "contents,first line" {
+		t.Errorf("Expected content and first line files, got %v", config.FileTypes)
+	}
+	if config.Args.HasField != "url" || config.Args.MaxOpenFiles != 1024 {
+		t.Errorf("Expected the given arguments and defaults, got %+v", config.Args)
+	}
+}
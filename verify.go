@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/femnad/passfuse/pkg/pass"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+)
+
+// readManifest reads a manifest mapping secret names, without the .gpg suffix, to SHA-256 digests of their content.
+func readManifest(manifestPath string) (map[string]string, error) {
+	content, err := ioutil.ReadFile(manifestPath)
+	if err != nil {
+		return nil, fmt.Errorf("error reading manifest %s: %s", manifestPath, err)
+	}
+	manifest := make(map[string]string)
+	err = json.Unmarshal(content, &manifest)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing manifest %s: %s", manifestPath, err)
+	}
+	return manifest, nil
+}
+
+// verify compares the digests of the secrets in the store with the ones in the manifest and writes a line for each
+// difference, prefixed with ~ for mismatching digests, - for secrets missing from the store and + for secrets missing
+// from the manifest. Returns whether all secrets match.
+func verify(args args, w io.Writer) (bool, error) {
+	manifest, err := readManifest(args.Verify)
+	if err != nil {
+		return false, err
+	}
+	root, err := pass.GetPassTree(args.PasswordStorePath, args.Prefix, pass.ParseOptions{StrictGpg: args.StrictGpg})
+	if err != nil {
+		return false, err
+	}
+
+	matching := true
+	found := make(map[string]bool)
+	for _, leaf := range pass.GetLeaves(root) {
+		name := strings.TrimSuffix(leaf.Secret, pass.GetSecretSuffix())
+		found[name] = true
+		expected, listed := manifest[name]
+		if !listed {
+			fmt.Fprintf(w, "+ %s\n", name)
+			matching = false
+			continue
+		}
+		digest, err := pass.GetSecretDigest(context.Background(), leaf.Secret)
+		if err != nil {
+			return false, err
+		}
+		if digest != strings.ToLower(expected) {
+			fmt.Fprintf(w, "~ %s\n", name)
+			matching = false
+		}
+	}
+
+	var missing []string
+	for name := range manifest {
+		if !found[name] {
+			missing = append(missing, name)
+		}
+	}
+	sort.Strings(missing)
+	for _, name := range missing {
+		fmt.Fprintf(w, "- %s\n", name)
+		matching = false
+	}
+	return matching, nil
+}
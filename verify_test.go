@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	storePath := makeStore(t, "work/github.gpg", "work/aws.gpg", "personal/new.gpg")
+	defer os.RemoveAll(storePath)
+	setSecrets(map[string]string{"work/github": "hunter2\n", "work/aws": "changed\n", "personal/new": "new\n"})
+
+	// The digest of "hunter2\n" matches, the one for work/aws doesn't.
+	manifest := `{
+		"work/github": "46a9d5bde718bf366178313019f04a753bad00685d38e3ec81c8628f35dfcb1b",
+		"work/aws": "c3a1c1fc4efb8d2d2cb67b3dde8c4f859fc47c4e8a218b9c0e3e5f2fbc78e3f1",
+		"work/old": "0000000000000000000000000000000000000000000000000000000000000000"
+	}`
+	manifestPath := filepath.Join(storePath, "manifest.json")
+	err := ioutil.WriteFile(manifestPath, []byte(manifest), 0600)
+	if err != nil {
+		t.Fatalf("Error writing manifest: %s", err)
+	}
+
+	report := bytes.Buffer{}
+	matching, err := verify(args{PasswordStorePath: storePath, StrictGpg: true, Verify: manifestPath}, &report)
+	if err != nil {
+		t.Fatalf("Error verifying: %s", err)
+	}
+	if matching {
+		t.Errorf("Expected verification to fail")
+	}
+	expected := "+ personal/new\n~ work/aws\n- work/old\n"
+	if report.String() != expected {
+		t.Errorf("Expected report %q, got %q", expected, report.String())
+	}
+}